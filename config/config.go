@@ -1,6 +1,7 @@
 package config
 
 import (
+	"context"
 	"encoding/json"
 	log "github.com/sirupsen/logrus"
 
@@ -9,6 +10,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 )
 
 var logging *log.Entry
@@ -16,6 +19,7 @@ var logging *log.Entry
 // ConfigPath the path where all config files will stored
 var ConfigPath string
 
+var jsonConfigLock sync.RWMutex
 var jsonConfigNew map[string]interface{}
 
 // ParseCmdLine parse your command line parameter to internal variables
@@ -32,7 +36,9 @@ func Init() {
 		},
 	)
 
+	jsonConfigLock.Lock()
 	jsonConfigNew = make(map[string]interface{})
+	jsonConfigLock.Unlock()
 }
 
 // Read will read the config from an file calles core.json
@@ -56,13 +62,53 @@ func Read() {
 
 	logging.Debug("Successfully Opened '" + ConfigPath + "/core.json'")
 	byteValue, _ := ioutil.ReadAll(jsonFile)
-	err = json.Unmarshal(byteValue, &jsonConfigNew)
+
+	// a broken file don't touch the current config
+	readConfig := make(map[string]interface{})
+	if err := json.Unmarshal(byteValue, &readConfig); err != nil {
+		logging.Error(err.Error())
+		return
+	}
+
+	jsonConfigLock.Lock()
+	if jsonConfigNew == nil {
+		jsonConfigNew = make(map[string]interface{})
+	}
+	for name, jsonObject := range readConfig {
+		jsonConfigNew[name] = jsonObject
+	}
+	jsonConfigLock.Unlock()
 
 }
 
+// reload read core.json and replace the whole config, so removed objects are gone
+//
+// if the file can not be parsed, the current config is kept
+func reload() error {
+
+	byteValue, err := ioutil.ReadFile(ConfigPath + "/core.json")
+	if err != nil {
+		return err
+	}
+
+	readConfig := make(map[string]interface{})
+	if err := json.Unmarshal(byteValue, &readConfig); err != nil {
+		return err
+	}
+
+	jsonConfigLock.Lock()
+	jsonConfigNew = readConfig
+	jsonConfigLock.Unlock()
+
+	return nil
+}
+
 // GetJSONObject Return an json object
 func GetJSONObject(name string) (map[string]interface{}, error) {
 
+	jsonConfigLock.RLock()
+	defer jsonConfigLock.RUnlock()
+
 	// then we try to get the object
 	if jsonObject, ok := jsonConfigNew[name].(map[string]interface{}); ok {
 		return jsonObject, nil
@@ -75,17 +121,60 @@ func GetJSONObject(name string) (map[string]interface{}, error) {
 func SetJSONObject(name string, jsonNode map[string]interface{}) error {
 
 	// save it
+	jsonConfigLock.Lock()
 	jsonConfigNew[name] = jsonNode
+	jsonConfigLock.Unlock()
 
 	return nil
 }
 
 // Save save you config to the core.json
 func Save() {
+	jsonConfigLock.RLock()
 	byteValue, _ := json.MarshalIndent(jsonConfigNew, "", "    ")
+	jsonConfigLock.RUnlock()
 	err := ioutil.WriteFile(ConfigPath+"/core.json", byteValue, 0644)
 	if err != nil {
 		logging.Error(err.Error())
 		os.Exit(-1)
 	}
 }
+
+// Watch [BLOCKING] check every interval if core.json was changed, read it again and call onChange
+//
+// it run until ctx is done
+func Watch(ctx context.Context, interval time.Duration, onChange func()) {
+
+	lastModified := time.Time{}
+	if info, err := os.Stat(ConfigPath + "/core.json"); err == nil {
+		lastModified = info.ModTime()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(ConfigPath + "/core.json")
+		if err != nil || !info.ModTime().After(lastModified) {
+			continue
+		}
+		lastModified = info.ModTime()
+
+		logging.Info("Config changed, reload '" + ConfigPath + "/core.json'")
+
+		if err := reload(); err != nil {
+			logging.Error(err.Error())
+			continue
+		}
+
+		if onChange != nil {
+			onChange()
+		}
+	}
+}
@@ -17,7 +17,13 @@ along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
 */
 package config
 
-import "testing"
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
 
 func TestInit(t *testing.T) {
 	ParseCmdLine()
@@ -55,3 +61,58 @@ func CreateNewConfigEntry(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestWatch(t *testing.T) {
+	Init()
+
+	ConfigPath = "/tmp/gopilot-config-watch"
+	os.RemoveAll(ConfigPath)
+	os.MkdirAll(ConfigPath, 0755)
+	defer os.RemoveAll(ConfigPath)
+	Read()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changed := make(chan struct{}, 10)
+	go Watch(ctx, 10*time.Millisecond, func() {
+		changed <- struct{}{}
+	})
+
+	// someone else edit the file
+	time.Sleep(50 * time.Millisecond)
+	ioutil.WriteFile(ConfigPath+"/core.json", []byte(`{"watched":{"value":"new"}}`), 0644)
+	os.Chtimes(ConfigPath+"/core.json", time.Now().Add(time.Second), time.Now().Add(time.Second))
+
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Change was not detected")
+	}
+
+	jsonObject, err := GetJSONObject("watched")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jsonObject["value"] != "new" {
+		t.Errorf("Expected the new value, got %v", jsonObject["value"])
+	}
+
+	// a broken file keep the current config
+	ioutil.WriteFile(ConfigPath+"/core.json", []byte(`{"watched":`), 0644)
+	os.Chtimes(ConfigPath+"/core.json", time.Now().Add(2*time.Second), time.Now().Add(2*time.Second))
+
+	select {
+	case <-changed:
+		t.Fatal("Broken config was reported as change")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	jsonObject, err = GetJSONObject("watched")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jsonObject["value"] != "new" {
+		t.Errorf("Expected the old value, got %v", jsonObject["value"])
+	}
+}
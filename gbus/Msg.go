@@ -21,6 +21,7 @@ package gbus
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
 )
 
 // Msg represent a single message inside the bus
@@ -51,6 +52,31 @@ type Msg struct {
 
 	// payload
 	Payload string `json:"v"`
+
+	// Encrypted is true if the payload is encrypted for the NodeTarget
+	Encrypted bool `json:"e,omitempty"`
+
+	// Timestamp is the unix-time in nanoseconds when the message was signed
+	Timestamp int64 `json:"ts,omitempty"`
+
+	// Nonce is an random string that is only used once per node, used for replay-protection
+	Nonce string `json:"n,omitempty"`
+
+	// Signature over all routed fields and the payload, "" if the message is unsigned
+	Signature string `json:"sig,omitempty"`
+
+	// MsgID identify the message for duplicate-suppression, it is set by the first node which send it with QoS
+	MsgID string `json:"mid,omitempty"`
+
+	// QoS is the delivery-guarantee of the message ( QoSAtMostOnce or QoSAtLeastOnce )
+	QoS int `json:"q,omitempty"`
+
+	// Seq is the sequence-number on the current socket-link, the remote side answer with an ACK
+	Seq uint64 `json:"sq,omitempty"`
+
+	// verified is true if the signature was already checked by us
+	// so we don't check it twice ( which would look like an replay )
+	verified bool
 }
 
 // ContextSet will set the context
@@ -63,6 +89,27 @@ func (curMessage *Msg) ContextGet() interface{} {
 	return curMessage.context
 }
 
+// signingString return the string which will be signed
+//
+// it contains all routed fields, the payload, the timestamp and the nonce
+// we use an json-array, so that no field can "move" into another one
+func (curMessage *Msg) signingString() string {
+
+	b, _ := json.Marshal([]string{
+		curMessage.NodeSource,
+		curMessage.GroupSource,
+		curMessage.NodeTarget,
+		curMessage.GroupTarget,
+		curMessage.Command,
+		curMessage.Payload,
+		strconv.FormatBool(curMessage.Encrypted),
+		strconv.FormatInt(curMessage.Timestamp, 10),
+		curMessage.Nonce,
+	})
+
+	return string(b)
+}
+
 // ToJSONByteArray will convert an message to an byte-array for sending it out
 func (curMessage *Msg) ToJSONByteArray() ([]byte, error) {
 
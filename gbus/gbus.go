@@ -43,17 +43,26 @@ type SubscriberList struct {
 type SubscriberListEntry struct {
 	NodeTarget  string `json:"nodeTarget"`
 	GroupTarget string `json:"groupTarget"`
+	Command     string `json:"command,omitempty"`
 }
 
 // callbacks
 type OnMessageFct func(*Msg, string /* group */, string /*command*/, string /*payload*/) // For example: onMessage(message *msgbus.Msg, group, command, payload string)
 
+// MiddlewareFct will be called for every message before it is placed on the bus
+// if it return an error, the message is rejected and will not be delivered
+type MiddlewareFct func(message *Msg) error
+
 // SubscriberList represent the list for all subcribers
 type GBus struct {
 	log             *logrus.Entry
 	subscribersLock sync.Mutex
 	subscribers     []subscriber
 
+	// middlewares
+	middlewaresLock sync.Mutex
+	middlewares     []MiddlewareFct
+
 	// messages
 	lastMsgNo int
 	messages  chan *Msg
@@ -101,11 +110,15 @@ func (bus *GBus) onPublishListWorker() {
 			if message.GroupTarget != "" && subscriber.filter.GroupTarget != "" && message.GroupTarget != subscriber.filter.GroupTarget {
 				continue
 			}
+			if subscriber.filter.Command != "" && message.Command != subscriber.filter.Command {
+				continue
+			}
 
 			bus.log.WithFields(logrus.Fields{
 				"subID":                  subscriber.id,
 				"subscriber.NodeTarget":  subscriber.filter.NodeTarget,
 				"subscriber.GroupTarget": subscriber.filter.GroupTarget,
+				"subscriber.Command":     subscriber.filter.Command,
 			}).Debug("Message match, call onMessage()")
 
 			subscriber.onMessage(message, message.GroupTarget, message.Command, message.Payload)
@@ -122,11 +135,17 @@ func (bus *GBus) onPublishListWorker() {
 // Subscribe will register an callback function
 // this function is called wenn a new message arrive and the listenForNodeName and listenForGroupName matches the target node/group in the message
 func (bus *GBus) Subscribe(id string, listenForNodeName string, listenForGroupName string, onMessageFP OnMessageFct) error {
+	return bus.SubscribeCommand(id, listenForNodeName, listenForGroupName, "", onMessageFP)
+}
+
+// SubscribeCommand is like Subscribe, but only messages with the command are delivered ( "" means every command )
+func (bus *GBus) SubscribeCommand(id string, listenForNodeName string, listenForGroupName string, listenForCommand string, onMessageFP OnMessageFct) error {
 
 	var newSubscriber subscriber
 	newSubscriber.id = id
 	newSubscriber.filter.NodeTarget = listenForNodeName
 	newSubscriber.filter.GroupTarget = listenForGroupName
+	newSubscriber.filter.Command = listenForCommand
 	newSubscriber.onMessage = onMessageFP
 
 	// append it to the list
@@ -136,6 +155,7 @@ func (bus *GBus) Subscribe(id string, listenForNodeName string, listenForGroupNa
 		"subID":                 newSubscriber.id,
 		"subscriberNodeTarget":  newSubscriber.filter.NodeTarget,
 		"subscriberGroupTarget": newSubscriber.filter.GroupTarget,
+		"subscriberCommand":     newSubscriber.filter.Command,
 	}).Debug("Subscribe")
 
 	bus.subscribers = append(bus.subscribers, newSubscriber)
@@ -186,11 +206,19 @@ func (bus *GBus) unSubscribeFull(id string, listenForNodeName string, listenForG
 	return nil
 }
 
+// Use will add an middleware which is called for every published message
+// middlewares are called in the order they are added
+func (bus *GBus) Use(middleware MiddlewareFct) {
+	bus.middlewaresLock.Lock()
+	bus.middlewares = append(bus.middlewares, middleware)
+	bus.middlewaresLock.Unlock()
+}
+
 // PublishPayload [BLOCKING] will place a new message to the bus
 // for socket-connections it will write directly to the socket itselfe
 func (bus *GBus) PublishPayload(nodeSource, nodeTarget, groupSource, groupTarget, command, payload string) error {
 
-	bus.PublishMsg(Msg{
+	return bus.PublishMsg(Msg{
 		NodeSource:  nodeSource,
 		NodeTarget:  nodeTarget,
 		GroupSource: groupSource,
@@ -198,14 +226,27 @@ func (bus *GBus) PublishPayload(nodeSource, nodeTarget, groupSource, groupTarget
 		Command:     command,
 		Payload:     payload,
 	})
-
-	return nil
 }
 
 // PublishMsg [BLOCKING] will place a new message to the bus
 // for socket-connections it will write directly to the socket itselfe
 func (bus *GBus) PublishMsg(message Msg) error {
 
+	// run middlewares
+	bus.middlewaresLock.Lock()
+	middlewares := bus.middlewares
+	bus.middlewaresLock.Unlock()
+
+	for _, middleware := range middlewares {
+		if err := middleware(&message); err != nil {
+			bus.log.WithFields(logrus.Fields{
+				"message.NodeSource": message.NodeSource,
+				"message.Command":    message.Command,
+			}).Error(err)
+			return err
+		}
+	}
+
 	// set message id
 	message.id = bus.lastMsgNo
 	bus.lastMsgNo = bus.lastMsgNo + 1
@@ -226,6 +267,7 @@ func (bus *GBus) SubscriberListGet() SubscriberList {
 		newSubscriberList.Subscriber[subscriber.id] = SubscriberListEntry{
 			NodeTarget:  subscriber.filter.NodeTarget,
 			GroupTarget: subscriber.filter.GroupTarget,
+			Command:     subscriber.filter.Command,
 		}
 
 	}
@@ -26,18 +26,17 @@ import (
 	"gitlab.com/gopilot/lib/clog"
 )
 
-var bus GBus
-
 func TestInit(t *testing.T) {
 
 	// we need our nodename
 	clog.EnableDebug()
 	clog.Init()
 
+	var bus GBus
 	bus.Init()
 	bus.Run()
 
-	isClosed := false
+	isClosed := make(chan struct{}, 1)
 
 	bus.Subscribe("0", "local", "test1", func(message *Msg, group, command, payload string) {
 		bus.PublishPayload("gotest", "local", "gotest", "test2", "", "")
@@ -48,7 +47,7 @@ func TestInit(t *testing.T) {
 	})
 
 	bus.Subscribe("3", "local", "end", func(message *Msg, group, command, payload string) {
-		isClosed = true
+		isClosed <- struct{}{}
 	})
 
 	bus.Subscribe("4", "local", "noreceive", func(message *Msg, group, command, payload string) {
@@ -64,11 +63,10 @@ func TestInit(t *testing.T) {
 	// now we send some messages
 	bus.PublishPayload("gotest", "local", "gotest", "test1", "", "")
 
-	for {
-		if isClosed == true {
-			break
-		}
-		time.Sleep(time.Second)
+	select {
+	case <-isClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("End was not recieved")
 	}
 
 }
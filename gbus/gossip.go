@@ -0,0 +1,836 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/gopilot/lib/mynodename"
+)
+
+// GossipGroup is the reserved group for membership-events and the messages between gossip-nodes
+const GossipGroup = "_members"
+
+// Events which are published on the bus, the payload is the Member as json
+const (
+	GossipJoin   = "memberJoin"
+	GossipLeave  = "memberLeave"
+	GossipFailed = "memberFailed"
+)
+
+// States of an Member
+const (
+	MemberAlive   = "alive"
+	MemberSuspect = "suspect" // an probe failed, if it don't refute it in SuspicionTimeout it is dead
+	MemberDead    = "dead"
+	MemberLeft    = "left"
+)
+
+// Defaults of GossipOptions
+const (
+	DefaultProbeInterval    = time.Second
+	DefaultProbeTimeout     = 500 * time.Millisecond
+	DefaultIndirectChecks   = 3
+	DefaultSuspicionTimeout = 5 * time.Second
+	DefaultRetransmitMult   = 4
+)
+
+// how many updates are piggybacked on one message
+const gossipMaxPiggyback = 16
+
+// messages between gossip-nodes
+const (
+	cmdGossipPing    = "gossipPing"
+	cmdGossipPingReq = "gossipPingReq"
+	cmdGossipAck     = "gossipAck"
+	cmdGossipSync    = "gossipSync"
+	cmdGossipSyncAck = "gossipSyncAck"
+)
+
+// ErrGossipJoin is returned if no node to join was reachable
+var ErrGossipJoin = errors.New("No node to join was reachable")
+
+// Member is an node of the cluster
+//
+// the incarnation is only increased by the node itselfe, so it can refute an suspicion of other nodes
+type Member struct {
+	Name        string `json:"n"`
+	Address     string `json:"a,omitempty"`
+	State       string `json:"s"`
+	Incarnation uint64 `json:"i,omitempty"`
+}
+
+// active return true if the member is alive or suspected
+func (member Member) active() bool {
+	return member.State == MemberAlive || member.State == MemberSuspect
+}
+
+// GossipOptions hold the settings of an gossip-node
+type GossipOptions struct {
+	// Name of this node ( "" means mynodename.NodeName )
+	Name string
+
+	// Address where other nodes reach us
+	Address string
+
+	// Resolve return the transport for the address of an member
+	// ( nil means unix-sockets for addresses which start with "/" or "@", otherwise tcp )
+	Resolve func(address string) Transport
+
+	// ProbeInterval is the time between two probes, ProbeTimeout the time we wait for an direct ack
+	ProbeInterval time.Duration
+	ProbeTimeout  time.Duration
+
+	// IndirectChecks is the count of members we ask to probe an member which not answered
+	IndirectChecks int
+
+	// SuspicionTimeout is the time an suspected member have to refute, before it is declared as dead
+	SuspicionTimeout time.Duration
+
+	// RetransmitMult * log10(members+1) is how often an update is piggybacked
+	RetransmitMult int
+
+	// Bus get the join/leave/failed-events ( nil disable it )
+	Bus *GBus
+
+	// Socket are the options of the links to the other nodes
+	Socket SocketOptions
+}
+
+// Gossip is an node of an cluster without an central server ( SWIM )
+//
+// every ProbeInterval one member is pinged, if it not answer other members are asked to ping it ( indirect probe ).
+// If this also fail the member is suspected, and declared dead after SuspicionTimeout.
+// Changes of the member-list are piggybacked on the pings and acks
+type Gossip struct {
+	log     *logrus.Entry
+	options GossipOptions
+	name    string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock        sync.Mutex
+	members     map[string]*gossipMember
+	broadcasts  []*gossipBroadcast
+	probeOrder  []string
+	probeIndex  int
+	suspectWait map[string]*time.Timer
+
+	linksLock sync.Mutex
+	links     map[string]*gossipLink
+
+	acksLock sync.Mutex
+	acks     map[uint64]chan struct{}
+	seq      uint64 // atomic
+}
+
+type gossipMember struct {
+	Member
+}
+
+// gossipBroadcast is an update which wait to be piggybacked
+type gossipBroadcast struct {
+	member    Member
+	transmits int
+}
+
+// gossipLink is an connection to another node, replies come back on the same link
+type gossipLink struct {
+	socket   *SocketConnection
+	ready    chan struct{} // closed after the handshake
+	done     chan struct{} // closed if the link is gone
+	doneOnce sync.Once
+	cancel   context.CancelFunc
+}
+
+// gossipPacket is the payload of the messages between gossip-nodes
+type gossipPacket struct {
+	Seq     uint64   `json:"seq,omitempty"`
+	Target  string   `json:"target,omitempty"`  // ping-req: the member we should ping
+	Members []Member `json:"members,omitempty"` // piggybacked updates, or the full list on sync
+}
+
+// GossipNew create an new gossip-node
+func GossipNew(options GossipOptions) *Gossip {
+
+	if options.Name == "" {
+		options.Name = mynodename.NodeName
+	}
+	if options.Resolve == nil {
+		options.Resolve = gossipResolve
+	}
+	if options.ProbeInterval <= 0 {
+		options.ProbeInterval = DefaultProbeInterval
+	}
+	if options.ProbeTimeout <= 0 {
+		options.ProbeTimeout = DefaultProbeTimeout
+	}
+	if options.IndirectChecks <= 0 {
+		options.IndirectChecks = DefaultIndirectChecks
+	}
+	if options.SuspicionTimeout <= 0 {
+		options.SuspicionTimeout = DefaultSuspicionTimeout
+	}
+	if options.RetransmitMult <= 0 {
+		options.RetransmitMult = DefaultRetransmitMult
+	}
+
+	newGossip := Gossip{
+		log: logrus.WithFields(logrus.Fields{
+			"prefix": "GOSSIP",
+			"node":   options.Name,
+		}),
+		options:     options,
+		name:        options.Name,
+		members:     make(map[string]*gossipMember),
+		suspectWait: make(map[string]*time.Timer),
+		links:       make(map[string]*gossipLink),
+		acks:        make(map[uint64]chan struct{}),
+	}
+	newGossip.ctx, newGossip.cancel = context.WithCancel(context.Background())
+
+	newGossip.members[options.Name] = &gossipMember{
+		Member: Member{
+			Name:    options.Name,
+			Address: options.Address,
+			State:   MemberAlive,
+		},
+	}
+
+	return &newGossip
+}
+
+// gossipResolve is the default for GossipOptions.Resolve
+func gossipResolve(address string) Transport {
+	if strings.HasPrefix(address, "/") || strings.HasPrefix(address, "@") {
+		return NetTransport{Network: "unix", Address: address}
+	}
+	return NetTransport{Network: "tcp", Address: address}
+}
+
+// Run [BLOCKING] accept other nodes on the listener and probe the members until ctx is done or Stop() is called
+func (gossip *Gossip) Run(ctx context.Context, listener Listener) error {
+
+	server := SocketNew()
+	server.OptionsSet(gossip.options.Socket)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			gossip.Stop()
+		case <-gossip.ctx.Done():
+		}
+		server.Shutdown()
+	}()
+
+	go gossip.probeLoop()
+
+	err := server.ServeListener(listener, SocketCallbacks{
+		OnMessage: gossip.handle,
+	})
+	if err == ErrServerClosed {
+		return nil
+	}
+	gossip.Stop()
+	return err
+}
+
+// Stop the node without telling the others, for them it look like an failure
+func (gossip *Gossip) Stop() {
+	gossip.cancel()
+
+	gossip.lock.Lock()
+	for name, timer := range gossip.suspectWait {
+		timer.Stop()
+		delete(gossip.suspectWait, name)
+	}
+	gossip.lock.Unlock()
+}
+
+// Join contact the nodes at the addresses and exchange the member-list with them
+//
+// it return how many nodes answered, ErrGossipJoin if none
+func (gossip *Gossip) Join(addresses ...string) (int, error) {
+
+	var wait sync.WaitGroup
+	var joined int32
+
+	for _, address := range addresses {
+		wait.Add(1)
+		go func(address string) {
+			defer wait.Done()
+
+			// we don't know the name of the node yet
+			seed := Member{Name: "seed:" + address, Address: address}
+			if gossip.request(seed, cmdGossipSync, gossipPacket{Members: gossip.Members()}, gossip.options.ProbeTimeout*4) {
+				atomic.AddInt32(&joined, 1)
+			}
+			gossip.linkClose(seed.Name)
+		}(address)
+	}
+	wait.Wait()
+
+	if joined == 0 {
+		return 0, ErrGossipJoin
+	}
+	return int(joined), nil
+}
+
+// Leave tell the other members that we leave and stop the node
+func (gossip *Gossip) Leave(timeout time.Duration) {
+
+	gossip.lock.Lock()
+	self := gossip.members[gossip.name]
+	self.State = MemberLeft
+	self.Incarnation++
+	left := self.Member
+	gossip.lock.Unlock()
+
+	gossip.log.Info("Leave the cluster")
+
+	var wait sync.WaitGroup
+	for _, member := range gossip.Members() {
+		if member.Name == gossip.name || !member.active() {
+			continue
+		}
+		wait.Add(1)
+		go func(member Member) {
+			defer wait.Done()
+			gossip.request(member, cmdGossipSync, gossipPacket{Members: []Member{left}}, timeout)
+		}(member)
+	}
+	wait.Wait()
+
+	gossip.Stop()
+}
+
+// Members return all known members with there state, sorted by name
+func (gossip *Gossip) Members() []Member {
+	gossip.lock.Lock()
+	defer gossip.lock.Unlock()
+
+	list := make([]Member, 0, len(gossip.members))
+	for _, member := range gossip.members {
+		list = append(list, member.Member)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// MemberGet return the member with the name
+func (gossip *Gossip) MemberGet(name string) (Member, bool) {
+	gossip.lock.Lock()
+	defer gossip.lock.Unlock()
+
+	member, exist := gossip.members[name]
+	if !exist {
+		return Member{}, false
+	}
+	return member.Member, true
+}
+
+// ################################# member-list #################################
+
+// merge apply updates of other nodes and publish the events
+func (gossip *Gossip) merge(updates []Member) {
+
+	type event struct {
+		command string
+		member  Member
+	}
+	var events []event
+
+	gossip.lock.Lock()
+	for _, update := range updates {
+		if command := gossip.apply(update); command != "" {
+			events = append(events, event{command, update})
+		}
+	}
+	gossip.lock.Unlock()
+
+	for _, event := range events {
+		gossip.publish(event.command, event.member)
+	}
+}
+
+// apply an update with the rules of SWIM, gossip.lock must be held
+//
+// it return the event which must be published
+func (gossip *Gossip) apply(update Member) string {
+
+	// someone think we are gone, so we refute it with an higher incarnation
+	if update.Name == gossip.name {
+		self := gossip.members[gossip.name]
+		if self.State == MemberAlive && (update.State == MemberSuspect || update.State == MemberDead) && update.Incarnation >= self.Incarnation {
+			self.Incarnation = update.Incarnation + 1
+			gossip.broadcastAdd(self.Member)
+			gossip.log.WithField("incarnation", self.Incarnation).Info("Refute suspicion")
+		}
+		return ""
+	}
+
+	current, exist := gossip.members[update.Name]
+	wasActive := exist && current.active()
+
+	if exist {
+		switch update.State {
+		case MemberAlive:
+			if update.Incarnation <= current.Incarnation {
+				return ""
+			}
+		case MemberSuspect:
+			if !current.active() {
+				return ""
+			}
+			if update.Incarnation < current.Incarnation || (current.State == MemberSuspect && update.Incarnation == current.Incarnation) {
+				return ""
+			}
+		case MemberDead, MemberLeft:
+			if !current.active() || update.Incarnation < current.Incarnation {
+				return ""
+			}
+		default:
+			return ""
+		}
+
+		current.State = update.State
+		current.Incarnation = update.Incarnation
+		if update.Address != "" {
+			current.Address = update.Address
+		}
+	} else {
+		current = &gossipMember{Member: update}
+		gossip.members[update.Name] = current
+	}
+
+	gossip.broadcastAdd(current.Member)
+	gossip.suspectTimer(current.Member)
+
+	switch {
+	case !wasActive && current.active():
+		return GossipJoin
+	case wasActive && current.State == MemberDead:
+		return GossipFailed
+	case wasActive && current.State == MemberLeft:
+		return GossipLeave
+	}
+	return ""
+}
+
+// suspectTimer start or stop the timer which declare an suspected member as dead, gossip.lock must be held
+func (gossip *Gossip) suspectTimer(member Member) {
+
+	if timer, exist := gossip.suspectWait[member.Name]; exist {
+		timer.Stop()
+		delete(gossip.suspectWait, member.Name)
+	}
+
+	if member.State != MemberSuspect || gossip.ctx.Err() != nil {
+		return
+	}
+
+	gossip.log.WithField("member", member.Name).Warn("Member is suspected")
+
+	dead := member
+	dead.State = MemberDead
+	gossip.suspectWait[member.Name] = time.AfterFunc(gossip.options.SuspicionTimeout, func() {
+		gossip.merge([]Member{dead})
+	})
+}
+
+// broadcastAdd queue the update to be piggybacked, gossip.lock must be held
+func (gossip *Gossip) broadcastAdd(member Member) {
+
+	for _, broadcast := range gossip.broadcasts {
+		if broadcast.member.Name == member.Name {
+			broadcast.member = member
+			broadcast.transmits = 0
+			return
+		}
+	}
+	gossip.broadcasts = append(gossip.broadcasts, &gossipBroadcast{member: member})
+}
+
+// broadcastsTake return the updates for the next message
+func (gossip *Gossip) broadcastsTake() []Member {
+	gossip.lock.Lock()
+	defer gossip.lock.Unlock()
+
+	limit := gossip.options.RetransmitMult * int(math.Ceil(math.Log10(float64(len(gossip.members)+1))))
+	if limit < 1 {
+		limit = 1
+	}
+
+	// the updates which was send least
+	sort.SliceStable(gossip.broadcasts, func(i, j int) bool {
+		return gossip.broadcasts[i].transmits < gossip.broadcasts[j].transmits
+	})
+
+	var updates []Member
+	var keep []*gossipBroadcast
+	for index, broadcast := range gossip.broadcasts {
+		if index < gossipMaxPiggyback {
+			updates = append(updates, broadcast.member)
+			broadcast.transmits++
+		}
+		if broadcast.transmits < limit {
+			keep = append(keep, broadcast)
+		}
+	}
+	gossip.broadcasts = keep
+
+	return updates
+}
+
+// publish an event on the bus
+func (gossip *Gossip) publish(command string, member Member) {
+
+	gossip.log.WithFields(logrus.Fields{
+		"member":      member.Name,
+		"incarnation": member.Incarnation,
+	}).Info(command)
+
+	if gossip.options.Bus == nil {
+		return
+	}
+
+	payload, _ := json.Marshal(member)
+	gossip.options.Bus.PublishMsg(Msg{
+		NodeSource:  gossip.name,
+		GroupSource: GossipGroup,
+		GroupTarget: GossipGroup,
+		Command:     command,
+		Payload:     string(payload),
+	})
+}
+
+// ################################# probes #################################
+
+func (gossip *Gossip) probeLoop() {
+
+	ticker := time.NewTicker(gossip.options.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-gossip.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if member, ok := gossip.probeNext(); ok {
+			gossip.probe(member)
+		}
+	}
+}
+
+// probeNext return the next member to probe, every member is probed once in random order
+func (gossip *Gossip) probeNext() (Member, bool) {
+	gossip.lock.Lock()
+	defer gossip.lock.Unlock()
+
+	for tries := 0; tries < 2; tries++ {
+		for gossip.probeIndex < len(gossip.probeOrder) {
+			name := gossip.probeOrder[gossip.probeIndex]
+			gossip.probeIndex++
+
+			if member, exist := gossip.members[name]; exist && member.active() {
+				return member.Member, true
+			}
+		}
+
+		// a new round
+		gossip.probeOrder = gossip.probeOrder[:0]
+		gossip.probeIndex = 0
+		for name, member := range gossip.members {
+			if name != gossip.name && member.active() {
+				gossip.probeOrder = append(gossip.probeOrder, name)
+			}
+		}
+		rand.Shuffle(len(gossip.probeOrder), func(i, j int) {
+			gossip.probeOrder[i], gossip.probeOrder[j] = gossip.probeOrder[j], gossip.probeOrder[i]
+		})
+	}
+
+	return Member{}, false
+}
+
+// probe the member directly and if this fail over other members, if both fail it is suspected
+func (gossip *Gossip) probe(member Member) {
+
+	if gossip.request(member, cmdGossipPing, gossipPacket{}, gossip.options.ProbeTimeout) {
+		return
+	}
+
+	gossip.log.WithField("member", member.Name).Debug("No ack, probe indirect")
+
+	wait := gossip.options.ProbeInterval - gossip.options.ProbeTimeout
+	if wait < gossip.options.ProbeTimeout {
+		wait = gossip.options.ProbeTimeout
+	}
+	deadline := time.Now().Add(wait)
+
+	seq, acked := gossip.ackRegister()
+	defer gossip.ackForget(seq)
+
+	for _, helper := range gossip.randomMembers(gossip.options.IndirectChecks, member.Name) {
+		go gossip.send(helper, cmdGossipPingReq, gossipPacket{Seq: seq, Target: member.Name}, deadline)
+	}
+
+	select {
+	case <-acked:
+		return
+	case <-time.After(time.Until(deadline)):
+	case <-gossip.ctx.Done():
+		return
+	}
+
+	suspect := member
+	suspect.State = MemberSuspect
+	gossip.merge([]Member{suspect})
+}
+
+// randomMembers return up to count active members, without us and exclude
+func (gossip *Gossip) randomMembers(count int, exclude string) []Member {
+	gossip.lock.Lock()
+	defer gossip.lock.Unlock()
+
+	var list []Member
+	for name, member := range gossip.members {
+		if name != gossip.name && name != exclude && member.State == MemberAlive {
+			list = append(list, member.Member)
+		}
+	}
+	rand.Shuffle(len(list), func(i, j int) {
+		list[i], list[j] = list[j], list[i]
+	})
+	if len(list) > count {
+		list = list[:count]
+	}
+	return list
+}
+
+// request send the packet and wait for the ack
+func (gossip *Gossip) request(member Member, command string, packet gossipPacket, timeout time.Duration) bool {
+
+	deadline := time.Now().Add(timeout)
+
+	seq, acked := gossip.ackRegister()
+	defer gossip.ackForget(seq)
+
+	packet.Seq = seq
+	if err := gossip.send(member, command, packet, deadline); err != nil {
+		return false
+	}
+
+	select {
+	case <-acked:
+		return true
+	case <-time.After(time.Until(deadline)):
+	case <-gossip.ctx.Done():
+	}
+	return false
+}
+
+func (gossip *Gossip) ackRegister() (uint64, chan struct{}) {
+	seq := atomic.AddUint64(&gossip.seq, 1)
+	acked := make(chan struct{})
+
+	gossip.acksLock.Lock()
+	gossip.acks[seq] = acked
+	gossip.acksLock.Unlock()
+
+	return seq, acked
+}
+
+func (gossip *Gossip) ackForget(seq uint64) {
+	gossip.acksLock.Lock()
+	delete(gossip.acks, seq)
+	gossip.acksLock.Unlock()
+}
+
+func (gossip *Gossip) ackDeliver(seq uint64) {
+	gossip.acksLock.Lock()
+	if acked, exist := gossip.acks[seq]; exist {
+		close(acked)
+		delete(gossip.acks, seq)
+	}
+	gossip.acksLock.Unlock()
+}
+
+// ################################# messages #################################
+
+// handle an message of another node, on an link or an session of our server
+func (gossip *Gossip) handle(socket *SocketConnection, message Msg) {
+
+	if message.GroupTarget != GossipGroup {
+		return
+	}
+
+	var packet gossipPacket
+	if err := json.Unmarshal([]byte(message.Payload), &packet); err != nil {
+		gossip.log.Error(err)
+		return
+	}
+
+	gossip.merge(packet.Members)
+
+	switch message.Command {
+
+	case cmdGossipPing:
+		gossip.reply(socket, message, cmdGossipAck, gossipPacket{Seq: packet.Seq})
+
+	case cmdGossipPingReq:
+		target, exist := gossip.MemberGet(packet.Target)
+		if !exist {
+			return
+		}
+		go func() {
+			if gossip.request(target, cmdGossipPing, gossipPacket{}, gossip.options.ProbeTimeout) {
+				gossip.reply(socket, message, cmdGossipAck, gossipPacket{Seq: packet.Seq})
+			}
+		}()
+
+	case cmdGossipSync:
+		gossip.reply(socket, message, cmdGossipSyncAck, gossipPacket{Seq: packet.Seq, Members: gossip.Members()})
+
+	case cmdGossipAck, cmdGossipSyncAck:
+		gossip.ackDeliver(packet.Seq)
+	}
+}
+
+// reply on the connection where the message came from
+func (gossip *Gossip) reply(socket *SocketConnection, message Msg, command string, packet gossipPacket) {
+	gossip.sendOn(socket, message.NodeSource, command, packet)
+}
+
+// send the packet over the link to the member, we wait max until deadline for the link
+func (gossip *Gossip) send(member Member, command string, packet gossipPacket, deadline time.Time) error {
+
+	link := gossip.linkGet(member)
+
+	select {
+	case <-link.ready:
+	case <-link.done:
+		return ErrNotConnected
+	case <-time.After(time.Until(deadline)):
+		return ErrNotConnected
+	}
+
+	return gossip.sendOn(link.socket, member.Name, command, packet)
+}
+
+// sendOn send the packet with the piggybacked updates
+func (gossip *Gossip) sendOn(socket *SocketConnection, target, command string, packet gossipPacket) error {
+
+	packet.Members = append(packet.Members, gossip.broadcastsTake()...)
+	payload, err := json.Marshal(packet)
+	if err != nil {
+		return err
+	}
+
+	return socket.SendMessage(Msg{
+		NodeSource:  gossip.name,
+		GroupSource: GossipGroup,
+		NodeTarget:  target,
+		GroupTarget: GossipGroup,
+		Command:     command,
+		Payload:     string(payload),
+	})
+}
+
+// ################################# links #################################
+
+// linkGet return the link to the member, it is created if needed
+func (gossip *Gossip) linkGet(member Member) *gossipLink {
+	gossip.linksLock.Lock()
+	defer gossip.linksLock.Unlock()
+
+	if link, exist := gossip.links[member.Name]; exist {
+		return link
+	}
+
+	ctx, cancel := context.WithCancel(gossip.ctx)
+	link := &gossipLink{
+		socket: SocketNew(),
+		ready:  make(chan struct{}),
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+	gossip.links[member.Name] = link
+
+	// the link is created again on the next send
+	options := gossip.options.Socket
+	options.Reconnect.MaxAttempts = 1
+	link.socket.OptionsSet(options)
+
+	go func() {
+		link.socket.ConnectTransport(ctx, gossip.options.Resolve(member.Address), gossip.name, GossipGroup, SocketCallbacks{
+			OnHandshakeFinished: func(socket *SocketConnection) {
+				close(link.ready)
+			},
+			OnMessage: gossip.handle,
+			OnDisconnect: func(socket *SocketConnection) {
+				gossip.linkDrop(member.Name, link)
+			},
+		})
+		gossip.linkDrop(member.Name, link)
+	}()
+
+	return link
+}
+
+// linkDrop forget the link
+func (gossip *Gossip) linkDrop(name string, link *gossipLink) {
+
+	link.doneOnce.Do(func() {
+		close(link.done)
+	})
+	link.cancel()
+
+	gossip.linksLock.Lock()
+	if gossip.links[name] == link {
+		delete(gossip.links, name)
+	}
+	gossip.linksLock.Unlock()
+}
+
+// linkClose close the link to the member
+func (gossip *Gossip) linkClose(name string) {
+	gossip.linksLock.Lock()
+	link, exist := gossip.links[name]
+	gossip.linksLock.Unlock()
+
+	if exist {
+		gossip.linkDrop(name, link)
+	}
+}
@@ -0,0 +1,261 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memNetwork connect gossip-nodes in memory, links between nodes can be broken
+type memNetwork struct {
+	lock       sync.Mutex
+	transports map[string]*PipeTransport
+	blocked    map[string]bool // "from->to"
+}
+
+// memUnreachable is an transport which can not dial
+type memUnreachable struct{}
+
+func (memUnreachable) Dial(ctx context.Context) (net.Conn, error) {
+	return nil, errors.New("Network unreachable")
+}
+
+func memNetworkNew() *memNetwork {
+	return &memNetwork{
+		transports: make(map[string]*PipeTransport),
+		blocked:    make(map[string]bool),
+	}
+}
+
+func (network *memNetwork) block(from, to string) {
+	network.lock.Lock()
+	network.blocked[from+"->"+to] = true
+	network.lock.Unlock()
+}
+
+// resolve return the Resolve-function of the node from
+func (network *memNetwork) resolve(from string) func(address string) Transport {
+	return func(address string) Transport {
+		network.lock.Lock()
+		defer network.lock.Unlock()
+
+		transport, exist := network.transports[address]
+		if !exist || network.blocked[from+"->"+address] {
+			return memUnreachable{}
+		}
+		return transport
+	}
+}
+
+// gossipNode is an running node with the events of its bus
+type gossipNode struct {
+	gossip *Gossip
+	events chan Msg
+	cancel context.CancelFunc
+}
+
+func (network *memNetwork) start(name string, suspicionTimeout time.Duration) *gossipNode {
+
+	var bus GBus
+	bus.Init()
+	bus.Run()
+
+	events := make(chan Msg, 100)
+	bus.Subscribe("members", "", GossipGroup, func(message *Msg, group, command, payload string) {
+		events <- *message
+	})
+
+	transport := PipeTransportNew()
+	network.lock.Lock()
+	network.transports[name] = transport
+	network.lock.Unlock()
+
+	gossip := GossipNew(GossipOptions{
+		Name:             name,
+		Address:          name,
+		Resolve:          network.resolve(name),
+		ProbeInterval:    100 * time.Millisecond,
+		ProbeTimeout:     40 * time.Millisecond,
+		SuspicionTimeout: suspicionTimeout,
+		Bus:              &bus,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go gossip.Run(ctx, transport)
+
+	return &gossipNode{gossip: gossip, events: events, cancel: cancel}
+}
+
+// expectEvent wait for the event of the member
+func (node *gossipNode) expectEvent(t *testing.T, command, member string) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case message := <-node.events:
+			var event Member
+			json.Unmarshal([]byte(message.Payload), &event)
+			if message.Command == command && event.Name == member {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("%s: no %s of %s", node.gossip.name, command, member)
+		}
+	}
+}
+
+// waitForMembers wait until the node see count active members
+func (node *gossipNode) waitForMembers(t *testing.T, count int) {
+	for i := 0; i < 250; i++ {
+		active := 0
+		for _, member := range node.gossip.Members() {
+			if member.active() {
+				active++
+			}
+		}
+		if active == count {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("%s: expected %d members, got %v", node.gossip.name, count, node.gossip.Members())
+}
+
+func TestGossipJoinAndFail(t *testing.T) {
+
+	network := memNetworkNew()
+	nodeA := network.start("A", 300*time.Millisecond)
+	nodeB := network.start("B", 300*time.Millisecond)
+	nodeC := network.start("C", 300*time.Millisecond)
+	defer nodeA.cancel()
+	defer nodeB.cancel()
+	defer nodeC.cancel()
+
+	if _, err := nodeB.gossip.Join("A"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodeC.gossip.Join("A"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodeC.gossip.Join("unknown"); err != ErrGossipJoin {
+		t.Errorf("Expected ErrGossipJoin, got %v", err)
+	}
+
+	// B learn about C over A
+	nodeA.expectEvent(t, GossipJoin, "C")
+	nodeB.expectEvent(t, GossipJoin, "C")
+	for _, node := range []*gossipNode{nodeA, nodeB, nodeC} {
+		node.waitForMembers(t, 3)
+	}
+
+	// C crash
+	nodeC.cancel()
+	nodeA.expectEvent(t, GossipFailed, "C")
+	nodeB.expectEvent(t, GossipFailed, "C")
+
+	if member, _ := nodeA.gossip.MemberGet("C"); member.State != MemberDead {
+		t.Errorf("C should be dead, got %+v", member)
+	}
+}
+
+func TestGossipIndirectProbe(t *testing.T) {
+
+	network := memNetworkNew()
+	nodeA := network.start("A", 300*time.Millisecond)
+	nodeB := network.start("B", 300*time.Millisecond)
+	nodeC := network.start("C", 300*time.Millisecond)
+	defer nodeA.cancel()
+	defer nodeB.cancel()
+	defer nodeC.cancel()
+
+	// A can not reach B, but C can
+	network.block("A", "B")
+
+	nodeB.gossip.Join("C")
+	nodeA.gossip.Join("C")
+	nodeA.waitForMembers(t, 3)
+
+	// many probe-rounds, B must stay alive because C probe it for A
+	time.Sleep(time.Second)
+	for {
+		select {
+		case message := <-nodeA.events:
+			if message.Command == GossipFailed {
+				t.Fatalf("Member failed: %s", message.Payload)
+			}
+			continue
+		default:
+		}
+		break
+	}
+	if member, _ := nodeA.gossip.MemberGet("B"); member.State == MemberDead {
+		t.Fatalf("B should be alive, got %+v", member)
+	}
+}
+
+func TestGossipRefute(t *testing.T) {
+
+	network := memNetworkNew()
+	nodeA := network.start("A", 5*time.Second)
+	nodeB := network.start("B", 5*time.Second)
+	defer nodeA.cancel()
+	defer nodeB.cancel()
+
+	nodeB.gossip.Join("A")
+	nodeA.waitForMembers(t, 2)
+
+	// A think B is gone
+	member, _ := nodeA.gossip.MemberGet("B")
+	member.State = MemberSuspect
+	nodeA.gossip.merge([]Member{member})
+
+	// B hear it and refute it with an new incarnation
+	for i := 0; i < 250; i++ {
+		if member, _ := nodeA.gossip.MemberGet("B"); member.State == MemberAlive && member.Incarnation > 0 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	member, _ = nodeA.gossip.MemberGet("B")
+	t.Fatalf("B did not refute, got %+v", member)
+}
+
+func TestGossipLeave(t *testing.T) {
+
+	network := memNetworkNew()
+	nodeA := network.start("A", 300*time.Millisecond)
+	nodeB := network.start("B", 300*time.Millisecond)
+	defer nodeA.cancel()
+	defer nodeB.cancel()
+
+	nodeB.gossip.Join("A")
+	nodeA.expectEvent(t, GossipJoin, "B")
+
+	nodeB.gossip.Leave(time.Second)
+	nodeA.expectEvent(t, GossipLeave, "B")
+
+	if member, _ := nodeA.gossip.MemberGet("B"); member.State != MemberLeft {
+		t.Errorf("B should have left, got %+v", member)
+	}
+}
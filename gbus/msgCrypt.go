@@ -0,0 +1,115 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"encoding/base64"
+	"errors"
+
+	"gitlab.com/gopilot/lib/nodekey"
+)
+
+// errors of the payload-encryption
+var (
+	ErrMsgNoRecipientKey = errors.New("No box-key for the target-node of the message")
+	ErrMsgDecrypt        = errors.New("Could not decrypt payload of message")
+)
+
+// BoxCrypter encrypt the payload of messages with a NodeTarget to the box-key of the target node ( NaCl box )
+//
+// Only the target node can read the payload, relays and the central bus only route the message.
+// The box-keys are exchanged in the handshake and pinned in the trust-store
+type BoxCrypter struct {
+	identity *nodekey.Identity
+	trust    *nodekey.TrustStore
+}
+
+// BoxCrypterNew create a new crypter for our identity
+func BoxCrypterNew(identity *nodekey.Identity, trust *nodekey.TrustStore) *BoxCrypter {
+	return &BoxCrypter{
+		identity: identity,
+		trust:    trust,
+	}
+}
+
+// shouldSeal return true if the message is from us, not encrypted yet and has an target-node
+func (crypter *BoxCrypter) shouldSeal(message *Msg) bool {
+	return !message.Encrypted &&
+		message.NodeTarget != "" &&
+		message.NodeSource == crypter.identity.NodeName
+}
+
+// shouldOpen return true if the message is encrypted for us
+func (crypter *BoxCrypter) shouldOpen(message *Msg) bool {
+	return message.Encrypted && message.NodeTarget == crypter.identity.NodeName
+}
+
+// Seal encrypt the payload of the message to the target node
+func (crypter *BoxCrypter) Seal(message *Msg) error {
+
+	boxKey, err := crypter.trust.LookupBoxKey(message.NodeTarget)
+	if err != nil {
+		return ErrMsgNoRecipientKey
+	}
+
+	sealed, err := crypter.identity.Seal([]byte(message.Payload), boxKey)
+	if err != nil {
+		return err
+	}
+
+	message.Payload = base64.StdEncoding.EncodeToString(sealed)
+	message.Encrypted = true
+	return nil
+}
+
+// Open decrypt the payload of the message from the source node
+func (crypter *BoxCrypter) Open(message *Msg) error {
+
+	boxKey, err := crypter.trust.LookupBoxKey(message.NodeSource)
+	if err != nil {
+		return ErrMsgUnknownNode
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(message.Payload)
+	if err != nil {
+		return ErrMsgDecrypt
+	}
+
+	payload, err := crypter.identity.Open(sealed, boxKey)
+	if err != nil {
+		return ErrMsgDecrypt
+	}
+
+	message.Payload = string(payload)
+	message.Encrypted = false
+	return nil
+}
+
+// DecryptMiddleware return an bus-middleware which decrypt messages for our node
+// before they are delivered to the subscribers
+//
+// The signature is made over the encrypted payload, so add it after the VerifyMiddleware
+func DecryptMiddleware(crypter *BoxCrypter) MiddlewareFct {
+	return func(message *Msg) error {
+		if !crypter.shouldOpen(message) {
+			return nil
+		}
+		return crypter.Open(message)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitlab.com/gopilot/lib/config"
+	"gitlab.com/gopilot/lib/nodekey"
+)
+
+func TestBoxCrypter(t *testing.T) {
+
+	tempDir, _ := ioutil.TempDir("", "gbus")
+	defer os.RemoveAll(tempDir)
+	config.ConfigPath = tempDir
+
+	edgeIdentity, _ := nodekey.IdentityLoad("edge")
+	edgeTrust, _ := nodekey.TrustStoreLoad(filepath.Join(tempDir, "edge_trust.json"))
+
+	centralIdentity, _ := nodekey.IdentityLoad("central")
+	centralTrust, _ := nodekey.TrustStoreLoad(filepath.Join(tempDir, "central_trust.json"))
+
+	relayIdentity, _ := nodekey.IdentityLoad("relay")
+	relayTrust, _ := nodekey.TrustStoreLoad(filepath.Join(tempDir, "relay_trust.json"))
+
+	// both know each other
+	centralTrust.Trust("edge", edgeIdentity.PublicKeyString(), edgeIdentity.BoxPublicKeyString())
+	edgeTrust.Trust("central", centralIdentity.PublicKeyString(), centralIdentity.BoxPublicKeyString())
+	relayTrust.Trust("central", centralIdentity.PublicKeyString(), centralIdentity.BoxPublicKeyString())
+
+	central := BoxCrypterNew(centralIdentity, centralTrust)
+	edge := BoxCrypterNew(edgeIdentity, edgeTrust)
+	relay := BoxCrypterNew(relayIdentity, relayTrust)
+
+	message := Msg{
+		NodeSource:  "central",
+		NodeTarget:  "edge",
+		GroupTarget: "credentials",
+		Payload:     "secret-password",
+	}
+	if !central.shouldSeal(&message) {
+		t.Fatal("Message should be sealed")
+	}
+	if err := central.Seal(&message); err != nil {
+		t.Fatal(err)
+	}
+	if message.Payload == "secret-password" || !message.Encrypted {
+		t.Fatal("Payload is not encrypted")
+	}
+
+	// the relay can not read it
+	if relay.shouldOpen(&message) {
+		t.Fatal("Relay should not open the message")
+	}
+	relayed := message
+	if err := relay.Open(&relayed); err == nil {
+		t.Fatal("Relay could decrypt the message")
+	}
+
+	// the edge can read it
+	var edgeBus GBus
+	edgeBus.Init()
+	edgeBus.Use(DecryptMiddleware(edge))
+	edgeBus.Run()
+
+	recieved := make(chan string, 1)
+	edgeBus.Subscribe("0", "edge", "credentials", func(message *Msg, group, command, payload string) {
+		recieved <- payload
+	})
+
+	if err := edgeBus.PublishMsg(message); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case payload := <-recieved:
+		if payload != "secret-password" {
+			t.Fatalf("Wrong payload '%s'", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message not recieved")
+	}
+
+	// modified ciphertext
+	broken := message
+	broken.Payload = broken.Payload[:len(broken.Payload)-4] + "AAAA"
+	if err := edgeBus.PublishMsg(broken); err != ErrMsgDecrypt {
+		t.Fatalf("Expected decrypt error, got %v", err)
+	}
+
+	// unknown target
+	unknown := Msg{NodeSource: "central", NodeTarget: "nobody"}
+	if err := central.Seal(&unknown); err != ErrMsgNoRecipientKey {
+		t.Fatalf("Expected no recipient key, got %v", err)
+	}
+}
+
+func TestBoxKeyNeedSigner(t *testing.T) {
+
+	tempDir, _ := ioutil.TempDir("", "gbus")
+	defer os.RemoveAll(tempDir)
+	config.ConfigPath = tempDir
+
+	edgeIdentity, _ := nodekey.IdentityLoad("edge")
+	centralIdentity, _ := nodekey.IdentityLoad("central")
+	centralTrust, _ := nodekey.TrustStoreLoad(filepath.Join(tempDir, "central_trust.json"))
+	centralTrust.Trust("edge", edgeIdentity.PublicKeyString(), "")
+
+	// an OLEH with an signature, but without an signer nobody can verify it
+	info, _ := json.Marshal(handshakeInfo{Version: ProtocolVersion, BoxKey: edgeIdentity.BoxPublicKeyString()})
+	oleh := Msg{NodeSource: "edge", Command: cmdOleh, Payload: string(info), Signature: "Zm9yZ2Vk"}
+
+	central := SocketNew()
+	central.OptionsSet(SocketOptions{Crypter: BoxCrypterNew(centralIdentity, centralTrust)})
+	if _, err := central.handshakePeer(&oleh); err != ErrMsgSignatureInvalid {
+		t.Fatalf("Expected ErrMsgSignatureInvalid, got %v", err)
+	}
+
+	// the box-key is not pinned
+	if _, err := centralTrust.LookupBoxKey("edge"); err == nil {
+		t.Fatal("Box-key was pinned without an verified signature")
+	}
+}
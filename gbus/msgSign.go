@@ -0,0 +1,236 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+
+	"gitlab.com/gopilot/lib/tools"
+)
+
+// errors which can occure while checking the signature of an message
+var (
+	ErrMsgUnsigned         = errors.New("Message is not signed")
+	ErrMsgSignatureInvalid = errors.New("Signature of message is invalid")
+	ErrMsgUnknownNode      = errors.New("No secret/key for the source-node of the message")
+	ErrMsgExpired          = errors.New("Message timestamp is outside of the allowed window")
+	ErrMsgReplayed         = errors.New("Message nonce was already seen ( replay )")
+)
+
+// DefaultReplayWindow is the time-window an signed message is valid
+const DefaultReplayWindow = 5 * time.Minute
+
+// MsgSigner sign and verify messages
+//
+// Sign is called on the node which create the message, Verify on every node which recieve it
+// so an message relayed over multiple nodes can be verified at the destination
+type MsgSigner interface {
+	Sign(message *Msg) error
+	Verify(message *Msg) error
+}
+
+// MsgRejectError is returned if an message was recieved but rejected
+//
+// The connection is still okay, only this single message was dropped
+type MsgRejectError struct {
+	Message Msg
+	Reason  error
+}
+
+func (err *MsgRejectError) Error() string {
+	return "Message rejected: " + err.Reason.Error()
+}
+
+// verifyMsg check the message with the signer and mark it as verified
+// if requireSigned is false, unsigned messages are allowed
+func verifyMsg(signer MsgSigner, requireSigned bool, message *Msg) error {
+
+	// already checked by us
+	if message.verified {
+		return nil
+	}
+
+	if message.Signature == "" {
+		if requireSigned {
+			return ErrMsgUnsigned
+		}
+		return nil
+	}
+
+	if signer == nil {
+		if requireSigned {
+			return ErrMsgSignatureInvalid
+		}
+		return nil
+	}
+
+	if err := signer.Verify(message); err != nil {
+		return err
+	}
+
+	message.verified = true
+	return nil
+}
+
+// VerifyMiddleware return an bus-middleware which reject unsigned/invalid messages
+func VerifyMiddleware(signer MsgSigner, requireSigned bool) MiddlewareFct {
+	return func(message *Msg) error {
+		return verifyMsg(signer, requireSigned, message)
+	}
+}
+
+// replayGuard remember nonces of messages inside the time-window
+type replayGuard struct {
+	window    time.Duration
+	seenLock  sync.Mutex
+	seen      map[string]int64
+	lastPrune int64
+}
+
+func replayGuardNew(window time.Duration) *replayGuard {
+	if window <= 0 {
+		window = DefaultReplayWindow
+	}
+
+	return &replayGuard{
+		window: window,
+		seen:   make(map[string]int64),
+	}
+}
+
+// stamp set the timestamp and a new nonce to the message
+func (guard *replayGuard) stamp(message *Msg) {
+	message.Timestamp = time.Now().UnixNano()
+	message.Nonce = nonceNew()
+}
+
+// nonceNew return a new random nonce
+func nonceNew() string {
+	b := make([]byte, 18)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// check if the message is inside the window and the nonce was not seen before
+func (guard *replayGuard) check(message *Msg) error {
+
+	now := time.Now().UnixNano()
+	window := int64(guard.window)
+
+	if message.Timestamp < now-window || message.Timestamp > now+window {
+		return ErrMsgExpired
+	}
+
+	guard.seenLock.Lock()
+	defer guard.seenLock.Unlock()
+
+	// remove old nonces from time to time
+	if now-guard.lastPrune > window {
+		for key, timestamp := range guard.seen {
+			if timestamp < now-window {
+				delete(guard.seen, key)
+			}
+		}
+		guard.lastPrune = now
+	}
+
+	key := message.NodeSource + "/" + message.Nonce
+	if _, exist := guard.seen[key]; exist {
+		return ErrMsgReplayed
+	}
+	guard.seen[key] = message.Timestamp
+
+	return nil
+}
+
+// HmacSigner sign messages with an HMAC-SHA256 with an secret per node
+//
+// The secret of the NodeSource of the message is used, so every node which should verify
+// an message need the secret of the source-node
+type HmacSigner struct {
+	secretsLock sync.Mutex
+	secrets     map[string]string
+	replay      *replayGuard
+}
+
+// HmacSignerNew create a new signer, window is the allowed time-window for replay-protection
+// ( 0 means DefaultReplayWindow )
+func HmacSignerNew(window time.Duration) *HmacSigner {
+	return &HmacSigner{
+		secrets: make(map[string]string),
+		replay:  replayGuardNew(window),
+	}
+}
+
+// SecretSet set the secret of an node
+func (signer *HmacSigner) SecretSet(nodeName, secret string) {
+	signer.secretsLock.Lock()
+	signer.secrets[nodeName] = secret
+	signer.secretsLock.Unlock()
+}
+
+// SecretRemove remove the secret of an node
+func (signer *HmacSigner) SecretRemove(nodeName string) {
+	signer.secretsLock.Lock()
+	delete(signer.secrets, nodeName)
+	signer.secretsLock.Unlock()
+}
+
+func (signer *HmacSigner) secretGet(nodeName string) (string, bool) {
+	signer.secretsLock.Lock()
+	defer signer.secretsLock.Unlock()
+
+	secret, exist := signer.secrets[nodeName]
+	return secret, exist
+}
+
+// Sign will set timestamp, nonce and signature of the message
+func (signer *HmacSigner) Sign(message *Msg) error {
+
+	secret, exist := signer.secretGet(message.NodeSource)
+	if !exist {
+		return ErrMsgUnknownNode
+	}
+
+	signer.replay.stamp(message)
+	message.Signature = tools.ComputeHmac256(message.signingString(), secret)
+
+	return nil
+}
+
+// Verify check the signature, the timestamp and the nonce of the message
+func (signer *HmacSigner) Verify(message *Msg) error {
+
+	secret, exist := signer.secretGet(message.NodeSource)
+	if !exist {
+		return ErrMsgUnknownNode
+	}
+
+	expected := tools.ComputeHmac256(message.signingString(), secret)
+	if !hmac.Equal([]byte(expected), []byte(message.Signature)) {
+		return ErrMsgSignatureInvalid
+	}
+
+	return signer.replay.check(message)
+}
@@ -0,0 +1,99 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"gitlab.com/gopilot/lib/nodekey"
+)
+
+// ErrMsgForeignSource is returned if we should sign an message which not come from our node
+var ErrMsgForeignSource = errors.New("Can not sign message of another node")
+
+// Ed25519Signer sign messages with the keypair of our node
+//
+// Messages are verified with the public key of the NodeSource from the trust-store.
+// The public keys are exchanged in the handshake and pinned in the trust-store
+type Ed25519Signer struct {
+	identity *nodekey.Identity
+	trust    *nodekey.TrustStore
+	replay   *replayGuard
+}
+
+// Ed25519SignerNew create a new signer, window is the allowed time-window for replay-protection
+// ( 0 means DefaultReplayWindow )
+func Ed25519SignerNew(identity *nodekey.Identity, trust *nodekey.TrustStore, window time.Duration) *Ed25519Signer {
+	return &Ed25519Signer{
+		identity: identity,
+		trust:    trust,
+		replay:   replayGuardNew(window),
+	}
+}
+
+// Sign will set timestamp, nonce and signature of the message
+// NodeSource of the message must be our node
+func (signer *Ed25519Signer) Sign(message *Msg) error {
+
+	if message.NodeSource != signer.identity.NodeName {
+		return ErrMsgForeignSource
+	}
+
+	signer.replay.stamp(message)
+	signature := signer.identity.Sign([]byte(message.signingString()))
+	message.Signature = base64.StdEncoding.EncodeToString(signature)
+
+	return nil
+}
+
+// Verify check the signature with the pinned key of the NodeSource, the timestamp and the nonce
+func (signer *Ed25519Signer) Verify(message *Msg) error {
+
+	publicKey, err := signer.trust.Lookup(message.NodeSource)
+	if err == nodekey.ErrNodeUnknown {
+		return ErrMsgUnknownNode
+	}
+	if err != nil {
+		return err
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(message.Signature)
+	if err != nil {
+		return ErrMsgSignatureInvalid
+	}
+	if !nodekey.Verify(publicKey, []byte(message.signingString()), signature) {
+		return ErrMsgSignatureInvalid
+	}
+
+	return signer.replay.check(message)
+}
+
+func (signer *Ed25519Signer) handshakeKey() string {
+	return signer.identity.PublicKeyString()
+}
+
+func (signer *Ed25519Signer) handshakeNode() string {
+	return signer.identity.NodeName
+}
+
+func (signer *Ed25519Signer) handshakePeer(nodeName, publicKey string) error {
+	return signer.trust.Check(nodeName, publicKey)
+}
@@ -0,0 +1,156 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitlab.com/gopilot/lib/config"
+	"gitlab.com/gopilot/lib/mynodename"
+	"gitlab.com/gopilot/lib/nodekey"
+)
+
+func TestEd25519Handshake(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+
+	tempDir, _ := ioutil.TempDir("", "gbus")
+	defer os.RemoveAll(tempDir)
+	config.ConfigPath = tempDir
+	mynodename.NodeName = "server"
+
+	serverIdentity, _ := nodekey.IdentityLoad("server")
+	serverTrust, _ := nodekey.TrustStoreLoad(filepath.Join(tempDir, "server_trust.json"))
+	serverTrust.TOFUSet(true)
+
+	clientIdentity, _ := nodekey.IdentityLoad("client")
+	clientTrust, _ := nodekey.TrustStoreLoad(filepath.Join(tempDir, "client_trust.json"))
+	clientTrust.Trust("server", serverIdentity.PublicKeyString(), "")
+
+	handshakeDone := make(chan *SocketConnection, 1)
+
+	server := SocketNew()
+	server.OptionsSet(SocketOptions{
+		Signer:        Ed25519SignerNew(serverIdentity, serverTrust, time.Minute),
+		RequireSigned: true,
+	})
+	go server.Serve(filename, SocketCallbacks{
+		OnHandshakeFinished: func(socket *SocketConnection) {
+			handshakeDone <- socket
+		},
+	})
+	waitForSocket(filename)
+	defer server.Shutdown()
+
+	client := SocketNew()
+	client.OptionsSet(SocketOptions{
+		Signer:        Ed25519SignerNew(clientIdentity, clientTrust, time.Minute),
+		RequireSigned: true,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.Connect(ctx, filename, "client", "test", SocketCallbacks{})
+
+	select {
+	case session := <-handshakeDone:
+		if session.RemoteNodeName() != "client" {
+			t.Fatal("Wrong remote node")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Handshake not finished")
+	}
+
+	// the server pinned the key of the client
+	pinnedKey, err := serverTrust.Lookup("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pinnedKey) != string(clientIdentity.PublicKey) {
+		t.Fatal("Wrong key pinned")
+	}
+}
+
+func TestEd25519ListenNode(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+
+	tempDir, _ := ioutil.TempDir("", "gbus")
+	defer os.RemoveAll(tempDir)
+	config.ConfigPath = tempDir
+	mynodename.NodeName = "server"
+
+	serverIdentity, _ := nodekey.IdentityLoad("server")
+	serverTrust, _ := nodekey.TrustStoreLoad(filepath.Join(tempDir, "server_trust.json"))
+	serverTrust.TOFUSet(true)
+
+	clientIdentity, _ := nodekey.IdentityLoad("client")
+	clientTrust, _ := nodekey.TrustStoreLoad(filepath.Join(tempDir, "client_trust.json"))
+	clientTrust.Trust("server", serverIdentity.PublicKeyString(), "")
+
+	handshakeDone := make(chan *SocketConnection, 1)
+
+	server := SocketNew()
+	server.OptionsSet(SocketOptions{
+		Signer:        Ed25519SignerNew(serverIdentity, serverTrust, time.Minute),
+		RequireSigned: true,
+	})
+	go server.Serve(filename, SocketCallbacks{
+		OnHandshakeFinished: func(socket *SocketConnection) {
+			handshakeDone <- socket
+		},
+	})
+	waitForSocket(filename)
+	defer server.Shutdown()
+
+	// we listen for an other node than our identity
+	client := SocketNew()
+	client.OptionsSet(SocketOptions{
+		Signer:            Ed25519SignerNew(clientIdentity, clientTrust, time.Minute),
+		RequireSigned:     true,
+		HeartbeatInterval: 50 * time.Millisecond,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.Connect(ctx, filename, "listener", "test", SocketCallbacks{})
+
+	select {
+	case session := <-handshakeDone:
+		if session.RemoteNodeName() != "client" {
+			t.Fatal("Wrong remote node")
+		}
+		if !session.Subscribed(Msg{NodeTarget: "listener", GroupTarget: "test"}) {
+			t.Fatal("The listen-filter of the client is missing")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Handshake not finished")
+	}
+
+	// signed PING/PONG pass the RequireSigned-check of the server
+	for start := time.Now(); client.RTT() == 0; {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("No PONG recieved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.com/gopilot/lib/tools"
+)
+
+func TestHmacSignVerify(t *testing.T) {
+
+	sender := HmacSignerNew(time.Minute)
+	sender.SecretSet("nodeA", "secretA")
+
+	reciever := HmacSignerNew(time.Minute)
+	reciever.SecretSet("nodeA", "secretA")
+
+	message := Msg{
+		NodeSource:  "nodeA",
+		NodeTarget:  "nodeB",
+		GroupTarget: "test",
+		Command:     "ping",
+		Payload:     "hello",
+	}
+	if err := sender.Sign(&message); err != nil {
+		t.Fatal(err)
+	}
+
+	// a copy that we modify
+	tampered := message
+	tampered.Payload = "bye"
+
+	if err := reciever.Verify(&message); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reciever.Verify(&message); err != ErrMsgReplayed {
+		t.Fatalf("Expected replay-error, got %v", err)
+	}
+
+	if err := reciever.Verify(&tampered); err != ErrMsgSignatureInvalid {
+		t.Fatalf("Expected invalid signature, got %v", err)
+	}
+
+	// unknown node
+	unknown := Msg{NodeSource: "nodeC"}
+	if err := sender.Sign(&unknown); err != ErrMsgUnknownNode {
+		t.Fatalf("Expected unknown node, got %v", err)
+	}
+
+	// message from the past
+	old := Msg{NodeSource: "nodeA", Nonce: nonceNew()}
+	old.Timestamp = time.Now().Add(-time.Hour).UnixNano()
+	old.Signature = tools.ComputeHmac256(old.signingString(), "secretA")
+	if err := reciever.Verify(&old); err != ErrMsgExpired {
+		t.Fatalf("Expected expired message, got %v", err)
+	}
+}
+
+func TestVerifyMiddleware(t *testing.T) {
+
+	signer := HmacSignerNew(time.Minute)
+	signer.SecretSet("nodeA", "secretA")
+
+	var signedBus GBus
+	signedBus.Init()
+	signedBus.Use(VerifyMiddleware(signer, true))
+	signedBus.Run()
+
+	recieved := make(chan string, 2)
+	signedBus.Subscribe("0", "", "signed", func(message *Msg, group, command, payload string) {
+		recieved <- payload
+	})
+
+	// unsigned must be rejected
+	if err := signedBus.PublishPayload("nodeA", "", "", "signed", "", "unsigned"); err != ErrMsgUnsigned {
+		t.Fatalf("Expected unsigned error, got %v", err)
+	}
+
+	// signed must pass
+	message := Msg{NodeSource: "nodeA", GroupTarget: "signed", Payload: "signed"}
+	signer.Sign(&message)
+
+	if err := signedBus.PublishMsg(message); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case payload := <-recieved:
+		if payload != "signed" {
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Signed message was not delivered")
+	}
+}
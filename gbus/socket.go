@@ -21,37 +21,258 @@ along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
 package gbus
 
 import (
-	"bufio"
-	"errors"
+	"context"
 	"fmt"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
-	"gitlab.com/gopilot/lib/mynodename"
 )
 
 const recvBufferSize int = 2048
 
+// DefaultMaxPendingHandshakes is the default count of connections which can wait for the handshake
+const DefaultMaxPendingHandshakes = 64
+
 // SocketConnection represent an current socket-session ( socket connection )
 type SocketConnection struct {
-	log             *logrus.Entry
-	id              string
-	socket          net.Conn // our socket
-	lastMessageID   int
-	remoteNodeName  string
-	remoteNodeGroup string
+	log              *logrus.Entry
+	id               string
+	socket           net.Conn // our socket
+	reader           *frameReader
+	writerLock       sync.Mutex
+	writer           *socketWriter // the only one who write to socket
+	writeFraming     string
+	compression      string
+	compressStats    compressStats
+	protocolVersion  int
+	capabilities     []string
+	lastMessageID    int64 // atomic
+	rtt              int64 // atomic
+	lastActivity     int64 // atomic, unix-time in nanoseconds
+	localNodeName    string
+	listenNodeName   string
+	remoteNodeName   string
+	remoteListenNode string
+	remoteNodeGroup  string
+	options          SocketOptions
+	handshaking      int32  // atomic, 1 while the handshake is running
+	listenerName     string // the listener which accepted this session
+	peerCred         *PeerCred
+	peerCredErr      error
+	lastReadSize     int // size of the last frame we read
+
+	// buckets of the RateLimiter for this connection
+	limitGeneration int
+	limitBuckets    *limitBuckets
+	limitNoticeLast int64 // unix-time in nanoseconds of the last limit-ERROR we send
+	limitCounted    bool  // the session is counted by the RateLimiter
+
+	// the ERROR of the server, if it closed our session because of its admission
+	kickedErr *RemoteError
+
+	// the server which created this session
+	server       *SocketConnection
+	connectTime  int64 // atomic, unix-time in nanoseconds
+	counters     sessionCounters
+	sessionsLock sync.Mutex
+	sessions     map[string]*SocketConnection // active sessions of an server
+	parked       map[string]*parkedSession    // session-token -> disconnected sessions of an server
+	forwardLock  sync.Mutex                   // ForwardAll and resume of an session
+
+	// listeners of an server
+	listenersLock sync.Mutex
+	listeners     []Listener
+	shutdown      int32 // atomic
+
+	// nodes which are online on an server
+	presenceLock sync.Mutex
+	presence     map[string]*presenceEntry
+	presenceBus  *GBus
+
+	// held from the change of the presence-table until the event is published, so join and leave never overtake each other
+	presenceOrderLock sync.Mutex
+
+	// session-resumption
+	sessionToken string // the token of this session
+	resumeToken  string // the token of the session the client want to resume
+	resumed      int32  // atomic
+	noResume     int32  // atomic, the session was kicked and can not be resumed
+	replaced     int32  // atomic, the session was kicked by an newer session of the same node
+
+	// the buffer of the parked session while it is replayed, new forwarded messages are appended to keep the order
+	replayLock   sync.Mutex
+	replayBuffer *outboundQueue
+
+	// our subscriptions and the subscriptions of the remote side
+	subscriptionsLock   sync.Mutex
+	subscriptions       []Subscription
+	subscriptionsActive bool // the connection is ready, changes are send directly
+	remoteSubscriptions []Subscription
+
+	// hold while we send our subscriptions, so they reach the remote side in order
+	subscriptionsSendLock sync.Mutex
+
+	// acknowledged messages
+	ackLock    sync.Mutex
+	ackSeq     uint64
+	ackPending map[uint64]Msg // sequence-number -> message which wait for an ACK
+	ackOrder   []uint64       // sequence-numbers in the order they was send, acked ones are removed later
+	dedup      *msgDedup
+
+	// outbound-queue of an client
+	queueLock sync.Mutex
+	queue     *outboundQueue
+	connected bool
+}
+
+// SocketOptions hold the settings of an socket-connection
+//
+// Sessions which are created by Serve() get the options of the server-socket
+type SocketOptions struct {
+	// Signer will sign outgoing messages and verify incoming messages, can be nil
+	Signer MsgSigner
+
+	// RequireSigned will reject incoming messages without a valid signature
+	RequireSigned bool
+
+	// Crypter will encrypt the payload of messages with an NodeTarget and decrypt messages for us, can be nil
+	Crypter *BoxCrypter
+
+	// AllowPlaintext will send messages unencrypted if we don't know the box-key of the target-node
+	// otherwise the message is not send
+	AllowPlaintext bool
+
+	// MaxFrameSize is the max size of a single message on the wire ( 0 means DefaultMaxFrameSize )
+	MaxFrameSize int
+
+	// NewlineFraming disable the length-framing, only newline-json is used
+	NewlineFraming bool
+
+	// DisableCompression disable the compression of messages
+	DisableCompression bool
+
+	// Compression is the preferred compression-algorithm ( CompressionDeflate or CompressionGzip )
+	// the client choose the algorithm of the connection, "" means the default order
+	Compression string
+
+	// CompressThreshold is the min size of a message which will be compressed ( 0 means DefaultCompressThreshold )
+	CompressThreshold int
+
+	// HeartbeatInterval is the interval in which we send an PING ( 0 means no PINGs )
+	HeartbeatInterval time.Duration
+
+	// ReadTimeout close the connection if nothing was recieved in this time
+	// ( 0 means 3 * HeartbeatInterval if heartbeats are used, otherwise no timeout )
+	ReadTimeout time.Duration
+
+	// IdleTimeout close the connection if no message ( except PING/PONG ) was send or recieved in this time ( 0 means no timeout )
+	IdleTimeout time.Duration
+
+	// HandshakeTimeout is the time the remote side have for the handshake
+	// ( 0 means DefaultHandshakeTimeout, negative values disable the timeout )
+	HandshakeTimeout time.Duration
+
+	// MaxPendingHandshakes is the max count of connections a server accept, which not finished the handshake
+	// connections above this are closed immediately ( 0 means DefaultMaxPendingHandshakes )
+	MaxPendingHandshakes int
+
+	// SendQueueSize is the count of messages which can wait to be written ( 0 means DefaultSendQueueSize )
+	SendQueueSize int
+
+	// SendPolicy is what SendMessage do if the send-queue is full ( default SendBlock )
+	SendPolicy string
+
+	// WriteTimeout close the connection if a write take longer,
+	// with SendBlock it is also the max time SendMessage wait for room in the queue
+	// ( 0 means DefaultWriteTimeout, negative values disable the timeout )
+	WriteTimeout time.Duration
+
+	// BatchMessages coalesce up to this count of queued messages into a single write ( 0 disable batching )
+	// if the remote side support it, the messages are send inside one batch-frame
+	BatchMessages int
+
+	// BatchBytes flush the batch if it reach this size ( 0 means DefaultBatchBytes )
+	BatchBytes int
+
+	// BatchDelay is the max time we wait for more messages before the batch is written
+	// ( 0 means only messages which are already queued are coalesced )
+	BatchDelay time.Duration
+
+	// Reconnect is the policy how a client retry to connect
+	Reconnect ReconnectPolicy
+
+	// OutboundQueue hold messages of an client while it is disconnected
+	OutboundQueue OutboundQueueOptions
+
+	// SocketMode, SocketOwner and SocketGroup are set on the file of the unix-socket by Serve()
+	// owner and group can be an name or an numeric id ( 0 / "" means don't change it )
+	SocketMode  os.FileMode
+	SocketOwner string
+	SocketGroup string
+
+	// PeerAllow only accept local processes which match this policy ( nil accept everyone )
+	// the check is done before the handshake, connections which are not an unix-socket are rejected
+	PeerAllow *PeerPolicy
+
+	// ACL decide what remote nodes can publish and subscribe ( nil allow everything )
+	// denied messages and subscriptions are answered with an ERROR.
+	// The node-name of the remote side is what it tell us in the handshake,
+	// use it together with Signer and RequireSigned or PeerAllow, otherwise every client can claim every name
+	ACL *ACL
+
+	// MaxSessions is the max count of sessions of an server ( 0 means unlimited )
+	MaxSessions int
+
+	// MaxSessionsPerNode is the max count of sessions with the same remote node name ( 0 means unlimited, 1 means unique node names )
+	// DuplicateNode decide if an new session above this is rejected or the oldest is closed ( default DuplicateRejectNew )
+	MaxSessionsPerNode int
+	DuplicateNode      string
+
+	// PresenceDebounce delay the leave-event of an node, if it come back in this time nothing is published ( 0 means no delay )
+	PresenceDebounce time.Duration
+
+	// RateLimiter limit messages, bytes and subscriptions of remote nodes ( nil means no limits )
+	RateLimiter *RateLimiter
+
+	// SessionResume is the grace-period in which an disconnected client can resume its session ( 0 disable it )
+	// while the client is away, messages of ForwardAll() which match its subscriptions are buffered
+	SessionResume time.Duration
+
+	// ResumeBufferSize is the max count of buffered messages of an disconnected session ( 0 means DefaultResumeBufferSize )
+	// if there are more, the oldest is dropped
+	ResumeBufferSize int
+
+	// MaxUnacked is the max count of messages with QoS which wait for an ACK ( 0 means DefaultMaxUnacked )
+	// if there are more, the oldest is forgotten
+	MaxUnacked int
+
+	// DedupWindow is the time we remember ids of recieved messages with QoS ( 0 means DefaultDedupWindow )
+	DedupWindow time.Duration
+
+	// MinProtocolVersion reject remote nodes with an older protocol version ( 0 accept every node )
+	MinProtocolVersion int
+
+	// RequiredCapabilities reject remote nodes which not support all of this capabilities
+	RequiredCapabilities []string
 }
 
 // SocketCallbacks provide different callbacks
-// OnConnect - Will fire if you successful connect to an socket ( after handshake )
+// OnConnect - Will fire if you successful connect to an socket ( after handshake ), on the server for every new session
+// OnConnectFailed - Will fire if dial or handshake failed, attempt count the failed attempts ( always 1 on the server )
 type SocketCallbacks struct {
-	OnConnect           func(socket *SocketConnection)
-	OnDisconnect        func(socket *SocketConnection)
-	OnHandshakeFinished func(socket *SocketConnection)
-	OnMessage           func(socket *SocketConnection, message Msg)
+	OnConnect             func(socket *SocketConnection)
+	OnConnectFailed       func(socket *SocketConnection, attempt int, err error)
+	OnDisconnect          func(socket *SocketConnection)
+	OnHandshakeFinished   func(socket *SocketConnection)
+	OnMessage             func(socket *SocketConnection, message Msg)
+	OnError               func(socket *SocketConnection, err error)                // an message was rejected, the connection is still alive
+	OnSubscriptionChanged func(socket *SocketConnection)                           // the remote side send an SUBSCRIBE/UNSUBSCRIBE
+	OnLimitExceeded       func(socket *SocketConnection, violation LimitViolation) // an limit of the RateLimiter was exceeded
 }
 
 // SocketNew create a new Socket
@@ -77,6 +298,99 @@ func SocketNew() (socket *SocketConnection) {
 	return &newSocket
 }
 
+// newSession create a new socket for an incoming connection with the options of the server-socket
+func (socket *SocketConnection) newSession() *SocketConnection {
+	newSocket := SocketNew()
+	newSocket.options = socket.options
+	newSocket.server = socket
+	return newSocket
+}
+
+// OptionsSet set the options of the socket, call it before Serve() or Connect()
+//
+// If options.OutboundQueue.Size is set, messages which are send before/between Connect are queued
+func (socket *SocketConnection) OptionsSet(options SocketOptions) {
+	socket.options = options
+
+	socket.queueLock.Lock()
+	if options.OutboundQueue.Size > 0 && socket.queue == nil {
+		socket.queue = outboundQueueNew(socket.log, options.OutboundQueue)
+	}
+	socket.queueLock.Unlock()
+}
+
+// OptionsGet return the current options of the socket
+func (socket *SocketConnection) OptionsGet() SocketOptions {
+	return socket.options
+}
+
+// connSet set the connection, every connection start with newline-framing for the handshake
+func (socket *SocketConnection) connSet(conn net.Conn) {
+	socket.socket = conn
+	socket.peerCredSet(conn)
+
+	socket.writerLock.Lock()
+	socket.writer = socketWriterNew(conn, socket.options)
+	socket.writerLock.Unlock()
+
+	socket.reader = frameReaderNew(conn, socket.options.MaxFrameSize, &socket.compressStats)
+	socket.writeFraming = FramingNewline
+	socket.compression = ""
+}
+
+// framingSet switch the framing for reading and writing
+func (socket *SocketConnection) framingSet(framing string) {
+	socket.reader.framing = framing
+	socket.writeFraming = framing
+	socket.log.WithField("framing", framing).Debug("Switch framing")
+}
+
+// compressionSet set the compression for reading and writing ( "" means no compression )
+func (socket *SocketConnection) compressionSet(compression string) {
+	socket.reader.compression = compression
+	socket.compression = compression
+	socket.log.WithField("compression", compression).Debug("Switch compression")
+}
+
+// encodeFrame return the frame for the json-message, it is compressed if it is big enough
+func (socket *SocketConnection) encodeFrame(data []byte) ([]byte, error) {
+
+	maxSize := socket.reader.maxSize
+	if len(data) > maxSize {
+		return nil, &FrameSizeError{Size: len(data), Max: maxSize}
+	}
+
+	threshold := socket.options.CompressThreshold
+	if threshold <= 0 {
+		threshold = DefaultCompressThreshold
+	}
+
+	body := data
+	frameType := frameTypeMsg
+	if socket.compression != "" && len(data) >= threshold {
+		compressed, err := compress(socket.compression, data)
+		if err != nil {
+			socket.log.Error(err)
+		} else if len(compressed) < len(data) {
+			body = compressed
+			frameType = frameTypeMsgCompressed
+		}
+	}
+
+	frame, err := frameEncode(socket.writeFraming, frameType, maxSize, body)
+	if err != nil {
+		return nil, err
+	}
+
+	socket.compressStats.countOut(len(data), len(body), frameType == frameTypeMsgCompressed)
+	return frame, nil
+}
+
+// Framing return the framing of the connection which was agreed in the handshake
+func (socket *SocketConnection) Framing() string {
+	return socket.writeFraming
+}
+
 // ID return the connection-id
 func (socket *SocketConnection) ID() string {
 	return socket.id
@@ -98,11 +412,48 @@ func (socket *SocketConnection) RemoteNodeGroup() string {
 
 // ReadMessage will call the onMessage if an message is recieved
 // this function is synchron ( blocked if no message is aviable ! )
+//
+// messages with QoS are acked, duplicates are dropped
 func (socket *SocketConnection) ReadMessage() (Msg, error) {
+	for {
+		message, err := socket.readMessage(true)
+		if err == nil {
+			err = socket.ackRecieved(&message)
+		}
+		if err == errMsgDuplicate {
+			continue
+		}
+		return message, err
+	}
+}
+
+// readMessage read the next message, if verify is false the signature is not checked
+func (socket *SocketConnection) readMessage(verify bool) (Msg, error) {
+
+	newMessage, err := socket.readRaw()
+	if err != nil {
+		return Msg{}, err
+	}
+	return socket.readVerify(newMessage, verify)
+}
+
+// readRaw read and parse the next message, nothing is checked
+func (socket *SocketConnection) readRaw() (Msg, error) {
 
 	socket.log.Debug("Wait for message")
 
-	jsonString, _ := bufio.NewReader(socket.socket).ReadString('\n')
+	// while the handshake is running, the handshake-deadline is used
+	if timeout := socket.readTimeout(); timeout > 0 && !socket.handshakeRunning() {
+		socket.socket.SetReadDeadline(time.Now().Add(timeout))
+	}
+
+	frame, err := socket.reader.readFrame()
+	if err != nil {
+		return Msg{}, err
+	}
+	socket.lastReadSize = len(frame)
+
+	jsonString := string(frame)
 	socket.log.WithFields(logrus.Fields{
 		"raw": jsonString,
 	},
@@ -113,13 +464,45 @@ func (socket *SocketConnection) ReadMessage() (Msg, error) {
 		socket.log.Error(err)
 		return Msg{}, err
 	}
+	return newMessage, nil
+}
 
-	// we tag the message with our connection id, so that we WONT send it out again
-	newMessage.id = socket.lastMessageID
-	newMessage.context = socket.ID
+// readVerify check the signature of an message from readRaw and decrypt it
+func (socket *SocketConnection) readVerify(newMessage Msg, verify bool) (Msg, error) {
 
-	// iterate id
-	socket.lastMessageID = socket.lastMessageID + 1
+	// check the signature
+	if verify {
+		if err := verifyMsg(socket.options.Signer, socket.options.RequireSigned, &newMessage); err != nil {
+
+			// an message which is send again after an reconnect has the same nonce
+			if err == ErrMsgReplayed && socket.ackDuplicate(&newMessage) {
+				return newMessage, errMsgDuplicate
+			}
+
+			socket.log.WithFields(logrus.Fields{
+				"source":  newMessage.NodeSource,
+				"command": newMessage.Command,
+			}).Error(err)
+			return newMessage, &MsgRejectError{Message: newMessage, Reason: err}
+		}
+	}
+
+	// decrypt it, if it is for us
+	if verify && socket.options.Crypter != nil && socket.options.Crypter.shouldOpen(&newMessage) {
+		if err := socket.options.Crypter.Open(&newMessage); err != nil {
+			socket.log.WithFields(logrus.Fields{
+				"source":  newMessage.NodeSource,
+				"command": newMessage.Command,
+			}).Error(err)
+			return newMessage, &MsgRejectError{Message: newMessage, Reason: err}
+		}
+	}
+
+	socket.counters.count(socket.isControl(newMessage), true)
+
+	// we tag the message with our connection id, so that we WONT send it out again
+	newMessage.id = socket.messageIDNext()
+	newMessage.context = socket.ID()
 
 	// debug
 	socket.log.WithFields(logrus.Fields{
@@ -136,7 +519,16 @@ func (socket *SocketConnection) ReadMessage() (Msg, error) {
 }
 
 // SendMessage will send a message over the socket connection
-func (socket *SocketConnection) SendMessage(message Msg) {
+//
+// It is safe to call it from multiple goroutines, the message is placed in the send-queue of the connection
+// and written by the writer of the connection.
+// If an client is disconnected, the message is placed in the outbound-queue
+func (socket *SocketConnection) SendMessage(message Msg) error {
+	return socket.send(message, false)
+}
+
+// send place the message in the send-queue, with noWait we never block on an full send-queue
+func (socket *SocketConnection) send(message Msg, noWait bool) error {
 
 	// we don't send messages that comes from us
 	if message.context == socket.ID() {
@@ -145,15 +537,77 @@ func (socket *SocketConnection) SendMessage(message Msg) {
 		},
 		).Debug("We dont send to sender")
 
-		return
+		return nil
+	}
+
+	// control-messages belong to the current connection
+	if !isControlCommand(message.Command) && socket.queueMessage(message) {
+		return nil
+	}
+
+	err := socket.sendNow(message, noWait)
+	if err != nil {
+		socket.log.WithFields(logrus.Fields{
+			"command": message.Command,
+		}).Error(err)
+	}
+	return err
+}
+
+// messageIDNext return the next id for an message of this connection
+func (socket *SocketConnection) messageIDNext() int {
+	return int(atomic.AddInt64(&socket.lastMessageID, 1) - 1)
+}
+
+// sendNow encrypt, sign and write the message to the connection
+func (socket *SocketConnection) sendNow(message Msg, noWait bool) error {
+
+	writer := socket.writerGet()
+	if writer == nil {
+		return ErrNotConnected
 	}
 
 	// iterate id
-	message.id = socket.lastMessageID
-	socket.lastMessageID = socket.lastMessageID + 1
+	message.id = socket.messageIDNext()
+
+	// encrypt it for the target
+	if socket.options.Crypter != nil && socket.options.Crypter.shouldSeal(&message) {
+		if err := socket.options.Crypter.Seal(&message); err != nil {
+			socket.log.WithFields(logrus.Fields{
+				"msgID":  message.id,
+				"target": message.NodeTarget,
+			}).Error(err)
+
+			if !socket.options.AllowPlaintext {
+				return err
+			}
+		}
+	}
+
+	// sign it, if we are the first one that send it
+	signed := false
+	if socket.options.Signer != nil && message.Signature == "" {
+		if err := socket.options.Signer.Sign(&message); err != nil {
+			socket.log.WithFields(logrus.Fields{
+				"msgID":  message.id,
+				"source": message.NodeSource,
+			}).Error(err)
+		} else {
+			signed = true
+		}
+	}
 
-	// convert to string
-	newMessageString, _ := message.ToJSONString()
+	// remember it until it is acked
+	socket.ackPrepare(&message, signed)
+
+	// convert to json
+	newMessageJSON, _ := message.ToJSONByteArray()
+	frame, err := socket.encodeFrame(newMessageJSON)
+	if err != nil {
+		// it will never fit, so we don't send it again
+		socket.ackForget(message.Seq)
+		return err
+	}
 
 	// debug
 	socket.log.WithFields(logrus.Fields{
@@ -167,7 +621,19 @@ func (socket *SocketConnection) SendMessage(message Msg) {
 	).Debug("Send Message")
 
 	// send it
-	fmt.Fprintf(socket.socket, "%s\n", newMessageString)
+	if err := writer.enqueue(writerFrame{data: frame, batchable: socket.writeFraming == FramingLength, noWait: noWait}); err != nil {
+		// the message was dropped, only messages which are lost with the connection are send again
+		if err == ErrSendQueueFull || err == ErrSendTimeout {
+			socket.ackForget(message.Seq)
+		}
+		return err
+	}
+
+	if !isControlCommand(message.Command) {
+		socket.activityTouch()
+	}
+	socket.counters.count(socket.isControl(message), false)
+	return nil
 }
 
 // Close will close the current socket connection
@@ -175,180 +641,302 @@ func (socket *SocketConnection) close() {
 
 	// debug
 	socket.log.Info("Close connection")
+
+	// the writer send what is left and close the connection
+	if writer := socket.writerGet(); writer != nil {
+		writer.close()
+		return
+	}
 	socket.socket.Close()
 }
 
-// Serve [BLOCKING] will start the socket-server and run forever until an error occure
-// if an connection occure and the handshake was okay, an goroutine will be started which handle incoming messages
+// Serve [BLOCKING] will start the socket-server on an unix-socket and run forever until an error occure
+//
+// if systemd passed an listener for filename ( socket-activation ) it is used.
+// filename can start with "@" for an socket in the abstract namespace
 func (socket *SocketConnection) Serve(filename string, cb SocketCallbacks) error {
 
 	socket.log = socket.log.WithField("type", "server")
 
-	// remove socket if it already exists
-	if err := os.RemoveAll(filename); err != nil {
-		socket.log.Error(err)
+	serverListener, err := socket.ListenUnix(filename)
+	if err != nil {
 		return err
 	}
 
+	return socket.ServeListener(serverListener, cb)
+}
+
+// ListenUnix create the unix-socket for Serve() or ServeListeners()
+//
+// SocketMode, SocketOwner and SocketGroup of the options are applied to the file
+func (socket *SocketConnection) ListenUnix(filename string) (Listener, error) {
+
+	// systemd already created it
+	if serverListener := systemdListenerFor(filename); serverListener != nil {
+		socket.log.Info(fmt.Sprintf("Use SOCKET %s from systemd", filename))
+		return serverListener, nil
+	}
+
 	// open the socket
-	var err error
-	var serverListener net.Listener
-	serverListener, err = net.Listen("unix", filename)
+	serverListener, err := NetListen("unix", filename)
 	if err != nil {
 		socket.log.Error(err)
-		return err
+		return nil, err
+	}
+
+	if !isAbstractSocket(filename) {
+		if err := socket.socketFileApply(filename); err != nil {
+			socket.log.Error(err)
+			serverListener.Close()
+			return nil, err
+		}
 	}
 
 	socket.log.Info(fmt.Sprintf("Create SOCKET on %s", filename))
+	return serverListener, nil
+}
+
+// ServeListener [BLOCKING] accept connections from the listener and run until an error occure
+// every new connection get its own goroutine which run the handshake and handle incoming messages
+//
+// after Shutdown() ErrServerClosed is returned
+func (socket *SocketConnection) ServeListener(serverListener Listener, cb SocketCallbacks) error {
+
+	socket.log = socket.log.WithField("type", "server")
+
+	return socket.serveListener(ServerListener{Listener: serverListener}, cb)
+}
+
+// serveListener accept connections, the sessions get the options of the listener
+func (socket *SocketConnection) serveListener(serverListener ServerListener, cb SocketCallbacks) error {
+
+	options := socket.options
+	if serverListener.Options != nil {
+		options = *serverListener.Options
+	}
+
+	log := socket.log
+	if serverListener.Name != "" {
+		log = log.WithField("listener", serverListener.Name)
+	}
+
+	if !socket.listenerAdd(serverListener.Listener) {
+		serverListener.Listener.Close()
+		return ErrServerClosed
+	}
+	defer socket.listenerRemove(serverListener.Listener)
+
+	maxPending := options.MaxPendingHandshakes
+	if maxPending <= 0 {
+		maxPending = DefaultMaxPendingHandshakes
+	}
+	pending := make(chan struct{}, maxPending)
 
 	// wait for new clients
 	for {
 
 		// wait for a new client
-		socket.log.Debug("Wating for new client")
-		newSocketCon, err := serverListener.Accept()
+		log.Debug("Wating for new client")
+		newSocketCon, err := serverListener.Listener.Accept()
 		if err != nil {
-			socket.log.Error(err)
+			if socket.isShutdown() {
+				return ErrServerClosed
+			}
+			log.Error(err)
 			return err
 		}
 
-		// create a new session
-		// the filter is empty, as server we accept every message
-		newSocket := SocketNew()
-		newSocket.socket = newSocketCon
-
-		// ################################# handshake #################################
-		// send a helo to the client
-		newSocket.SendMessage(Msg{
-			NodeSource:  mynodename.NodeName, // i'am the source
-			GroupSource: "",                  // i hear on every group
-			NodeTarget:  "",                  // i don't know you, so is just send it to all
-			GroupTarget: "",                  // i don't know your group ( yet )
-			Command:     "HELO",
-		})
-
-		// we wait for OLEH
-		newSocket.log.Debug("Wait for OLEH-Message")
-		ehloMessage, err := newSocket.ReadMessage()
-		if err != nil {
-			newSocket.log.Error(err)
-			newSocket.close()
-			continue
-		}
-		if ehloMessage.Command != "OLEH" {
-			newSocket.log.Error("No OLEH was recieved")
-			newSocket.close()
+		// a client which not answer must not block other clients, so we limit how many are waiting
+		select {
+		case pending <- struct{}{}:
+		default:
+			log.Warn("Too many pending handshakes, close connection")
+			newSocketCon.Close()
 			continue
 		}
 
-		newSocket.remoteNodeName = ehloMessage.NodeSource
-		newSocket.remoteNodeGroup = ehloMessage.GroupSource
-
-		newSocket.log.Debug("")
-		newSocket.log.Debug("############################ Handshake finished ############################")
-		newSocket.log.Debug("")
+		// create a new session
+		// the filter is empty, as server we accept every message
+		newSocket := socket.newSession()
+		newSocket.options = options
+		newSocket.listenerName = serverListener.Name
+		if serverListener.Name != "" {
+			newSocket.log = newSocket.log.WithField("listener", serverListener.Name)
+		}
+		newSocket.connSet(newSocketCon)
 
-		// ############################ handshake finished #############################
+		go newSocket.serveSession(pending, cb)
+	}
 
-		// start goroutine which handle incoming messages
-		go newSocket.eventLoopWaitForMessage(cb)
+}
 
-		// callback - finished with handshake
-		if cb.OnHandshakeFinished != nil {
-			cb.OnHandshakeFinished(newSocket)
+// serveSession run the handshake of an new session and handle messages until the connection is lost
+//
+// pending is released after the handshake
+func (socket *SocketConnection) serveSession(pending chan struct{}, cb SocketCallbacks) {
+
+	// ################################# handshake #################################
+	err := socket.handshakeServer()
+	<-pending
+
+	// the server can have enough sessions
+	if err == nil {
+		socket.aclSessionAdd()
+		socket.limitSessionAdd()
+
+		// denied subscriptions are removed before we forward, the client get the ERRORs after the ACCEPT
+		denied := socket.aclSubscriptionsFilter()
+		if err = socket.server.sessionAdd(socket); err != nil {
+			socket.log.Warn(err)
+			socket.sendError(ErrorCodeAdmission, err.Error())
+		}
+		for _, deniedErr := range denied {
+			socket.sendError(ErrorCodeACL, deniedErr.Error())
 		}
 	}
 
-}
+	if err != nil {
+		socket.log.Error(err)
+		socket.aclSessionRemove()
+		socket.limitSessionRemove()
+		// OnConnect was never fired, so we don't fire OnDisconnect
+		socket.close()
+		if cb.OnConnectFailed != nil {
+			cb.OnConnectFailed(socket, 1, err)
+		}
+		return
+	}
 
-// Connect [BLOCKING] Connect to an existing socket
-func (socket *SocketConnection) Connect(filename, listenForNodeName, listenForGroupName string, cb SocketCallbacks) error {
+	// the subscriptions of an resumed session are checked again, before its buffer is send
+	// new messages wait behind the buffer, so we send it without the forwardLock
+	if socket.Resumed() {
+		socket.aclSubscriptionsCheck()
+		go socket.replaySend()
+	}
 
-	socket.log = socket.log.WithField("type", "client")
+	socket.subscriptionsRestore()
 
-	var err error
+	socket.server.presenceJoin(socket)
 
-	// this runs forever
-	for {
+	// callback - connected
+	if cb.OnConnect != nil {
+		cb.OnConnect(socket)
+	}
 
-		// wait for connections
-		for {
-			socket.socket, err = net.Dial("unix", filename)
-			if err != nil {
-				socket.log.Error(err)
-				time.Sleep(10 * time.Second)
-			}
+	socket.log.Debug("")
+	socket.log.Debug("############################ Handshake finished ############################")
+	socket.log.Debug("")
+	// ############################ handshake finished #############################
 
-			if socket.socket != nil {
-				break
-			}
-		}
+	// callback - finished with handshake
+	if cb.OnHandshakeFinished != nil {
+		cb.OnHandshakeFinished(socket)
+	}
 
-		// ################################# handshake #################################
-		// we wait for HELO
-		socket.log.Debug("Wait for HELO-Message")
-		heloMessage, err := socket.ReadMessage()
-		if err != nil {
-			socket.close()
-			socket.log.Error(err)
-			return err
-		}
-		if heloMessage.Command != "HELO" {
-			socket.close()
-			errNoHelo := errors.New("No OLEH was recieved")
-			socket.log.Error(errNoHelo)
-			return errNoHelo
-		}
+	socket.eventLoopWaitForMessage(cb)
+}
 
-		socket.remoteNodeName = heloMessage.NodeSource
-		socket.remoteNodeGroup = heloMessage.GroupSource
-
-		// and informate the server about what we listen
-		socket.SendMessage(Msg{
-			NodeSource:  listenForNodeName,
-			GroupSource: listenForGroupName,
-			NodeTarget:  heloMessage.NodeTarget,
-			GroupTarget: "",
-			Command:     "OLEH",
-		})
-
-		// callback - connected
-		if cb.OnConnect != nil {
-			cb.OnConnect(socket)
-		}
+// Connect [BLOCKING] Connect to an existing socket
+//
+// If dial or handshake fail or the connection is lost, Connect will retry with the ReconnectPolicy of the options.
+// It return if ctx is done or the policy give up
+func (socket *SocketConnection) Connect(ctx context.Context, filename, listenForNodeName, listenForGroupName string, cb SocketCallbacks) error {
+	return socket.ConnectTransport(ctx, NetTransport{Network: "unix", Address: filename}, listenForNodeName, listenForGroupName, cb)
+}
 
-		socket.log.Debug("")
-		socket.log.Debug("############################ Handshake finished ############################")
-		socket.log.Debug("")
-		// ############################ handshake finished #############################
+// ConnectTransport [BLOCKING] is like Connect, but the connection is created by the transport
+func (socket *SocketConnection) ConnectTransport(ctx context.Context, transport Transport, listenForNodeName, listenForGroupName string, cb SocketCallbacks) error {
 
-		// callback - finished with handshake
-		if cb.OnHandshakeFinished != nil {
-			cb.OnHandshakeFinished(socket)
-		}
+	socket.log = socket.log.WithField("type", "client")
 
-		socket.eventLoopWaitForMessage(cb)
-	}
+	return socket.connectLoop(ctx, transport, listenForNodeName, listenForGroupName, cb)
 }
 
 func (socket *SocketConnection) eventLoopWaitForMessage(cb SocketCallbacks) {
 
+	// heartbeat
+	socket.activityTouch()
+	heartbeatDone := make(chan struct{})
+	go socket.heartbeatLoop(heartbeatDone)
+
 	// close and remove session if disconnect or error occure
 	defer func() {
+		close(heartbeatDone)
+		socket.queueDisconnected()
+		socket.subscriptionsInactive()
 		socket.log.Debugf("Close '%s'", socket.ID())
 		socket.close()
-		cb.OnDisconnect(socket)
+		if socket.server != nil {
+			socket.server.sessionRemove(socket)
+			socket.server.presenceLeave(socket)
+			socket.aclSessionRemove()
+			socket.limitSessionRemove()
+		}
+		if cb.OnDisconnect != nil {
+			cb.OnDisconnect(socket)
+		}
 	}()
 
 	// message-loop
 	for {
-		message, err := socket.ReadMessage()
+		message, err := socket.readRaw()
+		if err != nil {
+			socket.log.Error(err)
+			break
+		}
+
+		// the limit is taken before the signature is checked, so also invalid messages are counted
+		// and also SUBSCRIBE or PING can flood us
+		if err := socket.limitMessage(message, socket.lastReadSize, cb); err != nil {
+			if err.(*LimitError).Violation.Action == LimitDisconnect {
+				break
+			}
+			if cb.OnError != nil {
+				cb.OnError(socket, &MsgRejectError{Message: message, Reason: err})
+			}
+			continue
+		}
+
+		message, err = socket.readVerify(message, true)
+		if err == errMsgDuplicate {
+			continue
+		}
 		if err != nil {
+
+			// only this message is rejected, we keep the connection
+			if _, isReject := err.(*MsgRejectError); isReject {
+				if cb.OnError != nil {
+					cb.OnError(socket, err)
+				}
+				continue
+			}
+
 			socket.log.Error(err)
 			break
 		}
 
-		cb.OnMessage(socket, message)
+		if socket.handleControl(message, cb) {
+			continue
+		}
+
+		if err := socket.aclPublish(message); err != nil {
+			socket.log.Warn(err)
+			socket.sendError(ErrorCodeACL, err.Error())
+			if cb.OnError != nil {
+				cb.OnError(socket, &MsgRejectError{Message: message, Reason: err})
+			}
+			continue
+		}
+
+		// we ACK it only if we accepted it
+		if err := socket.ackRecieved(&message); err != nil {
+			continue
+		}
+
+		socket.activityTouch()
+		if cb.OnMessage != nil {
+			cb.OnMessage(socket, message)
+		}
 	}
 
 }
@@ -0,0 +1,299 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+
+	"gitlab.com/gopilot/lib/config"
+)
+
+// Actions of an ACL-rule
+const (
+	ACLPublish   = "publish"
+	ACLSubscribe = "subscribe"
+)
+
+// Defaults of an ACL
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+)
+
+// ErrACLForeignSource is returned if the remote node send an message with the NodeSource of another node
+var ErrACLForeignSource = errors.New("NodeSource is not the node of this connection")
+
+// ACLRule allow or deny an action of remote nodes
+//
+// Node and Group are patterns over the name/group of the remote node ( from the handshake ),
+// NodeTarget, GroupTarget and Command are patterns over the message or subscription.
+// Patterns use the syntax of path.Match, "" match everything
+type ACLRule struct {
+	Node   string `json:"node,omitempty"`
+	Group  string `json:"group,omitempty"`
+	Action string `json:"action,omitempty"` // ACLPublish, ACLSubscribe or "" for both
+
+	NodeTarget  string `json:"nodeTarget,omitempty"`
+	GroupTarget string `json:"groupTarget,omitempty"`
+	Command     string `json:"command,omitempty"`
+
+	Allow bool `json:"allow"`
+}
+
+// ACLConfig is how an ACL is stored in the config
+type ACLConfig struct {
+	Default            string    `json:"default,omitempty"` // ACLAllow or ACLDeny ( "" means ACLDeny )
+	AllowForeignSource bool      `json:"allowForeignSource,omitempty"`
+	Rules              []ACLRule `json:"rules,omitempty"`
+}
+
+// ACL decide what remote nodes can publish and subscribe, the first matching rule win
+//
+// it can be changed while it is used by sessions, the subscriptions of all sessions are checked again.
+//
+// The rules match the node-name which the remote side send in the handshake.
+// Without an Signer with RequireSigned this name is not verified, so an client can claim the name of another node.
+// Use signed handshakes or restrict the local processes with PeerAllow.
+type ACL struct {
+	lock               sync.RWMutex
+	rules              []ACLRule
+	defaultAllow       bool
+	allowForeignSource bool
+
+	// sessions which use this ACL
+	sessionsLock sync.Mutex
+	sessions     map[*SocketConnection]struct{}
+}
+
+// ACLNew create an new ACL
+func ACLNew(aclConfig ACLConfig) (*ACL, error) {
+	var newACL ACL
+	if err := newACL.Set(aclConfig); err != nil {
+		return nil, err
+	}
+	return &newACL, nil
+}
+
+// Set replace the rules of the ACL
+func (acl *ACL) Set(aclConfig ACLConfig) error {
+
+	if aclConfig.Default != "" && aclConfig.Default != ACLAllow && aclConfig.Default != ACLDeny {
+		return fmt.Errorf("Unknown ACL default '%s'", aclConfig.Default)
+	}
+
+	for index, rule := range aclConfig.Rules {
+		if rule.Action != "" && rule.Action != ACLPublish && rule.Action != ACLSubscribe {
+			return fmt.Errorf("Unknown action '%s' in ACL rule %d", rule.Action, index)
+		}
+		for _, pattern := range []string{rule.Node, rule.Group, rule.NodeTarget, rule.GroupTarget, rule.Command} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("Invalid pattern '%s' in ACL rule %d", pattern, index)
+			}
+		}
+	}
+
+	acl.lock.Lock()
+	acl.rules = append([]ACLRule{}, aclConfig.Rules...)
+	acl.defaultAllow = aclConfig.Default == ACLAllow
+	acl.allowForeignSource = aclConfig.AllowForeignSource
+	acl.lock.Unlock()
+
+	// subscriptions which are not allowed anymore are removed
+	for _, session := range acl.sessionList() {
+		session.aclSubscriptionsCheck()
+	}
+
+	return nil
+}
+
+// sessionList return the sessions which use this ACL
+func (acl *ACL) sessionList() []*SocketConnection {
+	acl.sessionsLock.Lock()
+	defer acl.sessionsLock.Unlock()
+
+	var sessions []*SocketConnection
+	for session := range acl.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// LoadConfig read the ACL from the json-object name of the config, use it with config.Watch() to reload it
+func (acl *ACL) LoadConfig(name string) error {
+
+	var aclConfig ACLConfig
+	if err := configObjectDecode(name, &aclConfig); err != nil {
+		return err
+	}
+
+	return acl.Set(aclConfig)
+}
+
+// configObjectDecode decode the json-object name of the config into v
+func configObjectDecode(name string, v interface{}) error {
+
+	jsonObject, err := config.GetJSONObject(name)
+	if err != nil {
+		return err
+	}
+
+	// the config only know maps
+	jsonBytes, err := json.Marshal(jsonObject)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(jsonBytes, v)
+}
+
+// aclMatch return true if the pattern match the value
+//
+// an value of "" mean "everything", so it only match an allow-rule which allow everything.
+// A deny-rule match if it overlap
+func aclMatch(pattern, value string, allow bool) bool {
+	if pattern == "" {
+		return true
+	}
+	if value == "" {
+		return !allow || pattern == "*"
+	}
+	matched, _ := path.Match(pattern, value)
+	return matched
+}
+
+// Allowed return true if the remote node can do the action with the target
+func (acl *ACL) Allowed(action, node, group, nodeTarget, groupTarget, command string) bool {
+	acl.lock.RLock()
+	defer acl.lock.RUnlock()
+
+	for _, rule := range acl.rules {
+		if rule.Action != "" && rule.Action != action {
+			continue
+		}
+		if !aclMatch(rule.Node, node, true) || !aclMatch(rule.Group, group, true) {
+			continue
+		}
+		if !aclMatch(rule.NodeTarget, nodeTarget, rule.Allow) ||
+			!aclMatch(rule.GroupTarget, groupTarget, rule.Allow) ||
+			!aclMatch(rule.Command, command, rule.Allow) {
+			continue
+		}
+		return rule.Allow
+	}
+
+	return acl.defaultAllow
+}
+
+// foreignSourceAllowed return true if nodes can send messages with the NodeSource of other nodes
+func (acl *ACL) foreignSourceAllowed() bool {
+	acl.lock.RLock()
+	defer acl.lock.RUnlock()
+	return acl.allowForeignSource
+}
+
+// aclPublish check an message of the remote node
+func (socket *SocketConnection) aclPublish(message Msg) error {
+
+	acl := socket.options.ACL
+	if acl == nil {
+		return nil
+	}
+
+	if message.NodeSource != socket.remoteNodeName && !acl.foreignSourceAllowed() {
+		return ErrACLForeignSource
+	}
+
+	if !acl.Allowed(ACLPublish, socket.remoteNodeName, socket.remoteNodeGroup, message.NodeTarget, message.GroupTarget, message.Command) {
+		return fmt.Errorf("Publish of '%s' to '%s/%s' is not allowed", message.Command, message.NodeTarget, message.GroupTarget)
+	}
+	return nil
+}
+
+// aclSubscribe check an subscription of the remote node
+func (socket *SocketConnection) aclSubscribe(sub Subscription) error {
+
+	acl := socket.options.ACL
+	if acl == nil {
+		return nil
+	}
+
+	if !acl.Allowed(ACLSubscribe, socket.remoteNodeName, socket.remoteNodeGroup, sub.NodeTarget, sub.GroupTarget, sub.Command) {
+		return fmt.Errorf("Subscription of '%s' on '%s/%s' is not allowed", sub.Command, sub.NodeTarget, sub.GroupTarget)
+	}
+	return nil
+}
+
+// aclSessionAdd register the session by its ACL, so it is checked again if the ACL change
+func (socket *SocketConnection) aclSessionAdd() {
+	acl := socket.options.ACL
+	if acl == nil {
+		return
+	}
+
+	// the name of the remote node is not proven
+	if (socket.options.Signer == nil || !socket.options.RequireSigned) && socket.options.PeerAllow == nil {
+		socket.log.WithField("node", socket.remoteNodeName).Warn("ACL without signed handshake or peer-policy, the node-name is not verified")
+	}
+
+	acl.sessionsLock.Lock()
+	if acl.sessions == nil {
+		acl.sessions = make(map[*SocketConnection]struct{})
+	}
+	acl.sessions[socket] = struct{}{}
+	acl.sessionsLock.Unlock()
+}
+
+// aclSessionRemove remove the session from its ACL
+func (socket *SocketConnection) aclSessionRemove() {
+	acl := socket.options.ACL
+	if acl == nil {
+		return
+	}
+
+	acl.sessionsLock.Lock()
+	delete(acl.sessions, socket)
+	acl.sessionsLock.Unlock()
+}
+
+// aclSubscriptionsCheck remove the subscriptions which are not allowed, after an resume or if the ACL changed
+func (socket *SocketConnection) aclSubscriptionsCheck() {
+	for _, err := range socket.aclSubscriptionsFilter() {
+		socket.sendError(ErrorCodeACL, err.Error())
+	}
+}
+
+// aclSubscriptionsFilter remove the subscriptions which are not allowed and return why
+func (socket *SocketConnection) aclSubscriptionsFilter() []error {
+
+	var denied []error
+	for _, sub := range socket.RemoteSubscriptions() {
+		if err := socket.aclSubscribe(sub); err != nil {
+			socket.log.Warn(err)
+			denied = append(denied, err)
+
+			socket.subscriptionsLock.Lock()
+			socket.remoteSubscriptions = subscriptionsRemove(socket.remoteSubscriptions, sub)
+			socket.subscriptionsLock.Unlock()
+		}
+	}
+	return denied
+}
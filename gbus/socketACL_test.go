@@ -0,0 +1,264 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitlab.com/gopilot/lib/config"
+)
+
+func TestACLRules(t *testing.T) {
+
+	acl, err := ACLNew(ACLConfig{
+		Rules: []ACLRule{
+			{Node: "admin*", Allow: true},
+			{Action: ACLPublish, Command: "shutdown", Allow: false},
+			{Action: ACLSubscribe, GroupTarget: "secret", Allow: false},
+			{Group: "workers", NodeTarget: "worker-*", Allow: true},
+			{Group: "workers", GroupTarget: "jobs", Allow: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		action, node, group, nodeTarget, groupTarget, command string
+		allowed                                               bool
+	}{
+		{ACLPublish, "admin1", "ops", "", "", "shutdown", true},
+		{ACLPublish, "worker-1", "workers", "worker-2", "", "shutdown", false},
+		{ACLPublish, "worker-1", "workers", "worker-2", "", "ping", true},
+		{ACLPublish, "worker-1", "workers", "server", "", "ping", false},
+		{ACLSubscribe, "worker-1", "workers", "", "jobs", "", true},
+		{ACLSubscribe, "worker-1", "workers", "", "secret", "", false},
+		// "" subscribe everything, this overlap with the denied group
+		{ACLSubscribe, "worker-1", "workers", "worker-1", "", "", false},
+		{ACLSubscribe, "guest", "guests", "", "jobs", "", false},
+	}
+	for _, test := range tests {
+		allowed := acl.Allowed(test.action, test.node, test.group, test.nodeTarget, test.groupTarget, test.command)
+		if allowed != test.allowed {
+			t.Errorf("%+v: expected %v", test, test.allowed)
+		}
+	}
+
+	if _, err := ACLNew(ACLConfig{Rules: []ACLRule{{Command: "["}}}); err == nil {
+		t.Error("Invalid pattern was accepted")
+	}
+}
+
+func TestACLLoadConfig(t *testing.T) {
+
+	config.Init()
+	config.SetJSONObject("gbusACL", map[string]interface{}{
+		"default": "allow",
+		"rules": []interface{}{
+			map[string]interface{}{"action": "publish", "command": "shutdown", "allow": false},
+		},
+	})
+
+	acl, _ := ACLNew(ACLConfig{})
+	if err := acl.LoadConfig("gbusACL"); err != nil {
+		t.Fatal(err)
+	}
+	if acl.Allowed(ACLPublish, "nodeA", "", "", "", "shutdown") {
+		t.Error("shutdown should be denied")
+	}
+	if !acl.Allowed(ACLPublish, "nodeA", "", "", "", "ping") {
+		t.Error("ping should be allowed by default")
+	}
+}
+
+func TestACLEnforce(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+
+	acl, err := ACLNew(ACLConfig{
+		Rules: []ACLRule{
+			{Action: ACLPublish, Node: "testnode", Command: "ping", Allow: true},
+			{Action: ACLSubscribe, Node: "testnode", NodeTarget: "testnode", Allow: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan Msg, 10)
+	sessions := make(chan *SocketConnection, 1)
+	server := SocketNew()
+	server.OptionsSet(SocketOptions{ACL: acl})
+	go server.Serve(filename, SocketCallbacks{
+		OnHandshakeFinished: func(socket *SocketConnection) {
+			sessions <- socket
+		},
+		OnMessage: func(socket *SocketConnection, message Msg) {
+			received <- message
+		},
+	})
+	waitForSocket(filename)
+	defer server.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errs := make(chan error, 10)
+	client := SocketNew()
+	go client.Connect(ctx, filename, "testnode", "test", SocketCallbacks{
+		OnError: func(socket *SocketConnection, err error) {
+			errs <- err
+		},
+	})
+
+	var session *SocketConnection
+	select {
+	case session = <-sessions:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No session")
+	}
+
+	expectDenied := func() {
+		select {
+		case err := <-errs:
+			if remoteErr, ok := err.(*RemoteError); !ok || remoteErr.Code != ErrorCodeACL {
+				t.Fatalf("Expected ACL-error, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("No ACL-error recieved")
+		}
+	}
+
+	// the subscription of the handshake is allowed
+	if len(session.RemoteSubscriptions()) != 1 {
+		t.Fatalf("Expected the handshake-subscription, got %v", session.RemoteSubscriptions())
+	}
+
+	client.SendMessage(Msg{NodeSource: "testnode", Command: "shutdown"})
+	expectDenied()
+	client.SendMessage(Msg{NodeSource: "othernode", Command: "ping"})
+	expectDenied()
+	client.SendMessage(Msg{NodeSource: "testnode", Command: "ping"})
+	expectMessage(t, received, "ping")
+
+	// a denied message is not acked, an allowed one is
+	client.SendMessage(Msg{NodeSource: "testnode", Command: "shutdown", QoS: QoSAtLeastOnce})
+	expectDenied()
+	client.SendMessage(Msg{NodeSource: "testnode", Command: "ping", QoS: QoSAtLeastOnce})
+	expectMessage(t, received, "ping")
+	for i := 0; i < 100 && client.Unacked() != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if client.Unacked() != 1 {
+		t.Fatalf("Expected the denied message as unacked, got %d", client.Unacked())
+	}
+
+	client.Subscribe(Subscription{GroupTarget: "admin"})
+	expectDenied()
+	if len(session.RemoteSubscriptions()) != 1 {
+		t.Errorf("Denied subscription was added: %v", session.RemoteSubscriptions())
+	}
+
+	// the subscription of the handshake is not allowed anymore
+	acl.Set(ACLConfig{
+		Rules: []ACLRule{
+			{Action: ACLPublish, Node: "testnode", Command: "ping", Allow: true},
+		},
+	})
+	expectDenied()
+	if len(session.RemoteSubscriptions()) != 0 {
+		t.Errorf("Subscription was not removed after reload: %v", session.RemoteSubscriptions())
+	}
+
+	// reload the rules while the session is running
+	acl.Set(ACLConfig{Default: ACLAllow})
+	client.SendMessage(Msg{NodeSource: "testnode", Command: "shutdown"})
+	expectMessage(t, received, "shutdown")
+}
+
+func TestACLResume(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+
+	acl, err := ACLNew(ACLConfig{
+		Rules: []ACLRule{
+			{Action: ACLSubscribe, Node: "testnode", NodeTarget: "testnode", Allow: true},
+			{Action: ACLSubscribe, Node: "testnode", GroupTarget: "alerts", Allow: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var bus GBus
+	bus.Init()
+	bus.Run()
+
+	subscribed := make(chan *SocketConnection, 10)
+	server := SocketNew()
+	server.OptionsSet(SocketOptions{ACL: acl, SessionResume: 5 * time.Second})
+	bus.Subscribe("server", "", "", server.ForwardAll)
+	go server.Serve(filename, SocketCallbacks{
+		OnSubscriptionChanged: func(socket *SocketConnection) {
+			subscribed <- socket
+		},
+	})
+	defer server.Shutdown()
+	waitForSocket(filename)
+
+	messages := make(chan Msg, 10)
+	client := SocketNew()
+	client.OptionsSet(SocketOptions{
+		Reconnect: ReconnectPolicy{InitialBackoff: 500 * time.Millisecond},
+	})
+	client.Subscribe(Subscription{GroupTarget: "alerts"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.Connect(ctx, filename, "testnode", "test", SocketCallbacks{
+		OnMessage: func(socket *SocketConnection, message Msg) {
+			messages <- message
+		},
+	})
+
+	var session *SocketConnection
+	select {
+	case session = <-subscribed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client did not subscribe")
+	}
+
+	// the parked session is not checked while the ACL change
+	session.close()
+	waitForParked(t, server, 1)
+	acl.Set(ACLConfig{
+		Rules: []ACLRule{
+			{Action: ACLSubscribe, Node: "testnode", NodeTarget: "testnode", Allow: true},
+		},
+	})
+	bus.PublishPayload("server", "", "", "alerts", "denied", "")
+
+	// but after the resume, so the buffered message is not send
+	waitForParked(t, server, 0)
+	bus.PublishPayload("server", "testnode", "", "test", "direct", "")
+	expectMessage(t, messages, "direct")
+}
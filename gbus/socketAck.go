@@ -0,0 +1,290 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Delivery-guarantees of an message
+const (
+	QoSAtMostOnce  = 0 // fire and forget
+	QoSAtLeastOnce = 1 // the remote side ack the message, it is send again after an reconnect
+)
+
+// CapAck is the capability for sequence-numbers and ACK
+const CapAck = "ack"
+
+// Defaults for acknowledged messages
+const (
+	DefaultMaxUnacked  = 1024
+	DefaultDedupWindow = 10 * time.Minute
+)
+
+// errMsgDuplicate is used internally if an message was already recieved
+var errMsgDuplicate = errors.New("Duplicate message")
+
+// msgDedup remember the ids of recieved messages
+type msgDedup struct {
+	window    time.Duration
+	seenLock  sync.Mutex
+	seen      map[string]int64
+	lastPrune int64
+}
+
+func msgDedupNew(window time.Duration) *msgDedup {
+	if window <= 0 {
+		window = DefaultDedupWindow
+	}
+
+	return &msgDedup{
+		window: window,
+		seen:   make(map[string]int64),
+	}
+}
+
+// check return true if the message was already seen inside the window
+func (dedup *msgDedup) check(message *Msg) bool {
+
+	now := time.Now().UnixNano()
+	window := int64(dedup.window)
+
+	dedup.seenLock.Lock()
+	defer dedup.seenLock.Unlock()
+
+	// remove old ids from time to time
+	if now-dedup.lastPrune > window {
+		for key, seen := range dedup.seen {
+			if seen < now-window {
+				delete(dedup.seen, key)
+			}
+		}
+		dedup.lastPrune = now
+	}
+
+	key := message.NodeSource + "/" + message.MsgID
+	if _, exist := dedup.seen[key]; exist {
+		return true
+	}
+	dedup.seen[key] = now
+
+	return false
+}
+
+// contains return true if the message was already seen, it is not remembered
+func (dedup *msgDedup) contains(message *Msg) bool {
+
+	dedup.seenLock.Lock()
+	defer dedup.seenLock.Unlock()
+
+	seen, exist := dedup.seen[message.NodeSource+"/"+message.MsgID]
+	return exist && seen >= time.Now().UnixNano()-int64(dedup.window)
+}
+
+// dedupGet return the duplicate-filter
+//
+// sessions use the one of there server, so an message which is send again after an reconnect is found
+func (socket *SocketConnection) dedupGet() *msgDedup {
+
+	if socket.server != nil {
+		return socket.server.dedupGet()
+	}
+
+	socket.ackLock.Lock()
+	defer socket.ackLock.Unlock()
+
+	if socket.dedup == nil {
+		socket.dedup = msgDedupNew(socket.options.DedupWindow)
+	}
+	return socket.dedup
+}
+
+// ackPrepare give an message with QoS an id and a sequence-number and remember it until it is acked
+//
+// messages without QoS or if the remote side don't support ACK are send as they are.
+// If we signed it, an retransmit is signed again with an new timestamp and nonce, the MsgID stay the same for the dedup
+func (socket *SocketConnection) ackPrepare(message *Msg, signed bool) {
+
+	if message.QoS < QoSAtLeastOnce || isControlCommand(message.Command) {
+		message.Seq = 0
+		return
+	}
+
+	if message.MsgID == "" {
+		message.MsgID = nonceNew()
+	}
+
+	if !socket.HasCapability(CapAck) {
+		socket.log.WithField("msgID", message.MsgID).Debug("Remote side does not support ACK, send without QoS")
+		message.Seq = 0
+		return
+	}
+
+	maxUnacked := socket.options.MaxUnacked
+	if maxUnacked <= 0 {
+		maxUnacked = DefaultMaxUnacked
+	}
+
+	socket.ackLock.Lock()
+	defer socket.ackLock.Unlock()
+
+	if socket.ackPending == nil {
+		socket.ackPending = make(map[uint64]Msg)
+	}
+
+	// we keep the newest, acked ones in the order are skipped
+	for len(socket.ackPending) >= maxUnacked && len(socket.ackOrder) > 0 {
+		oldest := socket.ackOrder[0]
+		socket.ackOrder = socket.ackOrder[1:]
+
+		if pending, exist := socket.ackPending[oldest]; exist {
+			socket.log.WithField("msgID", pending.MsgID).Warn("Too many unacked messages, forget the oldest")
+			delete(socket.ackPending, oldest)
+		}
+	}
+
+	socket.ackSeq++
+	message.Seq = socket.ackSeq
+	pending := *message
+	if signed {
+		pending.Timestamp = 0
+		pending.Nonce = ""
+		pending.Signature = ""
+	}
+	socket.ackPending[message.Seq] = pending
+	socket.ackOrder = append(socket.ackOrder, message.Seq)
+
+	// remove the acked ones from the order, before it grow too much
+	if len(socket.ackOrder) > 2*maxUnacked {
+		order := socket.ackOrder[:0]
+		for _, seq := range socket.ackOrder {
+			if _, exist := socket.ackPending[seq]; exist {
+				order = append(order, seq)
+			}
+		}
+		socket.ackOrder = order
+	}
+}
+
+// ackForget is called if the message could not be send
+func (socket *SocketConnection) ackForget(seq uint64) {
+	socket.ackLock.Lock()
+	delete(socket.ackPending, seq)
+	socket.ackLock.Unlock()
+}
+
+// ackSend confirm the message to the remote side
+func (socket *SocketConnection) ackSend(seq uint64) {
+	socket.SendMessage(Msg{
+		NodeSource: socket.localNodeName,
+		NodeTarget: socket.remoteNodeName,
+		Command:    cmdAck,
+		Payload:    strconv.FormatUint(seq, 10),
+	})
+}
+
+// ackHandle remove the acked message
+func (socket *SocketConnection) ackHandle(message Msg) {
+
+	seq, err := strconv.ParseUint(message.Payload, 10, 64)
+	if err != nil {
+		socket.log.Error(err)
+		return
+	}
+
+	socket.ackLock.Lock()
+	delete(socket.ackPending, seq)
+	socket.ackLock.Unlock()
+}
+
+// ackRecieved is called for every accepted message, it send the ACK
+// and return errMsgDuplicate if we already got this message
+//
+// it must be called after all checks, so we never ACK an message which we rejected
+func (socket *SocketConnection) ackRecieved(message *Msg) error {
+
+	if message.Seq == 0 || isControlCommand(message.Command) {
+		return nil
+	}
+
+	// also duplicates are acked, maybe the first ACK was lost
+	socket.ackSend(message.Seq)
+
+	if message.MsgID != "" && socket.dedupGet().check(message) {
+		socket.log.WithFields(logrus.Fields{
+			"source": message.NodeSource,
+			"msgID":  message.MsgID,
+		}).Debug("Drop duplicate message")
+		return errMsgDuplicate
+	}
+
+	return nil
+}
+
+// ackDuplicate ACK an message which we already accepted, return false if we never saw it
+//
+// the signature of an message which is send again is already known by the replay-protection
+func (socket *SocketConnection) ackDuplicate(message *Msg) bool {
+
+	if message.Seq == 0 || message.MsgID == "" || isControlCommand(message.Command) {
+		return false
+	}
+	if !socket.dedupGet().contains(message) {
+		return false
+	}
+
+	socket.ackSend(message.Seq)
+	return true
+}
+
+// ackRetransmit send all unacked messages again, this is done after an reconnect
+func (socket *SocketConnection) ackRetransmit() {
+
+	socket.ackLock.Lock()
+	var pending []Msg
+	for _, message := range socket.ackPending {
+		pending = append(pending, message)
+	}
+	socket.ackPending = nil
+	socket.ackOrder = nil
+	socket.ackLock.Unlock()
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Seq < pending[j].Seq
+	})
+
+	for _, message := range pending {
+		socket.log.WithField("msgID", message.MsgID).Debug("Send unacked message again")
+		socket.sendNow(message, false)
+	}
+}
+
+// Unacked return the count of messages which wait for an ACK
+func (socket *SocketConnection) Unacked() int {
+	socket.ackLock.Lock()
+	defer socket.ackLock.Unlock()
+
+	return len(socket.ackPending)
+}
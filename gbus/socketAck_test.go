@@ -0,0 +1,244 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"context"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAckDuplicate(t *testing.T) {
+
+	server, client, serverErr, clientErr := pipeHandshake(SocketOptions{}, SocketOptions{})
+	if serverErr != nil || clientErr != nil {
+		t.Fatal(serverErr, clientErr)
+	}
+
+	client.SendMessage(Msg{NodeSource: "testnode", Command: "telemetry"})
+	client.SendMessage(Msg{NodeSource: "testnode", Command: "important", QoS: QoSAtLeastOnce})
+	if client.Unacked() != 1 {
+		t.Fatalf("Expected one unacked message, got %d", client.Unacked())
+	}
+
+	// like after an reconnect, the server get it twice
+	client.ackRetransmit()
+	client.SendMessage(Msg{NodeSource: "testnode", Command: "after"})
+
+	for _, expected := range []string{"telemetry", "important", "after"} {
+		message, err := server.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Command != expected {
+			t.Fatalf("Expected %s, got %s", expected, message.Command)
+		}
+	}
+
+	// the server acked both copies
+	for i := 0; i < 2; i++ {
+		message, err := client.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !client.handleControl(message, SocketCallbacks{}) || message.Command != cmdAck {
+			t.Fatalf("Expected ACK, got %s", message.Command)
+		}
+	}
+	if client.Unacked() != 0 {
+		t.Fatalf("Expected no unacked message, got %d", client.Unacked())
+	}
+}
+
+func TestAckRetransmitAfterReconnect(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+
+	// the first session is kicked
+	var sessions int32
+	recieved := make(chan Msg, 10)
+
+	server := SocketNew()
+	go server.Serve(filename, SocketCallbacks{
+		OnHandshakeFinished: func(socket *SocketConnection) {
+			if atomic.AddInt32(&sessions, 1) == 1 {
+				socket.close()
+			}
+		},
+		OnMessage: func(socket *SocketConnection, message Msg) {
+			recieved <- message
+		},
+	})
+	waitForSocket(filename)
+	defer server.Shutdown()
+
+	var sendErr atomic.Value
+	client := SocketNew()
+	client.OptionsSet(SocketOptions{
+		Reconnect: ReconnectPolicy{InitialBackoff: 10 * time.Millisecond},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.Connect(ctx, filename, "testnode", "test", SocketCallbacks{
+		OnDisconnect: func(socket *SocketConnection) {
+			if atomic.LoadInt32(&sessions) != 1 {
+				return
+			}
+
+			// the connection is gone, but the message is not lost
+			err := socket.SendMessage(Msg{NodeSource: "testnode", Command: "important", QoS: QoSAtLeastOnce})
+			sendErr.Store(err != nil)
+		},
+	})
+
+	expectMessage(t, recieved, "important")
+	if failed, _ := sendErr.Load().(bool); !failed {
+		t.Fatal("Expected that the first send failed")
+	}
+
+	for i := 0; i < 100 && client.Unacked() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if client.Unacked() != 0 {
+		t.Fatal("Message was not acked")
+	}
+}
+
+func TestSubscriptionQoS(t *testing.T) {
+
+	server, client, serverErr, clientErr := pipeHandshake(SocketOptions{}, SocketOptions{})
+	if serverErr != nil || clientErr != nil {
+		t.Fatal(serverErr, clientErr)
+	}
+
+	server.remoteSubscriptions = append(server.remoteSubscriptions, Subscription{GroupTarget: "alerts", QoS: QoSAtLeastOnce})
+
+	server.Forward(&Msg{NodeSource: "server", GroupTarget: "alerts", Command: "fire"}, "alerts", "fire", "")
+	message, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.QoS != QoSAtLeastOnce || message.Seq == 0 || message.MsgID == "" {
+		t.Fatalf("Expected an acknowledged message, got %+v", message)
+	}
+}
+
+func TestAckEvictOldest(t *testing.T) {
+
+	_, client, serverErr, clientErr := pipeHandshake(SocketOptions{}, SocketOptions{MaxUnacked: 3})
+	if serverErr != nil || clientErr != nil {
+		t.Fatal(serverErr, clientErr)
+	}
+
+	for i := 0; i < 3; i++ {
+		client.SendMessage(Msg{NodeSource: "testnode", Command: "important", QoS: QoSAtLeastOnce})
+	}
+
+	// the first one is acked, the others not
+	client.ackHandle(Msg{Command: cmdAck, Payload: "1"})
+
+	for i := 0; i < 2; i++ {
+		client.SendMessage(Msg{NodeSource: "testnode", Command: "important", QoS: QoSAtLeastOnce})
+	}
+
+	// the oldest unacked is forgotten
+	for _, seq := range []uint64{3, 4, 5} {
+		if _, exist := client.ackPending[seq]; !exist {
+			t.Fatalf("Expected %d as unacked, got %v", seq, client.ackPending)
+		}
+	}
+	if client.Unacked() != 3 {
+		t.Fatalf("Expected 3 unacked, got %d", client.Unacked())
+	}
+}
+
+func TestAckDuplicateSigned(t *testing.T) {
+
+	serverSigner := HmacSignerNew(time.Minute)
+	serverSigner.SecretSet("testnode", "secret")
+	clientSigner := HmacSignerNew(time.Minute)
+	clientSigner.SecretSet("testnode", "secret")
+
+	server, client, serverErr, clientErr := pipeHandshake(SocketOptions{Signer: serverSigner}, SocketOptions{Signer: clientSigner})
+	if serverErr != nil || clientErr != nil {
+		t.Fatal(serverErr, clientErr)
+	}
+
+	// the copy is signed again, the dedup find it by the MsgID
+	client.SendMessage(Msg{NodeSource: "testnode", Command: "important", QoS: QoSAtLeastOnce})
+	client.ackRetransmit()
+	client.SendMessage(Msg{NodeSource: "testnode", Command: "after"})
+
+	for _, expected := range []string{"important", "after"} {
+		message, err := server.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Command != expected || message.Signature == "" {
+			t.Fatalf("Expected signed %s, got %+v", expected, message)
+		}
+	}
+
+	// the copy is also acked
+	for i := 0; i < 2; i++ {
+		message, err := client.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !client.handleControl(message, SocketCallbacks{}) || message.Command != cmdAck {
+			t.Fatalf("Expected ACK, got %s", message.Command)
+		}
+	}
+	if client.Unacked() != 0 {
+		t.Fatalf("Expected no unacked message, got %d", client.Unacked())
+	}
+}
+
+func TestAckRetransmitSignedAgain(t *testing.T) {
+
+	serverSigner := HmacSignerNew(time.Minute)
+	serverSigner.SecretSet("testnode", "secret")
+	clientSigner := HmacSignerNew(time.Minute)
+	clientSigner.SecretSet("testnode", "secret")
+
+	server, client, serverErr, clientErr := pipeHandshake(SocketOptions{Signer: serverSigner}, SocketOptions{Signer: clientSigner})
+	if serverErr != nil || clientErr != nil {
+		t.Fatal(serverErr, clientErr)
+	}
+
+	client.SendMessage(Msg{NodeSource: "testnode", Command: "important", QoS: QoSAtLeastOnce})
+	client.ackRetransmit()
+
+	first, err := server.readMessage(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := server.readMessage(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an new nonce, so the replay-protection accept it
+	if second.MsgID != first.MsgID || second.Nonce == first.Nonce || second.Signature == first.Signature {
+		t.Fatalf("Expected an new signature with the same MsgID, got %+v and %+v", first, second)
+	}
+}
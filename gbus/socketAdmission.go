@@ -0,0 +1,97 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// What the server do if an node connect while it has already MaxSessionsPerNode sessions
+const (
+	DuplicateRejectNew = "rejectNew" // the new session is rejected ( default )
+	DuplicateKickOld   = "kickOld"   // the oldest session of the node is closed
+)
+
+// AdmissionError is returned if the server reject an new session
+type AdmissionError struct {
+	Reason string
+}
+
+func (err *AdmissionError) Error() string {
+	return "Session rejected: " + err.Reason
+}
+
+// sessionAdmit check the limits of the server for an new session, socket.sessionsLock must be held
+//
+// it return the sessions which must be kicked for the new one, they are already removed from the server
+func (socket *SocketConnection) sessionAdmit(session *SocketConnection) ([]*SocketConnection, error) {
+
+	if socket.isShutdown() {
+		return nil, &AdmissionError{Reason: "Server is shutting down"}
+	}
+
+	var kick []*SocketConnection
+
+	if maxPerNode := socket.options.MaxSessionsPerNode; maxPerNode > 0 {
+
+		var nodeSessions []*SocketConnection
+		for _, existing := range socket.sessions {
+			if existing.remoteNodeName == session.remoteNodeName {
+				nodeSessions = append(nodeSessions, existing)
+			}
+		}
+
+		if len(nodeSessions) >= maxPerNode {
+			if socket.options.DuplicateNode != DuplicateKickOld {
+				return nil, &AdmissionError{
+					Reason: fmt.Sprintf("Node '%s' has already %d sessions", session.remoteNodeName, len(nodeSessions)),
+				}
+			}
+
+			// the oldest go
+			sort.Slice(nodeSessions, func(i, j int) bool {
+				return atomic.LoadInt64(&nodeSessions[i].connectTime) < atomic.LoadInt64(&nodeSessions[j].connectTime)
+			})
+			kick = nodeSessions[:len(nodeSessions)-maxPerNode+1]
+		}
+	}
+
+	if maxSessions := socket.options.MaxSessions; maxSessions > 0 && len(socket.sessions)-len(kick) >= maxSessions {
+		return nil, &AdmissionError{
+			Reason: fmt.Sprintf("Server has already %d sessions", len(socket.sessions)),
+		}
+	}
+
+	for _, kicked := range kick {
+		atomic.StoreInt32(&kicked.noResume, 1)
+		atomic.StoreInt32(&kicked.replaced, 1)
+		delete(socket.sessions, kicked.ID())
+	}
+
+	return kick, nil
+}
+
+// sessionKick close an session which was replaced by a new connection of the same node
+func (socket *SocketConnection) sessionKick(session *SocketConnection) {
+	session.log.Info("Session replaced by a new connection")
+	session.sendError(ErrorCodeAdmission, "Replaced by a new connection of the same node")
+	session.close()
+}
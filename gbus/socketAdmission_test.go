@@ -0,0 +1,135 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// admissionClient connect an client, the result of Connect() is sent to the returned channel
+func admissionClient(ctx context.Context, filename, node string, maxAttempts int) chan error {
+
+	result := make(chan error, 1)
+	client := SocketNew()
+	client.OptionsSet(SocketOptions{
+		Reconnect: ReconnectPolicy{
+			InitialBackoff: 10 * time.Millisecond,
+			MaxBackoff:     10 * time.Millisecond,
+			Multiplier:     1.0,
+			MaxAttempts:    maxAttempts,
+		},
+	})
+	go func() {
+		result <- client.Connect(ctx, filename, node, "test", SocketCallbacks{})
+	}()
+	return result
+}
+
+// expectAdmissionError wait until the client give up because the server reject it
+func expectAdmissionError(t *testing.T, result chan error, attempts int) {
+	select {
+	case err := <-result:
+		connectErr, ok := err.(*ConnectError)
+		if !ok {
+			t.Fatalf("Expected ConnectError, got %v", err)
+		}
+		if connectErr.Attempts != attempts {
+			t.Errorf("Expected %d attempts, got %d", attempts, connectErr.Attempts)
+		}
+		if remoteErr, ok := connectErr.LastErr.(*RemoteError); !ok || remoteErr.Code != ErrorCodeAdmission {
+			t.Fatalf("Expected admission-error, got %v", connectErr.LastErr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Session was not rejected")
+	}
+}
+
+func admissionServer(filename string, options SocketOptions) *SocketConnection {
+	server := SocketNew()
+	server.OptionsSet(options)
+	go server.Serve(filename, SocketCallbacks{})
+	waitForSocket(filename)
+	return server
+}
+
+func TestAdmissionMaxSessions(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+	server := admissionServer(filename, SocketOptions{MaxSessions: 1})
+	defer server.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	admissionClient(ctx, filename, "nodeA", 0)
+	waitForSessions(t, server, 1)
+
+	// every attempt is rejected until the client give up
+	expectAdmissionError(t, admissionClient(ctx, filename, "nodeB", 3), 3)
+	if sessions := waitForSessions(t, server, 1); sessions[0].RemoteNodeName != "nodeA" {
+		t.Errorf("Wrong session %+v", sessions[0])
+	}
+}
+
+func TestAdmissionDuplicateReject(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+	server := admissionServer(filename, SocketOptions{MaxSessionsPerNode: 1})
+	defer server.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	admissionClient(ctx, filename, "nodeA", 0)
+	first := waitForSessions(t, server, 1)[0]
+
+	expectAdmissionError(t, admissionClient(ctx, filename, "nodeA", 1), 1)
+
+	// other nodes are welcome
+	admissionClient(ctx, filename, "nodeB", 0)
+	waitForSessions(t, server, 2)
+	if server.Session(first.ID) == nil {
+		t.Error("The first session was closed")
+	}
+}
+
+func TestAdmissionDuplicateKickOld(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+	server := admissionServer(filename, SocketOptions{MaxSessionsPerNode: 1, DuplicateNode: DuplicateKickOld})
+	defer server.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	firstResult := admissionClient(ctx, filename, "nodeA", 1)
+	first := waitForSessions(t, server, 1)[0]
+
+	// the kick count as failed attempt of the old client
+	admissionClient(ctx, filename, "nodeA", 0)
+	expectAdmissionError(t, firstResult, 1)
+
+	sessions := waitForSessions(t, server, 1)
+	if sessions[0].ID == first.ID {
+		t.Error("The old session is still there")
+	}
+}
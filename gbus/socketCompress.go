@@ -0,0 +1,260 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Compression-algorithms for messages, only used with length-framing
+const (
+	CompressionDeflate = "deflate"
+	CompressionGzip    = "gzip"
+)
+
+// Capabilities for compression, the first one which both sides support is used
+const (
+	CapCompressDeflate = "compress.deflate"
+	CapCompressGzip    = "compress.gzip"
+)
+
+// DefaultCompressThreshold is the min size of a message which will be compressed
+const DefaultCompressThreshold = 1024
+
+// compressionPreferred is the order in which we select the compression
+var compressionPreferred = []struct {
+	capability string
+	algorithm  string
+}{
+	{CapCompressDeflate, CompressionDeflate},
+	{CapCompressGzip, CompressionGzip},
+}
+
+var deflateWriters = sync.Pool{
+	New: func() interface{} {
+		writer, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return writer
+	},
+}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// CompressionStats are the statistics of the compression of an connection
+//
+// Bytes are the size of the json-messages, WireBytes the size of the frame-bodys on the wire
+type CompressionStats struct {
+	Algorithm     string
+	MessagesIn    uint64
+	MessagesOut   uint64
+	CompressedIn  uint64
+	CompressedOut uint64
+	BytesIn       uint64
+	BytesOut      uint64
+	WireBytesIn   uint64
+	WireBytesOut  uint64
+}
+
+// RatioIn return the size on the wire compared to the message-size of incoming messages ( 1.0 means no compression )
+func (stats CompressionStats) RatioIn() float64 {
+	if stats.BytesIn == 0 {
+		return 1.0
+	}
+	return float64(stats.WireBytesIn) / float64(stats.BytesIn)
+}
+
+// RatioOut return the size on the wire compared to the message-size of outgoing messages ( 1.0 means no compression )
+func (stats CompressionStats) RatioOut() float64 {
+	if stats.BytesOut == 0 {
+		return 1.0
+	}
+	return float64(stats.WireBytesOut) / float64(stats.BytesOut)
+}
+
+// compressStats is the thread-safe counter behind CompressionStats
+type compressStats struct {
+	lock  sync.Mutex
+	stats CompressionStats
+}
+
+func (counter *compressStats) countIn(size, wireSize int, compressed bool) {
+	counter.lock.Lock()
+	counter.stats.MessagesIn++
+	counter.stats.BytesIn += uint64(size)
+	counter.stats.WireBytesIn += uint64(wireSize)
+	if compressed {
+		counter.stats.CompressedIn++
+	}
+	counter.lock.Unlock()
+}
+
+func (counter *compressStats) countOut(size, wireSize int, compressed bool) {
+	counter.lock.Lock()
+	counter.stats.MessagesOut++
+	counter.stats.BytesOut += uint64(size)
+	counter.stats.WireBytesOut += uint64(wireSize)
+	if compressed {
+		counter.stats.CompressedOut++
+	}
+	counter.lock.Unlock()
+}
+
+func (counter *compressStats) get() CompressionStats {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+	return counter.stats
+}
+
+// CompressionStats return the compression-statistics of the connection
+func (socket *SocketConnection) CompressionStats() CompressionStats {
+	stats := socket.compressStats.get()
+	stats.Algorithm = socket.compression
+	return stats
+}
+
+// compressionSelect return the algorithm for the agreed capabilities, "" means no compression
+func compressionSelect(capabilities []string) string {
+	for _, preferred := range compressionPreferred {
+		if capabilityContains(capabilities, preferred.capability) {
+			return preferred.algorithm
+		}
+	}
+	return ""
+}
+
+// compressionAgree remove all compression-capabilitys except the one we prefer
+//
+// the server select the algorithm from the agreed capabilities, so only one should be left
+func compressionAgree(capabilities []string, preferred string) []string {
+
+	// our preferred algorithm first, after that the default order
+	selected := ""
+	for _, current := range compressionPreferred {
+		if current.algorithm == preferred && capabilityContains(capabilities, current.capability) {
+			selected = current.capability
+		}
+	}
+	if selected == "" {
+		for _, current := range compressionPreferred {
+			if capabilityContains(capabilities, current.capability) {
+				selected = current.capability
+				break
+			}
+		}
+	}
+
+	var agreed []string
+	for _, capability := range capabilities {
+		if capability != selected && compressionCapability(capability) {
+			continue
+		}
+		agreed = append(agreed, capability)
+	}
+	return agreed
+}
+
+// compressionCapability return true if capability is an compression-capability
+func compressionCapability(capability string) bool {
+	for _, current := range compressionPreferred {
+		if current.capability == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// compress data with algorithm
+func compress(algorithm string, data []byte) ([]byte, error) {
+
+	var buffer bytes.Buffer
+
+	switch algorithm {
+	case CompressionDeflate:
+		writer := deflateWriters.Get().(*flate.Writer)
+		defer deflateWriters.Put(writer)
+
+		writer.Reset(&buffer)
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+
+	case CompressionGzip:
+		writer := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(writer)
+
+		writer.Reset(&buffer)
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, &FrameError{Reason: "Unknown compression " + algorithm}
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// decompress data with algorithm, the result can not be bigger than maxSize
+func decompress(algorithm string, data []byte, maxSize int) ([]byte, error) {
+
+	var reader io.Reader
+
+	switch algorithm {
+	case CompressionDeflate:
+		deflateReader := flate.NewReader(bytes.NewReader(data))
+		defer deflateReader.Close()
+		reader = deflateReader
+
+	case CompressionGzip:
+		gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, &FrameError{Reason: err.Error()}
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+
+	default:
+		return nil, &FrameError{Reason: "Compressed frame, but no compression was agreed"}
+	}
+
+	// protect us against compression-bombs
+	decompressed, err := ioutil.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+	if err != nil {
+		return nil, &FrameError{Reason: err.Error()}
+	}
+	if len(decompressed) > maxSize {
+		return nil, &FrameSizeError{Size: len(decompressed), Max: maxSize}
+	}
+
+	return decompressed, nil
+}
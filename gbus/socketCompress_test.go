@@ -0,0 +1,140 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCompressionNegotiated(t *testing.T) {
+
+	server, client, serverErr, clientErr := pipeHandshake(SocketOptions{}, SocketOptions{})
+	if serverErr != nil || clientErr != nil {
+		t.Fatal(serverErr, clientErr)
+	}
+	if server.CompressionStats().Algorithm != CompressionDeflate || client.CompressionStats().Algorithm != CompressionDeflate {
+		t.Fatal("Expected deflate")
+	}
+
+	telemetry := strings.Repeat(`{"sensor":"temperature","value":21.5},`, 200)
+
+	go func() {
+		client.SendMessage(Msg{NodeSource: "testnode", Command: "telemetry", Payload: telemetry})
+		client.SendMessage(Msg{NodeSource: "testnode", Command: "small", Payload: "x"})
+	}()
+
+	message, err := server.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Payload != telemetry {
+		t.Fatal("Payload was modified")
+	}
+
+	message, err = server.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Payload != "x" {
+		t.Fatal("Payload was modified")
+	}
+
+	clientStats := client.CompressionStats()
+	if clientStats.CompressedOut != 1 {
+		t.Fatalf("Expected one compressed message, got %d", clientStats.CompressedOut)
+	}
+	if clientStats.RatioOut() > 0.5 {
+		t.Fatalf("Bad compression ratio %f", clientStats.RatioOut())
+	}
+	if server.CompressionStats().CompressedIn != 1 {
+		t.Fatal("Server should recieve one compressed message")
+	}
+
+	// no compression if one side disable it
+	server, _, serverErr, clientErr = pipeHandshake(SocketOptions{}, SocketOptions{DisableCompression: true})
+	if serverErr != nil || clientErr != nil {
+		t.Fatal(serverErr, clientErr)
+	}
+	if server.CompressionStats().Algorithm != "" {
+		t.Fatal("Expected no compression")
+	}
+}
+
+func TestCompressionPreferred(t *testing.T) {
+
+	server, client, serverErr, clientErr := pipeHandshake(SocketOptions{}, SocketOptions{Compression: CompressionGzip})
+	if serverErr != nil || clientErr != nil {
+		t.Fatal(serverErr, clientErr)
+	}
+	if server.CompressionStats().Algorithm != CompressionGzip || client.CompressionStats().Algorithm != CompressionGzip {
+		t.Fatal("Expected gzip")
+	}
+
+	telemetry := strings.Repeat(`{"sensor":"humidity","value":40},`, 200)
+	go client.SendMessage(Msg{NodeSource: "testnode", Command: "telemetry", Payload: telemetry})
+
+	message, err := server.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Payload != telemetry {
+		t.Fatal("Payload was modified")
+	}
+	if server.CompressionStats().CompressedIn != 1 {
+		t.Fatal("Server should recieve one compressed message")
+	}
+
+	// an unknown preference use the default order
+	server, _, serverErr, clientErr = pipeHandshake(SocketOptions{}, SocketOptions{Compression: "zstd"})
+	if serverErr != nil || clientErr != nil {
+		t.Fatal(serverErr, clientErr)
+	}
+	if server.CompressionStats().Algorithm != CompressionDeflate {
+		t.Fatal("Expected deflate")
+	}
+}
+
+func TestCompressionAlgorithms(t *testing.T) {
+
+	data := bytes.Repeat([]byte("gopilot"), 1000)
+
+	for _, algorithm := range []string{CompressionDeflate, CompressionGzip} {
+		compressed, err := compress(algorithm, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decompressed, err := decompress(algorithm, compressed, len(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decompressed, data) {
+			t.Fatalf("%s: data differ", algorithm)
+		}
+
+		// bigger than the max frame size
+		if _, err := decompress(algorithm, compressed, len(data)-1); err == nil {
+			t.Fatalf("%s: max size was not checked", algorithm)
+		} else if _, ok := err.(*FrameSizeError); !ok {
+			t.Fatalf("%s: expected FrameSizeError, got %v", algorithm, err)
+		}
+	}
+}
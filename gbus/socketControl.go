@@ -0,0 +1,164 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ControlCommandPrefix is reserved for the control-commands of the socket-protocol
+//
+// Messages with an command that start with it are handled by the socket itselfe and never reach OnMessage,
+// so an application must not use it for its own commands.
+// All other commands belong to the application, also "ERROR" or "PING".
+const ControlCommandPrefix = "_gbus."
+
+// Control-commands of the socket-protocol
+const (
+	cmdAccept = ControlCommandPrefix + "ACCEPT"
+	cmdError  = ControlCommandPrefix + "ERROR"
+	cmdPing   = ControlCommandPrefix + "PING"
+	cmdPong   = ControlCommandPrefix + "PONG"
+
+	cmdAck = ControlCommandPrefix + "ACK"
+
+	cmdSubscribe   = ControlCommandPrefix + "SUBSCRIBE"
+	cmdUnsubscribe = ControlCommandPrefix + "UNSUBSCRIBE"
+)
+
+// Commands of the handshake
+//
+// they are only expected while the handshake is running and keep there old names, so older nodes can talk to us.
+// After the handshake they are normal commands of the application
+const (
+	cmdHelo = "HELO"
+	cmdOleh = "OLEH"
+)
+
+// isControlCommand return true if command is handled by the socket itselfe
+func isControlCommand(command string) bool {
+	return strings.HasPrefix(command, ControlCommandPrefix)
+}
+
+// isControl return true if the message belongs to the protocol, while the handshake is running every message does
+func (socket *SocketConnection) isControl(message Msg) bool {
+	return isControlCommand(message.Command) || socket.handshakeRunning()
+}
+
+// Error-codes which are send inside an ERROR-message
+const (
+	ErrorCodeHandshake = "handshake"
+	ErrorCodeSubscribe = "subscribe"
+	ErrorCodePeer      = "peer"
+	ErrorCodeACL       = "acl"
+	ErrorCodeLimit     = "limit"
+	ErrorCodeAdmission = "admission"
+)
+
+// RemoteError is an error which the remote side send to us
+type RemoteError struct {
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+}
+
+func (err *RemoteError) Error() string {
+	return fmt.Sprintf("Remote error [%s]: %s", err.Code, err.Reason)
+}
+
+// sendError send an ERROR-message to the remote side
+func (socket *SocketConnection) sendError(code, reason string) {
+
+	payload, _ := json.Marshal(RemoteError{
+		Code:   code,
+		Reason: reason,
+	})
+
+	socket.SendMessage(Msg{
+		NodeSource: socket.localNodeName,
+		NodeTarget: socket.remoteNodeName,
+		Command:    cmdError,
+		Payload:    string(payload),
+	})
+}
+
+// remoteErrorParse return the error inside an ERROR-message
+func remoteErrorParse(message Msg) *RemoteError {
+	var remoteErr RemoteError
+	if err := json.Unmarshal([]byte(message.Payload), &remoteErr); err != nil {
+		remoteErr.Reason = message.Payload
+	}
+	return &remoteErr
+}
+
+// handleControl handle control-messages, return false if the message is not an control-message
+func (socket *SocketConnection) handleControl(message Msg, cb SocketCallbacks) bool {
+
+	switch message.Command {
+
+	case cmdError:
+		remoteErr := remoteErrorParse(message)
+		socket.log.WithFields(logrus.Fields{
+			"code": remoteErr.Code,
+		}).Error(remoteErr.Reason)
+
+		// we was replaced by an newer connection of our node
+		if remoteErr.Code == ErrorCodeAdmission {
+			socket.kickedErr = remoteErr
+		}
+
+		if cb.OnError != nil {
+			cb.OnError(socket, remoteErr)
+		}
+		return true
+
+	case cmdPing:
+		socket.SendMessage(Msg{
+			NodeSource: socket.localNodeName,
+			NodeTarget: socket.remoteNodeName,
+			Command:    cmdPong,
+			Payload:    message.Payload,
+		})
+		return true
+
+	case cmdPong:
+		socket.heartbeatHandlePong(message)
+		return true
+
+	case cmdAck:
+		socket.ackHandle(message)
+		return true
+
+	case cmdSubscribe, cmdUnsubscribe:
+		socket.subscriptionHandle(message, cb)
+		return true
+
+	}
+
+	// an control-command of an newer version, it never reach the application
+	if isControlCommand(message.Command) {
+		socket.log.WithField("command", message.Command).Debug("Unknown control-command")
+		return true
+	}
+
+	return false
+}
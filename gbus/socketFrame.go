@@ -0,0 +1,269 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The framing of messages on the wire
+//
+// The handshake ( HELO/OLEH ) is always send as newline-json, so older nodes can talk to us.
+// After the handshake both sides switch to the framing the client selected
+const (
+	FramingNewline = "newline" // one json-message per line
+	FramingLength  = "length"  // [4 byte length][1 byte type][body]
+)
+
+// DefaultMaxFrameSize is the max size of a single frame if nothing else is set
+const DefaultMaxFrameSize = 1024 * 1024
+
+const frameHeaderSize = 5
+
+// frame-types of the length-framing
+const (
+	frameTypeMsg           byte = 0
+	frameTypeMsgCompressed byte = 1 // compressed with the agreed compression
+	frameTypeBatch         byte = 2 // the body contains multiple frames of the other types
+)
+
+// CapBatch is the capability for batch-frames
+const CapBatch = "batch"
+
+// FrameSizeError is returned if a frame is bigger than the max frame size
+// the connection can not be used anymore after this
+type FrameSizeError struct {
+	Size int
+	Max  int
+}
+
+func (err *FrameSizeError) Error() string {
+	return fmt.Sprintf("Frame size %d exceed the max frame size of %d", err.Size, err.Max)
+}
+
+// FrameError is returned if a frame is malformed
+type FrameError struct {
+	Reason string
+}
+
+func (err *FrameError) Error() string {
+	return "Invalid frame: " + err.Reason
+}
+
+// frameReader read frames from a connection
+//
+// it live as long as the connection, so bytes of the next message which are already buffered are not lost
+type frameReader struct {
+	reader      *bufio.Reader
+	framing     string
+	compression string
+	maxSize     int
+	stats       *compressStats
+
+	// messages of an batch-frame which are not returned yet
+	pending [][]byte
+}
+
+func frameReaderNew(reader io.Reader, maxSize int, stats *compressStats) *frameReader {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxFrameSize
+	}
+
+	return &frameReader{
+		reader:  bufio.NewReaderSize(reader, recvBufferSize),
+		framing: FramingNewline,
+		maxSize: maxSize,
+		stats:   stats,
+	}
+}
+
+// readFrame [BLOCKING] return the body of the next frame
+func (fr *frameReader) readFrame() ([]byte, error) {
+	if len(fr.pending) > 0 {
+		body := fr.pending[0]
+		fr.pending = fr.pending[1:]
+		return body, nil
+	}
+
+	if fr.framing == FramingLength {
+		return fr.readLengthFrame()
+	}
+	return fr.readNewlineFrame()
+}
+
+func (fr *frameReader) readLengthFrame() ([]byte, error) {
+
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(fr.reader, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := int(binary.BigEndian.Uint32(header[:4]))
+	if size > fr.maxSize {
+		return nil, &FrameSizeError{Size: size, Max: fr.maxSize}
+	}
+	if header[4] != frameTypeMsg && header[4] != frameTypeMsgCompressed && header[4] != frameTypeBatch {
+		return nil, &FrameError{Reason: fmt.Sprintf("Unknown frame type %d", header[4])}
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(fr.reader, body); err != nil {
+		return nil, err
+	}
+
+	if header[4] == frameTypeBatch {
+		return fr.readBatch(body)
+	}
+
+	return fr.decodeBody(header[4], body)
+}
+
+// decodeBody return the message inside the body of an frame
+func (fr *frameReader) decodeBody(frameType byte, body []byte) ([]byte, error) {
+
+	if frameType == frameTypeMsg {
+		fr.stats.countIn(len(body), len(body), false)
+		return body, nil
+	}
+
+	decompressed, err := decompress(fr.compression, body, fr.maxSize)
+	if err != nil {
+		return nil, err
+	}
+	fr.stats.countIn(len(decompressed), len(body), true)
+
+	return decompressed, nil
+}
+
+// readBatch split an batch-frame, the first message is returned, the others are pending
+func (fr *frameReader) readBatch(batch []byte) ([]byte, error) {
+
+	var messages [][]byte
+	for len(batch) > 0 {
+		if len(batch) < frameHeaderSize {
+			return nil, &FrameError{Reason: "Truncated frame inside batch"}
+		}
+
+		size := int(binary.BigEndian.Uint32(batch[:4]))
+		frameType := batch[4]
+		if size > len(batch)-frameHeaderSize {
+			return nil, &FrameError{Reason: "Truncated frame inside batch"}
+		}
+		if frameType != frameTypeMsg && frameType != frameTypeMsgCompressed {
+			return nil, &FrameError{Reason: fmt.Sprintf("Frame type %d is not allowed inside batch", frameType)}
+		}
+
+		message, err := fr.decodeBody(frameType, batch[frameHeaderSize:frameHeaderSize+size])
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+		batch = batch[frameHeaderSize+size:]
+	}
+
+	if len(messages) == 0 {
+		return nil, &FrameError{Reason: "Empty batch"}
+	}
+
+	fr.pending = messages[1:]
+	return messages[0], nil
+}
+
+func (fr *frameReader) readNewlineFrame() ([]byte, error) {
+
+	var line []byte
+
+	for {
+		part, err := fr.reader.ReadSlice('\n')
+		line = append(line, part...)
+
+		// the newline is not part of the message
+		if len(line) > fr.maxSize+1 {
+			return nil, &FrameSizeError{Size: len(line), Max: fr.maxSize}
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// remove the newline
+		line = line[:len(line)-1]
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+
+		// ignore empty lines
+		if len(line) == 0 {
+			continue
+		}
+
+		fr.stats.countIn(len(line), len(line), false)
+		return line, nil
+	}
+}
+
+// frameEncode return the frame for data, so it can be written with a single write
+//
+// frameType is only used with length-framing
+func frameEncode(framing string, frameType byte, maxSize int, data []byte) ([]byte, error) {
+
+	if maxSize <= 0 {
+		maxSize = DefaultMaxFrameSize
+	}
+	if len(data) > maxSize {
+		return nil, &FrameSizeError{Size: len(data), Max: maxSize}
+	}
+
+	if framing == FramingLength {
+		frame := make([]byte, frameHeaderSize+len(data))
+		binary.BigEndian.PutUint32(frame[:4], uint32(len(data)))
+		frame[4] = frameType
+		copy(frame[frameHeaderSize:], data)
+		return frame, nil
+	}
+
+	frame := make([]byte, len(data)+1)
+	copy(frame, data)
+	frame[len(data)] = '\n'
+	return frame, nil
+}
+
+// batchEncode wrap complete length-frames into one batch-frame
+func batchEncode(frames [][]byte) []byte {
+
+	size := 0
+	for _, frame := range frames {
+		size = size + len(frame)
+	}
+
+	batch := make([]byte, frameHeaderSize, frameHeaderSize+size)
+	binary.BigEndian.PutUint32(batch[:4], uint32(size))
+	batch[4] = frameTypeBatch
+	for _, frame := range frames {
+		batch = append(batch, frame...)
+	}
+
+	return batch
+}
@@ -0,0 +1,193 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pipeSockets return two connected sockets which use framing
+func pipeSockets(framing string, options SocketOptions) (*SocketConnection, *SocketConnection) {
+
+	left, right := net.Pipe()
+
+	sender := SocketNew()
+	sender.OptionsSet(options)
+	sender.connSet(left)
+	sender.framingSet(framing)
+
+	reciever := SocketNew()
+	reciever.OptionsSet(options)
+	reciever.connSet(right)
+	reciever.framingSet(framing)
+
+	return sender, reciever
+}
+
+func encodeTestFrames(t *testing.T, framing string, count int) []byte {
+
+	var frames []byte
+	for i := 0; i < count; i++ {
+		message := Msg{NodeSource: "sender", Command: fmt.Sprintf("cmd%d", i), Payload: strings.Repeat("x", 3000)}
+		messageJSON, _ := message.ToJSONByteArray()
+		frame, err := frameEncode(framing, frameTypeMsg, 0, messageJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame...)
+	}
+
+	return frames
+}
+
+func TestFramePipelined(t *testing.T) {
+	for _, framing := range []string{FramingNewline, FramingLength} {
+		t.Run(framing, func(t *testing.T) {
+
+			sender, reciever := pipeSockets(framing, SocketOptions{})
+
+			// all messages in one write
+			frames := encodeTestFrames(t, framing, 3)
+			go sender.socket.Write(frames)
+
+			for i := 0; i < 3; i++ {
+				message, err := reciever.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if message.Command != fmt.Sprintf("cmd%d", i) {
+					t.Fatalf("Expected cmd%d got %s", i, message.Command)
+				}
+			}
+		})
+	}
+}
+
+func TestFrameFragmented(t *testing.T) {
+	for _, framing := range []string{FramingNewline, FramingLength} {
+		t.Run(framing, func(t *testing.T) {
+
+			sender, reciever := pipeSockets(framing, SocketOptions{})
+
+			// write the frames in small pieces
+			frames := encodeTestFrames(t, framing, 2)
+			go func() {
+				for len(frames) > 0 {
+					size := 7
+					if size > len(frames) {
+						size = len(frames)
+					}
+					sender.socket.Write(frames[:size])
+					frames = frames[size:]
+					time.Sleep(time.Microsecond)
+				}
+			}()
+
+			for i := 0; i < 2; i++ {
+				message, err := reciever.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if message.Command != fmt.Sprintf("cmd%d", i) || len(message.Payload) != 3000 {
+					t.Fatalf("Wrong message %d", i)
+				}
+			}
+		})
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	for _, framing := range []string{FramingNewline, FramingLength} {
+		t.Run(framing, func(t *testing.T) {
+
+			sender, reciever := pipeSockets(framing, SocketOptions{MaxFrameSize: 1000})
+
+			// the sender not send it
+			if _, err := frameEncode(framing, frameTypeMsg, 1000, make([]byte, 1001)); err == nil {
+				t.Fatal("Too large frame was encoded")
+			}
+
+			go sender.socket.Write(encodeTestFrames(t, framing, 1))
+
+			_, err := reciever.ReadMessage()
+			if sizeErr, ok := err.(*FrameSizeError); !ok || sizeErr.Max != 1000 {
+				t.Fatalf("Expected FrameSizeError, got %v", err)
+			}
+		})
+	}
+}
+
+func TestFramingNegotiation(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+
+	messages := make(chan Msg, 10)
+	sessions := make(chan *SocketConnection, 1)
+
+	server := SocketNew()
+	go server.Serve(filename, SocketCallbacks{
+		OnHandshakeFinished: func(socket *SocketConnection) {
+			sessions <- socket
+		},
+		OnMessage: func(socket *SocketConnection, message Msg) {
+			messages <- message
+		},
+	})
+	waitForSocket(filename)
+	defer server.Shutdown()
+
+	// the client send directly after the OLEH, so the messages are pipelined with it
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := SocketNew()
+	go client.Connect(ctx, filename, "testnode", "test", SocketCallbacks{
+		OnHandshakeFinished: func(socket *SocketConnection) {
+			for i := 0; i < 5; i++ {
+				socket.SendMessage(Msg{NodeSource: "testnode", Command: fmt.Sprintf("cmd%d", i)})
+			}
+		},
+	})
+
+	var session *SocketConnection
+	select {
+	case session = <-sessions:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No session")
+	}
+	if session.Framing() != FramingLength {
+		t.Fatalf("Expected length-framing, got %s", session.Framing())
+	}
+
+	for i := 0; i < 5; i++ {
+		select {
+		case message := <-messages:
+			if message.Command != fmt.Sprintf("cmd%d", i) {
+				t.Fatalf("Expected cmd%d got %s", i, message.Command)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Message %d was lost", i)
+		}
+	}
+}
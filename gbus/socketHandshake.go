@@ -0,0 +1,490 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"gitlab.com/gopilot/lib/mynodename"
+)
+
+// ProtocolVersion is the version of the socket-protocol we speak
+//
+// Nodes which send no version in the handshake are version 0
+const ProtocolVersion = 1
+
+// Capabilities which can be negotiated in the handshake
+const (
+	CapFramingLength = "framing.length" // length-prefixed framing
+	CapSign          = "sign"           // messages are signed
+	CapEncrypt       = "encrypt"        // payloads for an target-node are encrypted
+	CapAccept        = "accept"         // the server confirm the OLEH with an ACCEPT or ERROR
+)
+
+// DefaultHandshakeTimeout is the time the remote side have for the whole handshake
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// the capabilities every node of this version support
+var capabilitiesDefault = []string{
+	CapHeartbeat,
+	CapSubscribe,
+	CapAck,
+	CapResume,
+	CapAccept,
+}
+
+// HandshakeError is returned if the handshake with the remote side failed
+type HandshakeError struct {
+	Reason string
+}
+
+func (err *HandshakeError) Error() string {
+	return "Handshake failed: " + err.Reason
+}
+
+// handshakeInfo is send as payload of HELO and OLEH
+//
+// an older node send an empty payload, so every field must be optional
+type handshakeInfo struct {
+	Version      int      `json:"ver,omitempty"`
+	Capabilities []string `json:"caps,omitempty"`
+	MaxFrameSize int      `json:"mfs,omitempty"`
+
+	PublicKey string `json:"pk,omitempty"`
+	BoxKey    string `json:"bk,omitempty"`
+
+	// SessionToken is the token of the new session in the HELO,
+	// in the OLEH the token of the session the client want to resume
+	SessionToken string `json:"st,omitempty"`
+
+	// ListenNode is the node-name the client listen for, if it is not the NodeSource of the OLEH
+	ListenNode string `json:"ln,omitempty"`
+}
+
+// keyExchanger is implemented by signers which send there public key inside the handshake
+type keyExchanger interface {
+	// handshakeKey return our public key
+	handshakeKey() string
+
+	// handshakePeer check ( or pin ) the public key of the remote node
+	handshakePeer(nodeName, publicKey string) error
+
+	// handshakeNode return the node-name of our identity, only this name can be signed
+	handshakeNode() string
+}
+
+// identityNodeName return the node-name of the signing identity or fallback if we don't sign
+func (socket *SocketConnection) identityNodeName(fallback string) string {
+	if exchanger, ok := socket.options.Signer.(keyExchanger); ok {
+		return exchanger.handshakeNode()
+	}
+	return fallback
+}
+
+// handshakeTimeout return the timeout for the handshake, 0 means no timeout
+func (socket *SocketConnection) handshakeTimeout() time.Duration {
+	if socket.options.HandshakeTimeout < 0 {
+		return 0
+	}
+	if socket.options.HandshakeTimeout == 0 {
+		return DefaultHandshakeTimeout
+	}
+	return socket.options.HandshakeTimeout
+}
+
+// handshakeDeadlineSet mark the handshake as running and limit it to the handshake-timeout
+//
+// the returned function remove the deadline again
+func (socket *SocketConnection) handshakeDeadlineSet() func() {
+
+	atomic.StoreInt32(&socket.handshaking, 1)
+
+	timeout := socket.handshakeTimeout()
+	if timeout <= 0 {
+		return func() {
+			atomic.StoreInt32(&socket.handshaking, 0)
+		}
+	}
+
+	socket.socket.SetReadDeadline(time.Now().Add(timeout))
+
+	return func() {
+		atomic.StoreInt32(&socket.handshaking, 0)
+		socket.socket.SetReadDeadline(time.Time{})
+	}
+}
+
+// handshakeRunning return true while the handshake is running
+func (socket *SocketConnection) handshakeRunning() bool {
+	return atomic.LoadInt32(&socket.handshaking) == 1
+}
+
+// handshakeErrorTimeout replace an timeout of the connection with an HandshakeError
+func handshakeErrorTimeout(err error) error {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return &HandshakeError{Reason: "Timeout"}
+	}
+	return err
+}
+
+// ProtocolVersion return the protocol-version which both sides speak
+func (socket *SocketConnection) ProtocolVersion() int {
+	return socket.protocolVersion
+}
+
+// Capabilities return the capabilities both sides agreed on in the handshake
+func (socket *SocketConnection) Capabilities() []string {
+	return socket.capabilities
+}
+
+// HasCapability return true if both sides agreed on capability
+func (socket *SocketConnection) HasCapability(capability string) bool {
+	return capabilityContains(socket.capabilities, capability)
+}
+
+// MaxFrameSize return the max frame size both sides agreed on
+func (socket *SocketConnection) MaxFrameSize() int {
+	return socket.reader.maxSize
+}
+
+// capabilitiesLocal return the capabilities we support
+func (socket *SocketConnection) capabilitiesLocal() []string {
+
+	capabilities := append([]string{}, capabilitiesDefault...)
+
+	if !socket.options.NewlineFraming {
+		capabilities = append(capabilities, CapFramingLength, CapBatch)
+
+		// compression need the length-framing
+		if !socket.options.DisableCompression {
+			capabilities = append(capabilities, CapCompressDeflate, CapCompressGzip)
+		}
+	}
+	if socket.options.Signer != nil {
+		capabilities = append(capabilities, CapSign)
+	}
+	if socket.options.Crypter != nil {
+		capabilities = append(capabilities, CapEncrypt)
+	}
+
+	sort.Strings(capabilities)
+	return capabilities
+}
+
+func capabilityContains(capabilities []string, capability string) bool {
+	for _, current := range capabilities {
+		if current == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// capabilitiesIntersect return all capabilities which are in both lists
+func capabilitiesIntersect(local, remote []string) []string {
+	var intersection []string
+	for _, capability := range local {
+		if capabilityContains(remote, capability) {
+			intersection = append(intersection, capability)
+		}
+	}
+	return intersection
+}
+
+// handshakeInfoLocal return the info we send to the remote side
+func (socket *SocketConnection) handshakeInfoLocal(capabilities []string) string {
+
+	info := handshakeInfo{
+		Version:      ProtocolVersion,
+		Capabilities: capabilities,
+		MaxFrameSize: socket.reader.maxSize,
+		SessionToken: socket.sessionToken,
+	}
+
+	// we listen for an other node than we are
+	if socket.listenNodeName != socket.localNodeName {
+		info.ListenNode = socket.listenNodeName
+	}
+
+	if exchanger, ok := socket.options.Signer.(keyExchanger); ok {
+		info.PublicKey = exchanger.handshakeKey()
+	}
+	if socket.options.Crypter != nil {
+		info.BoxKey = socket.options.Crypter.identity.BoxPublicKeyString()
+	}
+
+	b, _ := json.Marshal(info)
+	return string(b)
+}
+
+// handshakePeer handle the HELO/OLEH of the remote side
+//
+// the public key of the remote node must be known before we can check the signature of the message
+func (socket *SocketConnection) handshakePeer(message *Msg) (handshakeInfo, error) {
+
+	var info handshakeInfo
+	if message.Payload != "" {
+		if err := json.Unmarshal([]byte(message.Payload), &info); err != nil {
+			return info, err
+		}
+	}
+
+	if exchanger, ok := socket.options.Signer.(keyExchanger); ok && info.PublicKey != "" {
+		if err := exchanger.handshakePeer(message.NodeSource, info.PublicKey); err != nil {
+			return info, err
+		}
+	}
+
+	if err := verifyMsg(socket.options.Signer, socket.options.RequireSigned, message); err != nil {
+		return info, err
+	}
+
+	// the box-key is inside the signed payload, so we can pin it now
+	// without an signer nobody verified the signature, so we can not trust the box-key
+	if socket.options.Crypter != nil && info.BoxKey != "" {
+		if socket.options.Signer == nil {
+			return info, ErrMsgSignatureInvalid
+		}
+		if !message.verified {
+			return info, ErrMsgUnsigned
+		}
+		if err := socket.options.Crypter.trust.CheckBoxKey(message.NodeSource, info.BoxKey); err != nil {
+			return info, err
+		}
+	}
+
+	return info, nil
+}
+
+// handshakeApply check if we are compatible with the remote side and use the agreed settings
+func (socket *SocketConnection) handshakeApply(info handshakeInfo, capabilities []string) error {
+
+	socket.protocolVersion = info.Version
+	if socket.protocolVersion > ProtocolVersion {
+		socket.protocolVersion = ProtocolVersion
+	}
+	socket.capabilities = capabilities
+
+	// the smallest max frame size wins
+	if info.MaxFrameSize > 0 && info.MaxFrameSize < socket.reader.maxSize {
+		socket.reader.maxSize = info.MaxFrameSize
+	}
+
+	// the remote side use the agreed framing, also if we reject it
+	// so it can read our ERROR
+	if socket.HasCapability(CapFramingLength) {
+		socket.framingSet(FramingLength)
+		socket.compressionSet(compressionSelect(capabilities))
+
+		// the remote side can read batches, so we can send them
+		if socket.HasCapability(CapBatch) {
+			socket.writerGet().batchFramesEnable(socket.reader.maxSize)
+		}
+	}
+
+	if info.Version < socket.options.MinProtocolVersion {
+		return &HandshakeError{
+			Reason: fmt.Sprintf("Remote protocol version %d is older than the minimum version %d", info.Version, socket.options.MinProtocolVersion),
+		}
+	}
+
+	if socket.options.RequireSigned && !socket.HasCapability(CapSign) {
+		return &HandshakeError{Reason: "Remote side does not support signed messages"}
+	}
+	for _, required := range socket.options.RequiredCapabilities {
+		if !socket.HasCapability(required) {
+			return &HandshakeError{Reason: fmt.Sprintf("Remote side does not support '%s'", required)}
+		}
+	}
+
+	return nil
+}
+
+// handshakeServer send the HELO and wait for the OLEH of the client
+func (socket *SocketConnection) handshakeServer() error {
+
+	socket.localNodeName = socket.identityNodeName(mynodename.NodeName)
+	socket.listenNodeName = socket.localNodeName
+
+	defer socket.handshakeDeadlineSet()()
+
+	// is the local process allowed to talk to us ?
+	if err := socket.peerCheck(); err != nil {
+		socket.sendError(ErrorCodePeer, err.Error())
+		return err
+	}
+
+	// the client can resume this session later with this token
+	if socket.serverOptions().SessionResume > 0 {
+		socket.sessionToken = nonceNew()
+	}
+
+	// send a helo to the client with everything we support
+	err := socket.sendNow(Msg{
+		NodeSource:  socket.localNodeName, // i'am the source
+		GroupSource: "",                   // i hear on every group
+		NodeTarget:  "",                   // i don't know you, so is just send it to all
+		GroupTarget: "",                   // i don't know your group ( yet )
+		Command:     cmdHelo,
+		Payload:     socket.handshakeInfoLocal(socket.capabilitiesLocal()),
+	}, false)
+	if err != nil {
+		return err
+	}
+
+	// we wait for OLEH
+	socket.log.Debug("Wait for OLEH-Message")
+	olehMessage, err := socket.readMessage(false)
+	if err != nil {
+		return handshakeErrorTimeout(err)
+	}
+	if olehMessage.Command != cmdOleh {
+		return errors.New("No OLEH was recieved")
+	}
+
+	info, err := socket.handshakePeer(&olehMessage)
+
+	// the client answer with the agreed capabilities, we only accept what we offered
+	capabilities := capabilitiesIntersect(socket.capabilitiesLocal(), info.Capabilities)
+	if err != nil {
+		// the client already use the agreed framing, so it can read our ERROR
+		socket.handshakeApply(info, capabilities)
+		socket.sendError(ErrorCodeHandshake, err.Error())
+		return err
+	}
+
+	socket.remoteNodeName = olehMessage.NodeSource
+	socket.remoteNodeGroup = olehMessage.GroupSource
+	socket.remoteListenNode = info.ListenNode
+	socket.remoteSubscriptionsReset()
+
+	err = socket.handshakeApply(info, capabilities)
+	if err != nil {
+		socket.sendError(ErrorCodeHandshake, err.Error())
+		return err
+	}
+
+	// the client want to resume an older session
+	if socket.HasCapability(CapResume) {
+		socket.resumeToken = info.SessionToken
+	}
+
+	return nil
+}
+
+// handshakeClient wait for the HELO of the server and answer with an OLEH
+func (socket *SocketConnection) handshakeClient(listenForNodeName, listenForGroupName string) error {
+
+	// control-messages come from our identity, the listen-filter is send inside the OLEH
+	socket.localNodeName = socket.identityNodeName(listenForNodeName)
+	socket.listenNodeName = listenForNodeName
+
+	defer socket.handshakeDeadlineSet()()
+
+	// we wait for HELO
+	socket.log.Debug("Wait for HELO-Message")
+	heloMessage, err := socket.readMessage(false)
+	if err != nil {
+		return handshakeErrorTimeout(err)
+	}
+	if heloMessage.Command == cmdError {
+		return remoteErrorParse(heloMessage)
+	}
+	if heloMessage.Command != cmdHelo {
+		return errors.New("No HELO was recieved")
+	}
+
+	info, err := socket.handshakePeer(&heloMessage)
+	if err != nil {
+		return err
+	}
+
+	socket.remoteNodeName = heloMessage.NodeSource
+	socket.remoteNodeGroup = heloMessage.GroupSource
+	socket.remoteSubscriptionsReset()
+
+	// an older server offer nothing, so we agree on nothing
+	capabilities := capabilitiesIntersect(socket.capabilitiesLocal(), info.Capabilities)
+
+	// we choose the compression, the server use what we agree
+	capabilities = compressionAgree(capabilities, socket.options.Compression)
+
+	// and informate the server about what we listen, it belongs to this connection so it is never queued
+	err = socket.sendNow(Msg{
+		NodeSource:  socket.localNodeName,
+		GroupSource: listenForGroupName,
+		NodeTarget:  heloMessage.NodeTarget,
+		GroupTarget: "",
+		Command:     cmdOleh,
+		Payload:     socket.handshakeInfoLocal(capabilities),
+	}, false)
+	if err != nil {
+		return err
+	}
+
+	// we remember the token of this session, for the next reconnect
+	socket.sessionToken = ""
+	if capabilityContains(capabilities, CapResume) {
+		socket.sessionToken = info.SessionToken
+	}
+
+	// after the OLEH the server expect the agreed framing
+	if err := socket.handshakeApply(info, capabilities); err != nil {
+		return err
+	}
+
+	// the server can still reject us, so we are only connected after its ACCEPT
+	if !socket.HasCapability(CapAccept) {
+		return nil
+	}
+	socket.log.Debug("Wait for ACCEPT-Message")
+	acceptMessage, err := socket.readMessage(false)
+	if err != nil {
+		return handshakeErrorTimeout(err)
+	}
+	if acceptMessage.Command == cmdError {
+		return remoteErrorParse(acceptMessage)
+	}
+	if acceptMessage.Command != cmdAccept {
+		return errors.New("No ACCEPT was recieved")
+	}
+	return nil
+}
+
+// handshakeAccept confirm the handshake, after the server admitted the session
+//
+// the server must hold its forwardLock, so no other message is send before
+func (socket *SocketConnection) handshakeAccept() error {
+
+	if !socket.HasCapability(CapAccept) {
+		return nil
+	}
+
+	return socket.sendNow(Msg{
+		NodeSource: socket.localNodeName,
+		NodeTarget: socket.remoteNodeName,
+		Command:    cmdAccept,
+	}, false)
+}
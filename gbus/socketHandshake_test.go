@@ -0,0 +1,308 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// connPair return two connected tcp-connections
+//
+// other than net.Pipe() they are buffered, so both sides can write at the same time
+func connPair() (net.Conn, net.Conn) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer listener.Close()
+
+	right, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+	left, err := listener.Accept()
+	if err != nil {
+		panic(err)
+	}
+
+	return left, right
+}
+
+// pipeHandshake run the handshake between a server and a client over an local connection
+func pipeHandshake(serverOptions, clientOptions SocketOptions) (server, client *SocketConnection, serverErr, clientErr error) {
+
+	left, right := connPair()
+
+	server = SocketNew()
+	server.OptionsSet(serverOptions)
+	server.connSet(left)
+
+	client = SocketNew()
+	client.OptionsSet(clientOptions)
+	client.connSet(right)
+
+	// the server admit every client
+	serverDone := make(chan error, 1)
+	go func() {
+		err := server.handshakeServer()
+		if err == nil {
+			err = server.handshakeAccept()
+		}
+		serverDone <- err
+	}()
+
+	clientErr = client.handshakeClient("testnode", "test")
+	if clientErr != nil {
+		// the server is maybe blocked while sending the error
+		client.socket.Close()
+	}
+
+	return server, client, <-serverDone, clientErr
+}
+
+func TestHandshakeCapabilities(t *testing.T) {
+
+	server, client, serverErr, clientErr := pipeHandshake(
+		SocketOptions{MaxFrameSize: 1000},
+		SocketOptions{MaxFrameSize: 2000},
+	)
+	if serverErr != nil || clientErr != nil {
+		t.Fatal(serverErr, clientErr)
+	}
+
+	for _, socket := range []*SocketConnection{server, client} {
+		if socket.ProtocolVersion() != ProtocolVersion {
+			t.Fatalf("Wrong protocol version %d", socket.ProtocolVersion())
+		}
+		if !socket.HasCapability(CapFramingLength) || socket.HasCapability(CapSign) {
+			t.Fatalf("Wrong capabilities %v", socket.Capabilities())
+		}
+		if socket.Framing() != FramingLength {
+			t.Fatalf("Wrong framing %s", socket.Framing())
+		}
+		if socket.MaxFrameSize() != 1000 {
+			t.Fatalf("Wrong max frame size %d", socket.MaxFrameSize())
+		}
+	}
+
+	// an client which only speak newline
+	server, client, serverErr, clientErr = pipeHandshake(
+		SocketOptions{},
+		SocketOptions{NewlineFraming: true},
+	)
+	if serverErr != nil || clientErr != nil {
+		t.Fatal(serverErr, clientErr)
+	}
+	if server.Framing() != FramingNewline || client.Framing() != FramingNewline {
+		t.Fatal("Expected newline-framing")
+	}
+	if server.HasCapability(CapFramingLength) || server.HasCapability(CapCompressDeflate) {
+		t.Fatalf("Unexpected capabilities %v", server.Capabilities())
+	}
+}
+
+func TestHandshakeIncompatible(t *testing.T) {
+
+	left, right := net.Pipe()
+
+	server := SocketNew()
+	server.OptionsSet(SocketOptions{MinProtocolVersion: ProtocolVersion + 1})
+	server.connSet(left)
+
+	client := SocketNew()
+	client.connSet(right)
+
+	serverDone := make(chan error, 1)
+	go func() {
+		serverDone <- server.handshakeServer()
+	}()
+
+	// the client is fine with the server, but the server reject it inside the handshake and tell it why
+	err := client.handshakeClient("testnode", "test")
+	if handshakeErr, ok := err.(*RemoteError); !ok || handshakeErr.Code != ErrorCodeHandshake {
+		t.Fatalf("Expected handshake-error, got %v", err)
+	}
+
+	if _, ok := (<-serverDone).(*HandshakeError); !ok {
+		t.Fatal("Server should reject the client")
+	}
+
+	// a client which require signed messages
+	_, _, _, clientErr := pipeHandshake(
+		SocketOptions{},
+		SocketOptions{RequiredCapabilities: []string{CapSign}},
+	)
+	if _, ok := clientErr.(*HandshakeError); !ok {
+		t.Fatalf("Expected handshake-error, got %v", clientErr)
+	}
+}
+
+func TestHandshakeRejectedConnectError(t *testing.T) {
+
+	// every rejection of the server is an failed attempt of the client
+	for _, serverOptions := range []SocketOptions{
+		{MinProtocolVersion: ProtocolVersion + 1},
+		{RequiredCapabilities: []string{"unknown"}},
+		{RequireSigned: true},
+	} {
+		filename := filepath.Join(t.TempDir(), "x.sock")
+		server := SocketNew()
+		server.OptionsSet(serverOptions)
+		go server.Serve(filename, SocketCallbacks{})
+		waitForSocket(filename)
+
+		client := SocketNew()
+		client.OptionsSet(SocketOptions{
+			Reconnect: ReconnectPolicy{
+				InitialBackoff: 10 * time.Millisecond,
+				MaxBackoff:     10 * time.Millisecond,
+				Multiplier:     1.0,
+				MaxAttempts:    3,
+			},
+		})
+
+		result := make(chan error, 1)
+		go func() {
+			result <- client.Connect(context.Background(), filename, "testnode", "test", SocketCallbacks{
+				OnConnect: func(socket *SocketConnection) {
+					t.Error("Client was connected")
+				},
+			})
+		}()
+
+		select {
+		case err := <-result:
+			connectErr, ok := err.(*ConnectError)
+			if !ok {
+				t.Fatalf("Expected ConnectError, got %v", err)
+			}
+			if connectErr.Attempts != 3 {
+				t.Errorf("Expected 3 attempts, got %d", connectErr.Attempts)
+			}
+			if remoteErr, ok := connectErr.LastErr.(*RemoteError); !ok || remoteErr.Code != ErrorCodeHandshake {
+				t.Errorf("Expected handshake-error, got %v", connectErr.LastErr)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Client with %+v did not give up", serverOptions)
+		}
+
+		server.Shutdown()
+	}
+}
+
+func TestServeHandshakeTimeout(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+
+	failed := make(chan error, 10)
+	connected := make(chan struct{}, 1)
+	var disconnected int32
+
+	server := SocketNew()
+	server.OptionsSet(SocketOptions{HandshakeTimeout: 500 * time.Millisecond})
+	go server.Serve(filename, SocketCallbacks{
+		OnConnect: func(socket *SocketConnection) {
+			connected <- struct{}{}
+		},
+		OnDisconnect: func(socket *SocketConnection) {
+			atomic.AddInt32(&disconnected, 1)
+		},
+		OnConnectFailed: func(socket *SocketConnection, attempt int, err error) {
+			failed <- err
+		},
+	})
+	waitForSocket(filename)
+	defer server.Shutdown()
+
+	// a client which never answer
+	silent, err := net.Dial("unix", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	// must not block the next client
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := SocketNew()
+	go client.Connect(ctx, filename, "testnode", "test", SocketCallbacks{})
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client was blocked by the silent client")
+	}
+
+	// the probe of waitForSocket also failed, so we look for the timeout
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case err := <-failed:
+			if _, ok := err.(*HandshakeError); ok {
+				// the handshake failed, so there was no connection to disconnect
+				if atomic.LoadInt32(&disconnected) != 0 {
+					t.Fatal("OnDisconnect fired for a failed handshake")
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatal("Silent client was not timed out")
+		}
+	}
+}
+
+func TestServeMaxPendingHandshakes(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+
+	server := SocketNew()
+	server.OptionsSet(SocketOptions{MaxPendingHandshakes: 1})
+	go server.Serve(filename, SocketCallbacks{})
+	waitForSocket(filename)
+	defer server.Shutdown()
+
+	// waitForSocket already used the only slot for a moment, so we wait until it is free again
+	time.Sleep(100 * time.Millisecond)
+
+	first, err := net.Dial("unix", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if _, err := first.Read(make([]byte, 1)); err != nil {
+		t.Fatal("First client should get the HELO")
+	}
+
+	// the second connection is closed immediately
+	second, err := net.Dial("unix", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Second client should be rejected")
+	}
+}
@@ -0,0 +1,119 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// CapHeartbeat is the capability for PING/PONG
+const CapHeartbeat = "heartbeat"
+
+// RTT return the last measured round-trip-time of an PING/PONG, 0 if not measured yet
+func (socket *SocketConnection) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&socket.rtt))
+}
+
+// readTimeout return how long a read can block before we think the remote side is dead
+func (socket *SocketConnection) readTimeout() time.Duration {
+	if socket.options.ReadTimeout > 0 {
+		return socket.options.ReadTimeout
+	}
+
+	// we should get at least one PING or PONG in this time
+	if socket.options.HeartbeatInterval > 0 && socket.HasCapability(CapHeartbeat) {
+		return 3 * socket.options.HeartbeatInterval
+	}
+
+	return 0
+}
+
+// activityTouch remember that an message was send or recieved
+func (socket *SocketConnection) activityTouch() {
+	atomic.StoreInt64(&socket.lastActivity, time.Now().UnixNano())
+}
+
+// heartbeatSendPing send an PING with the current time, the remote side answer with the same payload
+func (socket *SocketConnection) heartbeatSendPing() {
+	socket.SendMessage(Msg{
+		NodeSource: socket.localNodeName,
+		NodeTarget: socket.remoteNodeName,
+		Command:    cmdPing,
+		Payload:    strconv.FormatInt(time.Now().UnixNano(), 10),
+	})
+}
+
+// heartbeatHandlePong calculate the round-trip-time
+func (socket *SocketConnection) heartbeatHandlePong(message Msg) {
+	sendTime, err := strconv.ParseInt(message.Payload, 10, 64)
+	if err != nil {
+		return
+	}
+
+	rtt := time.Now().UnixNano() - sendTime
+	atomic.StoreInt64(&socket.rtt, rtt)
+	socket.log.WithField("rtt", time.Duration(rtt)).Debug("PONG")
+}
+
+// heartbeatLoop send PINGs and close an idle connection until done is closed
+func (socket *SocketConnection) heartbeatLoop(done chan struct{}) {
+
+	pingInterval := socket.options.HeartbeatInterval
+	sendPings := pingInterval > 0 && socket.HasCapability(CapHeartbeat)
+	idleTimeout := socket.options.IdleTimeout
+
+	// we tick fast enough for the PINGs and the idle-timeout
+	var interval time.Duration
+	if sendPings {
+		interval = pingInterval
+	}
+	if idleTimeout > 0 && (interval <= 0 || idleTimeout/2 < interval) {
+		interval = idleTimeout / 2
+	}
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastPing := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+
+		case now := <-ticker.C:
+			idle := time.Duration(now.UnixNano() - atomic.LoadInt64(&socket.lastActivity))
+			if idleTimeout > 0 && idle > idleTimeout {
+				socket.log.WithField("idle", idle).Info("Connection is idle")
+				socket.close()
+				return
+			}
+
+			// the ticker can be faster than the heartbeat
+			if sendPings && now.Sub(lastPing) >= pingInterval-interval/2 {
+				lastPing = now
+				socket.heartbeatSendPing()
+			}
+		}
+	}
+}
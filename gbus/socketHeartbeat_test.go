@@ -0,0 +1,130 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeartbeatRTT(t *testing.T) {
+
+	options := SocketOptions{HeartbeatInterval: 20 * time.Millisecond}
+
+	server, client, serverErr, clientErr := pipeHandshake(options, options)
+	if serverErr != nil || clientErr != nil {
+		t.Fatal(serverErr, clientErr)
+	}
+	if !server.HasCapability(CapHeartbeat) {
+		t.Fatal("Heartbeat not agreed")
+	}
+
+	go server.eventLoopWaitForMessage(SocketCallbacks{})
+	go client.eventLoopWaitForMessage(SocketCallbacks{})
+	defer client.close()
+
+	for i := 0; i < 100; i++ {
+		if server.RTT() > 0 && client.RTT() > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("No RTT was measured")
+}
+
+func TestHeartbeatDeadPeer(t *testing.T) {
+
+	server, _, serverErr, clientErr := pipeHandshake(
+		SocketOptions{HeartbeatInterval: 20 * time.Millisecond},
+		SocketOptions{},
+	)
+	if serverErr != nil || clientErr != nil {
+		t.Fatal(serverErr, clientErr)
+	}
+
+	// the client never read or answer
+	disconnected := make(chan struct{})
+	go server.eventLoopWaitForMessage(SocketCallbacks{
+		OnDisconnect: func(socket *SocketConnection) {
+			close(disconnected)
+		},
+	})
+
+	select {
+	case <-disconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Dead peer was not detected")
+	}
+}
+
+func TestHeartbeatIdle(t *testing.T) {
+
+	options := SocketOptions{
+		HeartbeatInterval: 10 * time.Millisecond,
+		IdleTimeout:       100 * time.Millisecond,
+	}
+
+	server, client, serverErr, clientErr := pipeHandshake(options, options)
+	if serverErr != nil || clientErr != nil {
+		t.Fatal(serverErr, clientErr)
+	}
+
+	// PINGs are no activity
+	disconnected := make(chan struct{})
+	go server.eventLoopWaitForMessage(SocketCallbacks{
+		OnDisconnect: func(socket *SocketConnection) {
+			close(disconnected)
+		},
+	})
+	go client.eventLoopWaitForMessage(SocketCallbacks{})
+
+	select {
+	case <-disconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Idle connection was not closed")
+	}
+}
+
+func TestHeartbeatIdleShorterThanInterval(t *testing.T) {
+
+	// the idle-timeout is checked faster than the heartbeat
+	options := SocketOptions{
+		HeartbeatInterval: time.Minute,
+		IdleTimeout:       100 * time.Millisecond,
+	}
+
+	server, client, serverErr, clientErr := pipeHandshake(options, options)
+	if serverErr != nil || clientErr != nil {
+		t.Fatal(serverErr, clientErr)
+	}
+
+	disconnected := make(chan struct{})
+	go server.eventLoopWaitForMessage(SocketCallbacks{
+		OnDisconnect: func(socket *SocketConnection) {
+			close(disconnected)
+		},
+	})
+	go client.eventLoopWaitForMessage(SocketCallbacks{})
+
+	select {
+	case <-disconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Idle connection was not closed in time")
+	}
+}
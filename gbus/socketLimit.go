@@ -0,0 +1,557 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// What happen if an limit is exceeded
+const (
+	LimitDrop       = "drop"       // the message is rejected ( default )
+	LimitDelay      = "delay"      // we stop reading from the connection until there are tokens again
+	LimitDisconnect = "disconnect" // the connection is closed
+)
+
+// Scopes of an limit
+const (
+	LimitScopeConnection = "connection"
+	LimitScopeNode       = "node"
+	LimitScopeGroup      = "group"
+)
+
+// LimitNoticeInterval is the min time between two limit-ERRORs to the remote side
+const LimitNoticeInterval = time.Second
+
+// Kinds of an limit
+const (
+	LimitMessages      = "messages"
+	LimitBytes         = "bytes"
+	LimitSubscriptions = "subscriptions"
+)
+
+// RateLimit is an token-bucket for messages and bytes, 0 means unlimited
+type RateLimit struct {
+	MessagesPerSecond float64 `json:"messagesPerSecond,omitempty"`
+	MessageBurst      int     `json:"messageBurst,omitempty"` // 0 means one second of MessagesPerSecond
+	BytesPerSecond    float64 `json:"bytesPerSecond,omitempty"`
+	ByteBurst         int     `json:"byteBurst,omitempty"` // 0 means one second of BytesPerSecond
+	MaxSubscriptions  int     `json:"maxSubscriptions,omitempty"`
+	Action            string  `json:"action,omitempty"` // LimitDrop, LimitDelay or LimitDisconnect
+}
+
+// RateLimitConfig hold the limits of an server, this is how it is stored in the config
+type RateLimitConfig struct {
+	Connection RateLimit            `json:"connection,omitempty"` // for every session
+	Node       RateLimit            `json:"node,omitempty"`       // for all sessions of an remote node
+	Group      RateLimit            `json:"group,omitempty"`      // for all sessions of an remote group
+	Nodes      map[string]RateLimit `json:"nodes,omitempty"`      // replace Node for single nodes
+	Groups     map[string]RateLimit `json:"groups,omitempty"`     // replace Group for single groups
+}
+
+// LimitViolation describe an exceeded limit
+type LimitViolation struct {
+	Scope  string // LimitScopeConnection, LimitScopeNode or LimitScopeGroup
+	Key    string // the node- or group-name, the session-id for connections
+	Kind   string // LimitMessages, LimitBytes or LimitSubscriptions
+	Action string
+}
+
+// LimitError is returned if an limit is exceeded
+type LimitError struct {
+	Violation LimitViolation
+}
+
+func (err *LimitError) Error() string {
+	return fmt.Sprintf("Limit of %s exceeded for %s '%s'", err.Violation.Kind, err.Violation.Scope, err.Violation.Key)
+}
+
+// ################################# token-bucket #################################
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// tokenBucketNew return nil if rate is 0
+func tokenBucketNew(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	newBucket := tokenBucket{
+		rate:  rate,
+		burst: float64(burst),
+	}
+	if newBucket.burst <= 0 {
+		newBucket.burst = rate
+	}
+	if newBucket.burst < 1 {
+		newBucket.burst = 1
+	}
+	newBucket.tokens = newBucket.burst
+	return &newBucket
+}
+
+// refill add the tokens since the last call
+func (bucket *tokenBucket) refill(now time.Time) {
+	if !bucket.last.IsZero() {
+		bucket.tokens = bucket.tokens + now.Sub(bucket.last).Seconds()*bucket.rate
+		if bucket.tokens > bucket.burst {
+			bucket.tokens = bucket.burst
+		}
+	}
+	bucket.last = now
+}
+
+// allowed return true if n tokens can be taken without debt
+//
+// an full bucket always allow one take, so a single message bigger than burst can pass
+func (bucket *tokenBucket) allowed(now time.Time, n float64) bool {
+	bucket.refill(now)
+	return bucket.tokens >= n || bucket.tokens >= bucket.burst
+}
+
+// take n tokens, with debt the tokens are taken anyway and we return how long to wait
+func (bucket *tokenBucket) take(now time.Time, n float64, debt bool) (time.Duration, bool) {
+
+	if bucket.allowed(now, n) {
+		bucket.tokens = bucket.tokens - n
+		return 0, true
+	}
+
+	if !debt {
+		return 0, false
+	}
+
+	bucket.tokens = bucket.tokens - n
+	return time.Duration(-bucket.tokens / bucket.rate * float64(time.Second)), true
+}
+
+// limitBuckets are the buckets of one scope
+type limitBuckets struct {
+	limit    RateLimit
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+func limitBucketsNew(limit RateLimit) *limitBuckets {
+	return &limitBuckets{
+		limit:    limit,
+		messages: tokenBucketNew(limit.MessagesPerSecond, limit.MessageBurst),
+		bytes:    tokenBucketNew(limit.BytesPerSecond, limit.ByteBurst),
+	}
+}
+
+// check return the kind which would be exceeded, nothing is taken
+//
+// with LimitDelay we never refuse, we wait
+func (buckets *limitBuckets) check(now time.Time, size int) (string, bool) {
+
+	if buckets.limit.Action == LimitDelay {
+		return "", true
+	}
+	if buckets.messages != nil && !buckets.messages.allowed(now, 1) {
+		return LimitMessages, false
+	}
+	if buckets.bytes != nil && !buckets.bytes.allowed(now, float64(size)) {
+		return LimitBytes, false
+	}
+	return "", true
+}
+
+// take the tokens, check() must be called before
+//
+// with LimitDelay the kind and how long to wait is returned
+func (buckets *limitBuckets) take(now time.Time, size int) (string, time.Duration) {
+
+	debt := buckets.limit.Action == LimitDelay
+	kind := ""
+	var wait time.Duration
+
+	if buckets.messages != nil {
+		if messageWait, _ := buckets.messages.take(now, 1, debt); messageWait > 0 {
+			kind, wait = LimitMessages, messageWait
+		}
+	}
+
+	if buckets.bytes != nil {
+		if byteWait, _ := buckets.bytes.take(now, float64(size), debt); byteWait > wait {
+			kind, wait = LimitBytes, byteWait
+		}
+	}
+
+	return kind, wait
+}
+
+// ################################# limiter #################################
+
+// RateLimiter enforce the limits of an RateLimitConfig, it is shared by all sessions of an server
+//
+// it can be changed while it is used by sessions
+type RateLimiter struct {
+	lock       sync.Mutex
+	config     RateLimitConfig
+	generation int // increased on every Set, so sessions renew there buckets
+	nodes      map[string]*limitBuckets
+	groups     map[string]*limitBuckets
+	stats      map[string]uint64
+
+	// count of sessions per node and group, the buckets are dropped with the last session
+	nodeSessions  map[string]int
+	groupSessions map[string]int
+}
+
+// RateLimiterNew create an new RateLimiter
+func RateLimiterNew(limitConfig RateLimitConfig) (*RateLimiter, error) {
+	newLimiter := RateLimiter{
+		stats:         make(map[string]uint64),
+		nodeSessions:  make(map[string]int),
+		groupSessions: make(map[string]int),
+	}
+	if err := newLimiter.Set(limitConfig); err != nil {
+		return nil, err
+	}
+	return &newLimiter, nil
+}
+
+func rateLimitCheck(limit RateLimit) error {
+	switch limit.Action {
+	case "", LimitDrop, LimitDelay, LimitDisconnect:
+		return nil
+	}
+	return fmt.Errorf("Unknown limit action '%s'", limit.Action)
+}
+
+// Set replace the limits, all buckets start full again
+func (limiter *RateLimiter) Set(limitConfig RateLimitConfig) error {
+
+	limits := []RateLimit{limitConfig.Connection, limitConfig.Node, limitConfig.Group}
+	for _, limit := range limitConfig.Nodes {
+		limits = append(limits, limit)
+	}
+	for _, limit := range limitConfig.Groups {
+		limits = append(limits, limit)
+	}
+	for _, limit := range limits {
+		if err := rateLimitCheck(limit); err != nil {
+			return err
+		}
+	}
+
+	limiter.lock.Lock()
+	limiter.config = limitConfig
+	limiter.generation++
+	limiter.nodes = make(map[string]*limitBuckets)
+	limiter.groups = make(map[string]*limitBuckets)
+	limiter.lock.Unlock()
+
+	return nil
+}
+
+// LoadConfig read the limits from the json-object name of the config, use it with config.Watch() to reload it
+func (limiter *RateLimiter) LoadConfig(name string) error {
+
+	var limitConfig RateLimitConfig
+	if err := configObjectDecode(name, &limitConfig); err != nil {
+		return err
+	}
+
+	return limiter.Set(limitConfig)
+}
+
+// nodeLimit return the limit of an remote node
+func (limiter *RateLimiter) nodeLimit(node string) RateLimit {
+	if limit, exist := limiter.config.Nodes[node]; exist {
+		return limit
+	}
+	return limiter.config.Node
+}
+
+// groupLimit return the limit of an remote group
+func (limiter *RateLimiter) groupLimit(group string) RateLimit {
+	if limit, exist := limiter.config.Groups[group]; exist {
+		return limit
+	}
+	return limiter.config.Group
+}
+
+// Stats return how often an limit was exceeded, the key is "<scope>.<kind>.<action>"
+func (limiter *RateLimiter) Stats() map[string]uint64 {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	stats := make(map[string]uint64, len(limiter.stats))
+	for key, count := range limiter.stats {
+		stats[key] = count
+	}
+	return stats
+}
+
+// StatsKeys return the sorted keys of Stats()
+func (limiter *RateLimiter) StatsKeys() []string {
+	stats := limiter.Stats()
+	keys := make([]string, 0, len(stats))
+	for key := range stats {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// take tokens from all scopes of the session
+//
+// first all scopes are checked, so an refused message take no tokens of an other scope.
+// With LimitDelay the violation is returned together with the time to wait
+func (limiter *RateLimiter) take(socket *SocketConnection, size int) (*LimitViolation, time.Duration) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	// the limits changed
+	if socket.limitGeneration != limiter.generation {
+		socket.limitGeneration = limiter.generation
+		socket.limitBuckets = limitBucketsNew(limiter.config.Connection)
+	}
+
+	nodeBuckets, exist := limiter.nodes[socket.remoteNodeName]
+	if !exist {
+		nodeBuckets = limitBucketsNew(limiter.nodeLimit(socket.remoteNodeName))
+		limiter.nodes[socket.remoteNodeName] = nodeBuckets
+	}
+	groupBuckets, exist := limiter.groups[socket.remoteNodeGroup]
+	if !exist {
+		groupBuckets = limitBucketsNew(limiter.groupLimit(socket.remoteNodeGroup))
+		limiter.groups[socket.remoteNodeGroup] = groupBuckets
+	}
+
+	scopes := []struct {
+		scope   string
+		key     string
+		buckets *limitBuckets
+	}{
+		{LimitScopeConnection, socket.ID(), socket.limitBuckets},
+		{LimitScopeNode, socket.remoteNodeName, nodeBuckets},
+		{LimitScopeGroup, socket.remoteNodeGroup, groupBuckets},
+	}
+
+	now := time.Now()
+	for _, scope := range scopes {
+		if kind, ok := scope.buckets.check(now, size); !ok {
+			return limiter.violation(scope.scope, scope.key, kind, scope.buckets.limit.Action), 0
+		}
+	}
+
+	var delayed *LimitViolation
+	var wait time.Duration
+	for _, scope := range scopes {
+		kind, scopeWait := scope.buckets.take(now, size)
+		if scopeWait > wait {
+			delayed = &LimitViolation{Scope: scope.scope, Key: scope.key, Kind: kind, Action: LimitDelay}
+			wait = scopeWait
+		}
+	}
+
+	if delayed != nil {
+		return limiter.violation(delayed.Scope, delayed.Key, delayed.Kind, LimitDelay), wait
+	}
+	return nil, 0
+}
+
+// sessionAdd count the session for its node and group
+func (limiter *RateLimiter) sessionAdd(socket *SocketConnection) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	limiter.nodeSessions[socket.remoteNodeName]++
+	limiter.groupSessions[socket.remoteNodeGroup]++
+}
+
+// sessionRemove drop the buckets of the node and group, if this was there last session
+func (limiter *RateLimiter) sessionRemove(socket *SocketConnection) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	if limiter.nodeSessions[socket.remoteNodeName]--; limiter.nodeSessions[socket.remoteNodeName] <= 0 {
+		delete(limiter.nodeSessions, socket.remoteNodeName)
+		delete(limiter.nodes, socket.remoteNodeName)
+	}
+	if limiter.groupSessions[socket.remoteNodeGroup]--; limiter.groupSessions[socket.remoteNodeGroup] <= 0 {
+		delete(limiter.groupSessions, socket.remoteNodeGroup)
+		delete(limiter.groups, socket.remoteNodeGroup)
+	}
+}
+
+// violation count it, limiter.lock must be held
+func (limiter *RateLimiter) violation(scope, key, kind, action string) *LimitViolation {
+	if action == "" {
+		action = LimitDrop
+	}
+	limiter.stats[scope+"."+kind+"."+action]++
+
+	return &LimitViolation{
+		Scope:  scope,
+		Key:    key,
+		Kind:   kind,
+		Action: action,
+	}
+}
+
+// subscriptionsCheck return an violation if the remote side can not subscribe more
+func (limiter *RateLimiter) subscriptionsCheck(socket *SocketConnection) *LimitViolation {
+
+	// subscriptions of all sessions of the same node/group
+	nodeCount, groupCount := 0, 0
+	if socket.server != nil {
+		for _, session := range socket.server.sessionList() {
+			count := session.remoteSubscriptionsCount()
+			if session.remoteNodeName == socket.remoteNodeName {
+				nodeCount = nodeCount + count
+			}
+			if session.remoteNodeGroup == socket.remoteNodeGroup {
+				groupCount = groupCount + count
+			}
+		}
+	} else {
+		nodeCount = socket.remoteSubscriptionsCount()
+		groupCount = nodeCount
+	}
+
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	scopes := []struct {
+		scope string
+		key   string
+		limit RateLimit
+		count int
+	}{
+		{LimitScopeConnection, socket.ID(), limiter.config.Connection, socket.remoteSubscriptionsCount()},
+		{LimitScopeNode, socket.remoteNodeName, limiter.nodeLimit(socket.remoteNodeName), nodeCount},
+		{LimitScopeGroup, socket.remoteNodeGroup, limiter.groupLimit(socket.remoteNodeGroup), groupCount},
+	}
+	for _, scope := range scopes {
+		if scope.limit.MaxSubscriptions > 0 && scope.count >= scope.limit.MaxSubscriptions {
+			action := scope.limit.Action
+			if action != LimitDisconnect {
+				action = LimitDrop
+			}
+			return limiter.violation(scope.scope, scope.key, LimitSubscriptions, action)
+		}
+	}
+
+	return nil
+}
+
+// ################################# socket #################################
+
+// limitViolated log the violation, inform the remote side and the callback
+//
+// an delay is not send to the remote side, it just notice that we read slower.
+// The remote side get max one ERROR per LimitNoticeInterval, so an flood don't create an flood of ERRORs
+func (socket *SocketConnection) limitViolated(violation *LimitViolation, cb SocketCallbacks) error {
+
+	err := &LimitError{Violation: *violation}
+
+	now := time.Now().UnixNano()
+	notice := violation.Action == LimitDisconnect || now-socket.limitNoticeLast >= int64(LimitNoticeInterval)
+
+	logEntry := socket.log.WithFields(logrus.Fields{
+		"scope":  violation.Scope,
+		"key":    violation.Key,
+		"kind":   violation.Kind,
+		"action": violation.Action,
+	})
+	if notice {
+		logEntry.Warn("Limit exceeded")
+	} else {
+		logEntry.Debug("Limit exceeded")
+	}
+
+	if violation.Action != LimitDelay && notice {
+		socket.limitNoticeLast = now
+		socket.sendError(ErrorCodeLimit, err.Error())
+	}
+
+	if cb.OnLimitExceeded != nil {
+		cb.OnLimitExceeded(socket, *violation)
+	}
+
+	return err
+}
+
+// limitMessage take tokens for an message of the remote side, also control-messages are counted
+//
+// it wait if the action is LimitDelay, an LimitError is returned if the message must be dropped or the connection closed
+func (socket *SocketConnection) limitMessage(message Msg, size int, cb SocketCallbacks) error {
+
+	limiter := socket.options.RateLimiter
+	if limiter == nil {
+		return nil
+	}
+
+	violation, wait := limiter.take(socket, size)
+	if violation == nil {
+		return nil
+	}
+
+	err := socket.limitViolated(violation, cb)
+	if violation.Action != LimitDelay {
+		return err
+	}
+
+	time.Sleep(wait)
+	return nil
+}
+
+// limitSessionAdd count the session by the RateLimiter, so the buckets of its node and group can be dropped later
+func (socket *SocketConnection) limitSessionAdd() {
+	if socket.options.RateLimiter != nil && !socket.limitCounted {
+		socket.limitCounted = true
+		socket.options.RateLimiter.sessionAdd(socket)
+	}
+}
+
+// limitSessionRemove is called if the session is closed
+func (socket *SocketConnection) limitSessionRemove() {
+	if socket.options.RateLimiter != nil && socket.limitCounted {
+		socket.limitCounted = false
+		socket.options.RateLimiter.sessionRemove(socket)
+	}
+}
+
+// limitSubscription check if the remote side can subscribe more
+func (socket *SocketConnection) limitSubscription(cb SocketCallbacks) error {
+
+	limiter := socket.options.RateLimiter
+	if limiter == nil {
+		return nil
+	}
+
+	if violation := limiter.subscriptionsCheck(socket); violation != nil {
+		return socket.limitViolated(violation, cb)
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitlab.com/gopilot/lib/config"
+)
+
+func TestTokenBucket(t *testing.T) {
+
+	now := time.Now()
+	bucket := tokenBucketNew(10, 2)
+
+	for i := 0; i < 2; i++ {
+		if _, ok := bucket.take(now, 1, false); !ok {
+			t.Fatal("Burst should be allowed")
+		}
+	}
+	if _, ok := bucket.take(now, 1, false); ok {
+		t.Fatal("Bucket should be empty")
+	}
+	if _, ok := bucket.take(now.Add(100*time.Millisecond), 1, false); !ok {
+		t.Fatal("Bucket should be refilled")
+	}
+
+	// with debt we get the time to wait
+	wait, ok := bucket.take(now.Add(100*time.Millisecond), 1, true)
+	if !ok || wait != 100*time.Millisecond {
+		t.Fatalf("Expected to wait 100ms, got %v", wait)
+	}
+
+	if tokenBucketNew(0, 10) != nil {
+		t.Fatal("Rate 0 is unlimited")
+	}
+}
+
+// limitSetup connect an client to an server with the limiter in serverOptions, both are stopped after the test
+func limitSetup(t *testing.T, serverOptions, clientOptions SocketOptions) (*SocketConnection, chan Msg, chan LimitViolation, chan error, chan struct{}) {
+
+	received := make(chan Msg, 100)
+	violations := make(chan LimitViolation, 100)
+	disconnected := make(chan struct{}, 10)
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+	server := SocketNew()
+	server.OptionsSet(serverOptions)
+	go server.Serve(filename, SocketCallbacks{
+		OnMessage: func(socket *SocketConnection, message Msg) {
+			received <- message
+		},
+		OnLimitExceeded: func(socket *SocketConnection, violation LimitViolation) {
+			violations <- violation
+		},
+		OnDisconnect: func(socket *SocketConnection) {
+			if socket.RemoteNodeName() == "testnode" {
+				disconnected <- struct{}{}
+			}
+		},
+	})
+	waitForSocket(filename)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		server.Shutdown()
+	})
+
+	connected := make(chan struct{}, 10)
+	errs := make(chan error, 100)
+	client := SocketNew()
+	client.OptionsSet(clientOptions)
+	go client.Connect(ctx, filename, "testnode", "test", SocketCallbacks{
+		OnHandshakeFinished: func(socket *SocketConnection) {
+			connected <- struct{}{}
+		},
+		OnError: func(socket *SocketConnection, err error) {
+			errs <- err
+		},
+	})
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client not connected")
+	}
+	waitForSessions(t, server, 1)
+
+	return client, received, violations, errs, disconnected
+}
+
+func TestRateLimitDrop(t *testing.T) {
+
+	limiter, err := RateLimiterNew(RateLimitConfig{
+		Connection: RateLimit{MessagesPerSecond: 0.1, MessageBurst: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, received, violations, errs, _ := limitSetup(t, SocketOptions{RateLimiter: limiter}, SocketOptions{})
+
+	for i := 0; i < 5; i++ {
+		client.SendMessage(Msg{NodeSource: "testnode", Command: "status"})
+	}
+	expectMessage(t, received, "status")
+	expectMessage(t, received, "status")
+
+	for i := 0; i < 3; i++ {
+		select {
+		case violation := <-violations:
+			if violation.Scope != LimitScopeConnection || violation.Kind != LimitMessages || violation.Action != LimitDrop {
+				t.Errorf("Unexpected violation %+v", violation)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Violation missing")
+		}
+	}
+
+	// the client get only one error for all drops
+	select {
+	case err := <-errs:
+		if remoteErr, ok := err.(*RemoteError); !ok || remoteErr.Code != ErrorCodeLimit {
+			t.Errorf("Expected limit-error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client got no error")
+	}
+	select {
+	case err := <-errs:
+		t.Errorf("Expected only one error, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if count := limiter.Stats()["connection.messages.drop"]; count != 3 {
+		t.Errorf("Expected 3 drops in the stats, got %d", count)
+	}
+	select {
+	case message := <-received:
+		t.Errorf("Dropped message was delivered: %v", message)
+	default:
+	}
+}
+
+func TestRateLimitDelay(t *testing.T) {
+
+	limiter, _ := RateLimiterNew(RateLimitConfig{
+		Group: RateLimit{MessagesPerSecond: 20, MessageBurst: 1, Action: LimitDelay},
+	})
+	client, received, _, _, _ := limitSetup(t, SocketOptions{RateLimiter: limiter}, SocketOptions{})
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		client.SendMessage(Msg{NodeSource: "testnode", Command: "status"})
+	}
+	for i := 0; i < 5; i++ {
+		expectMessage(t, received, "status")
+	}
+
+	// 4 messages over the burst need 200ms
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Messages were not delayed, took %v", elapsed)
+	}
+	if limiter.Stats()["group.messages.delay"] == 0 {
+		t.Error("Delay is missing in the stats")
+	}
+}
+
+func TestRateLimitConfigNode(t *testing.T) {
+
+	config.Init()
+	config.SetJSONObject("gbusLimits", map[string]interface{}{
+		"nodes": map[string]interface{}{
+			"testnode": map[string]interface{}{
+				"maxSubscriptions": 2,
+				"action":           "disconnect",
+			},
+		},
+	})
+
+	limiter, _ := RateLimiterNew(RateLimitConfig{})
+	if err := limiter.LoadConfig("gbusLimits"); err != nil {
+		t.Fatal(err)
+	}
+
+	client, _, violations, errs, disconnected := limitSetup(t, SocketOptions{RateLimiter: limiter}, SocketOptions{})
+
+	// the subscription of the handshake is not counted
+	client.Subscribe(Subscription{GroupTarget: "one"})
+	client.Subscribe(Subscription{GroupTarget: "two"})
+	client.Subscribe(Subscription{GroupTarget: "three"})
+
+	select {
+	case violation := <-violations:
+		if violation.Scope != LimitScopeNode || violation.Kind != LimitSubscriptions || violation.Key != "testnode" {
+			t.Errorf("Unexpected violation %+v", violation)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Violation missing")
+	}
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client got no error")
+	}
+
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Node was not disconnected")
+	}
+}
+
+func TestRateLimitCheckAllScopes(t *testing.T) {
+
+	limiter, _ := RateLimiterNew(RateLimitConfig{
+		Connection: RateLimit{MessagesPerSecond: 0.1, MessageBurst: 3},
+		Node:       RateLimit{MessagesPerSecond: 0.1, MessageBurst: 1},
+	})
+
+	session := SocketNew()
+	session.remoteNodeName = "testnode"
+	session.remoteNodeGroup = "test"
+
+	if violation, _ := limiter.take(session, 10); violation != nil {
+		t.Fatalf("First message should pass, got %+v", violation)
+	}
+
+	// the node refuse, so the connection keep its tokens
+	for i := 0; i < 2; i++ {
+		if violation, _ := limiter.take(session, 10); violation == nil || violation.Scope != LimitScopeNode {
+			t.Fatalf("Expected node-violation, got %+v", violation)
+		}
+	}
+	if tokens := session.limitBuckets.messages.tokens; tokens < 1.9 {
+		t.Fatalf("Connection lost tokens of refused messages, %f left", tokens)
+	}
+}
+
+func TestRateLimitPrune(t *testing.T) {
+
+	limiter, _ := RateLimiterNew(RateLimitConfig{
+		Node:  RateLimit{MessagesPerSecond: 10},
+		Group: RateLimit{MessagesPerSecond: 10},
+	})
+
+	first := SocketNew()
+	first.remoteNodeName = "testnode"
+	first.remoteNodeGroup = "test"
+	second := SocketNew()
+	second.remoteNodeName = "testnode"
+	second.remoteNodeGroup = "test"
+
+	limiter.sessionAdd(first)
+	limiter.sessionAdd(second)
+	limiter.take(first, 10)
+
+	// the node has an other session
+	limiter.sessionRemove(first)
+	if len(limiter.nodes) != 1 || len(limiter.groups) != 1 {
+		t.Fatal("Buckets was dropped while the node has sessions")
+	}
+
+	limiter.sessionRemove(second)
+	if len(limiter.nodes) != 0 || len(limiter.groups) != 0 || len(limiter.nodeSessions) != 0 {
+		t.Fatalf("Buckets of closed sessions are not dropped %v %v", limiter.nodes, limiter.groups)
+	}
+}
+
+func TestRateLimitInvalidSignature(t *testing.T) {
+
+	limiter, _ := RateLimiterNew(RateLimitConfig{
+		Connection: RateLimit{MessagesPerSecond: 0.1, MessageBurst: 2},
+	})
+	serverSigner := HmacSignerNew(time.Minute)
+	serverSigner.SecretSet("testnode", "secret")
+
+	clientSigner := HmacSignerNew(time.Minute)
+	clientSigner.SecretSet("testnode", "secret")
+
+	client, _, violations, _, _ := limitSetup(t, SocketOptions{
+		RateLimiter:   limiter,
+		Signer:        serverSigner,
+		RequireSigned: true,
+	}, SocketOptions{Signer: clientSigner})
+
+	// the signature is checked after the limit, so an flood of invalid messages is limited
+	for i := 0; i < 5; i++ {
+		client.SendMessage(Msg{NodeSource: "testnode", Command: "forged", Signature: "invalid"})
+	}
+
+	select {
+	case <-violations:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Messages with an invalid signature was not limited")
+	}
+}
+
+func TestRateLimitControl(t *testing.T) {
+
+	limiter, _ := RateLimiterNew(RateLimitConfig{
+		Connection: RateLimit{MessagesPerSecond: 0.1, MessageBurst: 2},
+	})
+	client, _, violations, _, _ := limitSetup(t, SocketOptions{RateLimiter: limiter}, SocketOptions{})
+
+	// an SUBSCRIBE-flood is limited
+	for i := 0; i < 5; i++ {
+		client.Subscribe(Subscription{GroupTarget: fmt.Sprintf("group%d", i)})
+	}
+
+	select {
+	case violation := <-violations:
+		if violation.Kind != LimitMessages {
+			t.Errorf("Unexpected violation %+v", violation)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SUBSCRIBE was not limited")
+	}
+}
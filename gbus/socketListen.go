@@ -0,0 +1,207 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errors while we prepare the path of an unix-socket
+var (
+	ErrPathNotSocket = errors.New("Path exists and is not an socket, refuse to remove it")
+	ErrSocketInUse   = errors.New("Socket is in use by another process")
+)
+
+// the first file-descriptor which systemd pass to us
+const systemdListenFdsStart = 3
+
+// isAbstractSocket return true for unix-addresses in the abstract namespace
+func isAbstractSocket(address string) bool {
+	return strings.HasPrefix(address, "@")
+}
+
+// unixSocketRemoveStale remove an unix-socket which is not used anymore
+func unixSocketRemoveStale(filename string) error {
+
+	info, err := os.Lstat(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return ErrPathNotSocket
+	}
+
+	// someone is listening
+	if conn, err := net.DialTimeout("unix", filename, time.Second); err == nil {
+		conn.Close()
+		return ErrSocketInUse
+	}
+
+	return os.Remove(filename)
+}
+
+// socketFileApply set mode, owner and group of an socket-file
+func (socket *SocketConnection) socketFileApply(filename string) error {
+
+	if socket.options.SocketMode != 0 {
+		if err := os.Chmod(filename, socket.options.SocketMode); err != nil {
+			return err
+		}
+	}
+
+	if socket.options.SocketOwner == "" && socket.options.SocketGroup == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if socket.options.SocketOwner != "" {
+		owner, err := lookupID(socket.options.SocketOwner, func(name string) (string, error) {
+			found, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return found.Uid, nil
+		})
+		if err != nil {
+			return err
+		}
+		uid = owner
+	}
+	if socket.options.SocketGroup != "" {
+		group, err := lookupID(socket.options.SocketGroup, func(name string) (string, error) {
+			found, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return found.Gid, nil
+		})
+		if err != nil {
+			return err
+		}
+		gid = group
+	}
+
+	return os.Chown(filename, uid, gid)
+}
+
+// lookupID return the numeric id of an user/group, it can be numeric already
+func lookupID(nameOrID string, lookup func(name string) (string, error)) (int, error) {
+
+	if id, err := strconv.Atoi(nameOrID); err == nil {
+		return id, nil
+	}
+
+	id, err := lookup(nameOrID)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(id)
+}
+
+// ################################# systemd #################################
+
+var (
+	systemdOnce      sync.Once
+	systemdListeners map[string][]Listener
+	systemdErr       error
+)
+
+// SystemdListeners return the listeners which systemd passed to us with socket-activation
+//
+// the key is the name from FileDescriptorName= ( LISTEN_FDNAMES ), "" if systemd send no names.
+// The environment is only read once, so the listeners are not passed to child processes
+func SystemdListeners() (map[string][]Listener, error) {
+	systemdOnce.Do(func() {
+		systemdListeners, systemdErr = systemdListenersLoad()
+	})
+	return systemdListeners, systemdErr
+}
+
+func systemdListenersLoad() (map[string][]Listener, error) {
+
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make(map[string][]Listener)
+
+	// not for us
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return listeners, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return listeners, nil
+	}
+
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+
+	for index := 0; index < count; index++ {
+		name := ""
+		if index < len(names) {
+			name = names[index]
+		}
+
+		file := os.NewFile(uintptr(systemdListenFdsStart+index), fmt.Sprintf("LISTEN_FD_%d", systemdListenFdsStart+index))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return listeners, err
+		}
+
+		listeners[name] = append(listeners[name], listener)
+	}
+
+	return listeners, nil
+}
+
+// systemdListenerFor return the listener which systemd created for the unix-socket, or nil
+func systemdListenerFor(filename string) Listener {
+
+	listeners, err := SystemdListeners()
+	if err != nil {
+		return nil
+	}
+
+	for _, named := range listeners {
+		for _, listener := range named {
+			if netListener, ok := listener.(net.Listener); ok && netListener.Addr().String() == filename {
+				return listener
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestListenSafeRemove(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+
+	// an regular file is never removed
+	if err := ioutil.WriteFile(filename, []byte("important"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NetListen("unix", filename); err != ErrPathNotSocket {
+		t.Fatalf("Expected ErrPathNotSocket, got %v", err)
+	}
+	if _, err := os.Stat(filename); err != nil {
+		t.Fatal("The file was removed")
+	}
+	os.Remove(filename)
+
+	// an socket in use is not removed
+	inUse, err := NetListen("unix", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NetListen("unix", filename); err != ErrSocketInUse {
+		t.Fatalf("Expected ErrSocketInUse, got %v", err)
+	}
+
+	// an stale socket is replaced
+	inUse.(*net.UnixListener).SetUnlinkOnClose(false)
+	inUse.Close()
+	stale, err := NetListen("unix", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.Close()
+}
+
+func TestListenAbstract(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets only exist on linux")
+	}
+
+	address := "@gbus-abstract-" + strconv.Itoa(os.Getpid())
+	listener, err := NetListen("unix", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go echoServer(listener)
+	transportPing(t, NetTransport{Network: "unix", Address: address})
+}
+
+func TestListenSocketMode(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+
+	server := SocketNew()
+	server.OptionsSet(SocketOptions{
+		SocketMode:  0600,
+		SocketGroup: strconv.Itoa(os.Getgid()),
+	})
+	go server.Serve(filename, SocketCallbacks{})
+	waitForSocket(filename)
+	defer server.Shutdown()
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, got %o", info.Mode().Perm())
+	}
+}
+
+// TestSystemdHelperProcess is not an real test, it is the echo-server for TestListenSystemd
+func TestSystemdHelperProcess(t *testing.T) {
+	if os.Getenv("GBUS_SYSTEMD_HELPER") == "" {
+		return
+	}
+
+	// systemd set this after the fork
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+
+	logrus.SetLevel(logrus.WarnLevel)
+	server := SocketNew()
+	server.Serve(os.Getenv("GBUS_SYSTEMD_HELPER"), SocketCallbacks{
+		OnMessage: func(socket *SocketConnection, message Msg) {
+			socket.SendMessage(Msg{NodeSource: "echo", Command: "echo-" + message.Command})
+		},
+	})
+	os.Exit(0)
+}
+
+func TestListenSystemd(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+
+	listener, err := net.Listen("unix", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	file, err := listener.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	helper := exec.Command(os.Args[0], "-test.run=^TestSystemdHelperProcess$")
+	helper.Env = append(os.Environ(), "GBUS_SYSTEMD_HELPER="+filename, "LISTEN_FDS=1", "LISTEN_FDNAMES=gbus")
+	helper.ExtraFiles = []*os.File{file}
+	if err := helper.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		helper.Process.Kill()
+		helper.Wait()
+	}()
+
+	// the helper must not remove the socket we passed
+	time.Sleep(100 * time.Millisecond)
+	transportPing(t, NetTransport{Network: "unix", Address: filename})
+}
@@ -0,0 +1,130 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errors of the peer-check
+var (
+	ErrPeerCredUnsupported = errors.New("Peer credentials are not supported on this connection")
+)
+
+// PeerCred are the credentials of the process on the other side of an unix-socket
+type PeerCred struct {
+	UID uint32
+	GID uint32
+	PID int32
+	Exe string // path of the executable, can be empty if we are not allowed to read it
+}
+
+// PeerPolicy allow only local processes which match one of the uids, gids or executables
+type PeerPolicy struct {
+	UIDs []uint32
+	GIDs []uint32
+	Exes []string
+}
+
+// Allowed return true if the credentials match the policy
+func (policy *PeerPolicy) Allowed(cred PeerCred) bool {
+
+	for _, uid := range policy.UIDs {
+		if uid == cred.UID {
+			return true
+		}
+	}
+	for _, gid := range policy.GIDs {
+		if gid == cred.GID {
+			return true
+		}
+	}
+	if cred.Exe != "" {
+		for _, exe := range policy.Exes {
+			if exe == cred.Exe {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// peerCredSet read the credentials of the remote process if conn is an unix-socket
+func (socket *SocketConnection) peerCredSet(conn net.Conn) {
+
+	socket.peerCred = nil
+	socket.peerCredErr = ErrPeerCredUnsupported
+
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return
+	}
+
+	cred, err := peerCredRead(unixConn)
+	if err != nil {
+		socket.peerCredErr = err
+		return
+	}
+	socket.peerCred = &cred
+	socket.peerCredErr = nil
+}
+
+// PeerCredentials return uid, gid, pid and executable of the remote process
+//
+// this is only aviable on unix-sockets, otherwise an error is returned
+func (socket *SocketConnection) PeerCredentials() (PeerCred, error) {
+	if socket.peerCred == nil {
+		return PeerCred{}, socket.peerCredErr
+	}
+	return *socket.peerCred, nil
+}
+
+// peerCheck check the remote process against the PeerAllow-policy
+//
+// connections without credentials are rejected if an policy is set
+func (socket *SocketConnection) peerCheck() error {
+
+	policy := socket.options.PeerAllow
+	if policy == nil {
+		return nil
+	}
+
+	cred, err := socket.PeerCredentials()
+	if err != nil {
+		socket.log.WithField("reason", err.Error()).Warn("Reject peer without credentials")
+		return &HandshakeError{Reason: "Peer not allowed: " + err.Error()}
+	}
+
+	if !policy.Allowed(cred) {
+		socket.log.WithFields(logrus.Fields{
+			"uid": cred.UID,
+			"gid": cred.GID,
+			"pid": cred.PID,
+			"exe": cred.Exe,
+		}).Warn("Reject peer")
+		return &HandshakeError{Reason: fmt.Sprintf("Peer not allowed: uid %d gid %d", cred.UID, cred.GID)}
+	}
+
+	return nil
+}
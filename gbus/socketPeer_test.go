@@ -0,0 +1,123 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestPeerPolicy(t *testing.T) {
+
+	cred := PeerCred{UID: 1000, GID: 100, PID: 42, Exe: "/usr/bin/gopilot"}
+
+	if (&PeerPolicy{}).Allowed(cred) {
+		t.Error("An empty policy must reject everyone")
+	}
+	if !(&PeerPolicy{UIDs: []uint32{0, 1000}}).Allowed(cred) {
+		t.Error("uid should be allowed")
+	}
+	if !(&PeerPolicy{GIDs: []uint32{100}}).Allowed(cred) {
+		t.Error("gid should be allowed")
+	}
+	if !(&PeerPolicy{Exes: []string{"/usr/bin/gopilot"}}).Allowed(cred) {
+		t.Error("exe should be allowed")
+	}
+	if (&PeerPolicy{Exes: []string{""}}).Allowed(PeerCred{UID: 1000}) {
+		t.Error("An unknown exe must not match")
+	}
+}
+
+// peerConnect connect an client to an server with the policy and return the session on the server or the error of the client
+//
+// the server is stopped after the test
+func peerConnect(t *testing.T, policy *PeerPolicy) (*SocketConnection, error) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+	sessions := make(chan *SocketConnection, 1)
+	server := SocketNew()
+	server.OptionsSet(SocketOptions{PeerAllow: policy})
+	go server.Serve(filename, SocketCallbacks{
+		OnHandshakeFinished: func(socket *SocketConnection) {
+			sessions <- socket
+		},
+	})
+	waitForSocket(filename)
+	t.Cleanup(server.Shutdown)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	failed := make(chan error, 10)
+	client := SocketNew()
+	go client.Connect(ctx, filename, "testnode", "test", SocketCallbacks{
+		OnConnectFailed: func(socket *SocketConnection, attempt int, err error) {
+			failed <- err
+		},
+	})
+
+	select {
+	case session := <-sessions:
+		return session, nil
+	case err := <-failed:
+		return nil, err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout while connecting")
+	}
+	return nil, nil
+}
+
+func TestPeerCredentials(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_PEERCRED only exist on linux")
+	}
+
+	exe, _ := os.Executable()
+	session, err := peerConnect(t, &PeerPolicy{Exes: []string{exe}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cred, err := session.PeerCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.UID != uint32(os.Getuid()) || cred.GID != uint32(os.Getgid()) || cred.PID != int32(os.Getpid()) {
+		t.Errorf("Wrong credentials %+v", cred)
+	}
+}
+
+func TestPeerReject(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_PEERCRED only exist on linux")
+	}
+
+	_, err := peerConnect(t, &PeerPolicy{UIDs: []uint32{uint32(os.Getuid()) + 4242}})
+	remoteErr, ok := err.(*RemoteError)
+	if !ok {
+		t.Fatalf("Expected RemoteError, got %v", err)
+	}
+	if remoteErr.Code != ErrorCodePeer {
+		t.Errorf("Expected code %s, got %s", ErrorCodePeer, remoteErr.Code)
+	}
+}
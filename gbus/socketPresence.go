@@ -0,0 +1,263 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"encoding/json"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/gopilot/lib/mynodename"
+)
+
+// PresenceGroup is the reserved group for presence-messages of the server
+const PresenceGroup = "_presence"
+
+// Commands of presence-messages
+const (
+	PresenceJoin  = "join"
+	PresenceLeave = "leave"
+)
+
+// Reasons of an PresenceEvent
+const (
+	PresenceReasonConnect    = "connect"
+	PresenceReasonResume     = "resume"
+	PresenceReasonDisconnect = "disconnect"
+	PresenceReasonKick       = "kick"
+	PresenceReasonShutdown   = "shutdown"
+)
+
+// PresenceEvent is the payload of an presence-message
+type PresenceEvent struct {
+	Node      string `json:"node"`
+	Group     string `json:"group"`
+	Transport string `json:"transport"` // the name of the listener or the network of the connection
+	Reason    string `json:"reason"`
+	Time      int64  `json:"time"` // unix-time in nanoseconds
+}
+
+// PresenceInfo is an entry of the presence-table
+type PresenceInfo struct {
+	Node      string
+	Group     string
+	Transport string
+	Since     time.Time
+	Sessions  int // count of sessions of the node
+}
+
+// presenceEntry is an node which is online
+type presenceEntry struct {
+	info  PresenceInfo
+	leave *time.Timer // the node is gone, but we wait PresenceDebounce before we tell it
+}
+
+// PresenceBusSet publish presence-messages on the bus, nil disable it
+func (socket *SocketConnection) PresenceBusSet(bus *GBus) {
+	socket.presenceLock.Lock()
+	socket.presenceBus = bus
+	socket.presenceLock.Unlock()
+}
+
+// Presence return the nodes which are online, sorted by name
+func (socket *SocketConnection) Presence() []PresenceInfo {
+	socket.presenceLock.Lock()
+	defer socket.presenceLock.Unlock()
+
+	list := make([]PresenceInfo, 0, len(socket.presence))
+	for _, entry := range socket.presence {
+		list = append(list, entry.info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Node < list[j].Node
+	})
+	return list
+}
+
+// PresenceOf return the presence of an node
+func (socket *SocketConnection) PresenceOf(node string) (PresenceInfo, bool) {
+	socket.presenceLock.Lock()
+	defer socket.presenceLock.Unlock()
+
+	entry, exist := socket.presence[node]
+	if !exist {
+		return PresenceInfo{}, false
+	}
+	return entry.info, true
+}
+
+// transport return how the remote node is connected
+func (socket *SocketConnection) transport() string {
+	if socket.listenerName != "" {
+		return socket.listenerName
+	}
+	if socket.socket != nil && socket.socket.RemoteAddr() != nil {
+		return socket.socket.RemoteAddr().Network()
+	}
+	return ""
+}
+
+// presenceJoin is called after an session was added
+//
+// if the node come back while we wait to tell that it left, nothing is published
+func (socket *SocketConnection) presenceJoin(session *SocketConnection) {
+
+	event := PresenceEvent{
+		Node:      session.RemoteNodeName(),
+		Group:     session.RemoteNodeGroup(),
+		Transport: session.transport(),
+		Reason:    PresenceReasonConnect,
+	}
+	if session.Resumed() {
+		event.Reason = PresenceReasonResume
+	}
+
+	socket.presenceOrderLock.Lock()
+	defer socket.presenceOrderLock.Unlock()
+
+	socket.presenceLock.Lock()
+	if socket.presence == nil {
+		socket.presence = make(map[string]*presenceEntry)
+	}
+
+	entry, exist := socket.presence[event.Node]
+	if exist {
+		entry.info.Sessions++
+		entry.info.Group = event.Group
+		entry.info.Transport = event.Transport
+
+		// flapping
+		if entry.leave != nil {
+			entry.leave.Stop()
+			entry.leave = nil
+			session.log.WithField("node", event.Node).Debug("Node is back before the debounce, no presence-event")
+		}
+		socket.presenceLock.Unlock()
+		return
+	}
+
+	socket.presence[event.Node] = &presenceEntry{
+		info: PresenceInfo{
+			Node:      event.Node,
+			Group:     event.Group,
+			Transport: event.Transport,
+			Since:     time.Now(),
+			Sessions:  1,
+		},
+	}
+	socket.presenceLock.Unlock()
+
+	socket.presencePublish(PresenceJoin, event)
+}
+
+// presenceLeave is called after an session was removed
+//
+// if the node was replaced by an newer session, this is debounced like an disconnect
+func (socket *SocketConnection) presenceLeave(session *SocketConnection) {
+
+	event := PresenceEvent{
+		Node:      session.RemoteNodeName(),
+		Group:     session.RemoteNodeGroup(),
+		Transport: session.transport(),
+		Reason:    PresenceReasonDisconnect,
+	}
+	if socket.isShutdown() {
+		event.Reason = PresenceReasonShutdown
+	} else if atomic.LoadInt32(&session.noResume) == 1 {
+		event.Reason = PresenceReasonKick
+	}
+
+	socket.presenceOrderLock.Lock()
+	defer socket.presenceOrderLock.Unlock()
+
+	socket.presenceLock.Lock()
+
+	entry, exist := socket.presence[event.Node]
+	if !exist {
+		socket.presenceLock.Unlock()
+		return
+	}
+
+	entry.info.Sessions--
+	if entry.info.Sessions > 0 {
+		socket.presenceLock.Unlock()
+		return
+	}
+
+	debounce := socket.options.PresenceDebounce
+	replaced := event.Reason == PresenceReasonKick && atomic.LoadInt32(&session.replaced) == 1
+	if debounce <= 0 || (event.Reason != PresenceReasonDisconnect && !replaced) {
+		delete(socket.presence, event.Node)
+		socket.presenceLock.Unlock()
+
+		socket.presencePublish(PresenceLeave, event)
+		return
+	}
+
+	// maybe it come back
+	var timer *time.Timer
+	timer = time.AfterFunc(debounce, func() {
+		socket.presenceOrderLock.Lock()
+		defer socket.presenceOrderLock.Unlock()
+
+		socket.presenceLock.Lock()
+		current, exist := socket.presence[event.Node]
+		if !exist || current.leave != timer {
+			socket.presenceLock.Unlock()
+			return
+		}
+		delete(socket.presence, event.Node)
+		socket.presenceLock.Unlock()
+
+		socket.presencePublish(PresenceLeave, event)
+	})
+	entry.leave = timer
+	socket.presenceLock.Unlock()
+}
+
+// presencePublish send the event to the bus, the caller hold the presenceOrderLock
+func (socket *SocketConnection) presencePublish(command string, event PresenceEvent) {
+
+	socket.log.WithFields(logrus.Fields{
+		"node":      event.Node,
+		"group":     event.Group,
+		"transport": event.Transport,
+		"reason":    event.Reason,
+	}).Info("Node " + command)
+
+	socket.presenceLock.Lock()
+	bus := socket.presenceBus
+	socket.presenceLock.Unlock()
+	if bus == nil {
+		return
+	}
+
+	event.Time = time.Now().UnixNano()
+	payload, _ := json.Marshal(event)
+
+	bus.PublishMsg(Msg{
+		NodeSource:  mynodename.NodeName,
+		GroupSource: PresenceGroup,
+		GroupTarget: PresenceGroup,
+		Command:     command,
+		Payload:     string(payload),
+	})
+}
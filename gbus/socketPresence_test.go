@@ -0,0 +1,193 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// expectPresence wait for the next presence-message
+func expectPresence(t *testing.T, events chan Msg, command, node, reason string) PresenceEvent {
+
+	select {
+	case message := <-events:
+		var event PresenceEvent
+		if err := json.Unmarshal([]byte(message.Payload), &event); err != nil {
+			t.Fatal(err)
+		}
+		if message.Command != command || event.Node != node || event.Reason != reason {
+			t.Fatalf("Expected %s of %s ( %s ), got %s %+v", command, node, reason, message.Command, event)
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No %s of %s", command, node)
+	}
+	return PresenceEvent{}
+}
+
+func TestPresence(t *testing.T) {
+
+	var bus GBus
+	bus.Init()
+	bus.Run()
+
+	events := make(chan Msg, 10)
+	bus.Subscribe("presence", "", PresenceGroup, func(message *Msg, group, command, payload string) {
+		if message.GroupSource == PresenceGroup {
+			events <- *message
+		}
+	})
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+	server := SocketNew()
+	server.OptionsSet(SocketOptions{PresenceDebounce: 300 * time.Millisecond})
+	server.PresenceBusSet(&bus)
+	go server.Serve(filename, SocketCallbacks{})
+	waitForSocket(filename)
+	defer server.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := SocketNew()
+	client.OptionsSet(SocketOptions{
+		Reconnect: ReconnectPolicy{InitialBackoff: 10 * time.Millisecond},
+	})
+	go client.Connect(ctx, filename, "nodeA", "clients", SocketCallbacks{})
+
+	event := expectPresence(t, events, PresenceJoin, "nodeA", PresenceReasonConnect)
+	if event.Group != "clients" || event.Transport != "unix" {
+		t.Errorf("Wrong event %+v", event)
+	}
+	if info, online := server.PresenceOf("nodeA"); !online || info.Sessions != 1 {
+		t.Fatalf("nodeA should be online, got %+v", info)
+	}
+
+	// the connection break, but the client is back before the debounce
+	oldID := waitForSessions(t, server, 1)[0].ID
+	server.Session(oldID).close()
+	for i := 0; i < 250; i++ {
+		if sessions := server.Sessions(); len(sessions) == 1 && sessions[0].ID != oldID {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	select {
+	case message := <-events:
+		t.Fatalf("Flapping was not absorbed, got %s", message.Command)
+	default:
+	}
+	if presence := server.Presence(); len(presence) != 1 || presence[0].Sessions != 1 {
+		t.Fatalf("Wrong presence-table %+v", presence)
+	}
+
+	// now it is gone
+	cancel()
+	expectPresence(t, events, PresenceLeave, "nodeA", PresenceReasonDisconnect)
+	if _, online := server.PresenceOf("nodeA"); online {
+		t.Error("nodeA is still online")
+	}
+}
+
+func TestPresenceKick(t *testing.T) {
+
+	var bus GBus
+	bus.Init()
+	bus.Run()
+
+	events := make(chan Msg, 10)
+	bus.Subscribe("presence", "", PresenceGroup, func(message *Msg, group, command, payload string) {
+		events <- *message
+	})
+
+	// an kick is never debounced
+	filename := filepath.Join(t.TempDir(), "x.sock")
+	server := SocketNew()
+	server.OptionsSet(SocketOptions{PresenceDebounce: time.Hour})
+	server.PresenceBusSet(&bus)
+	go server.Serve(filename, SocketCallbacks{})
+	waitForSocket(filename)
+	defer server.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := SocketNew()
+	go client.Connect(ctx, filename, "nodeB", "clients", SocketCallbacks{
+		OnDisconnect: func(socket *SocketConnection) {
+			cancel()
+		},
+	})
+	expectPresence(t, events, PresenceJoin, "nodeB", PresenceReasonConnect)
+
+	server.DisconnectNode("nodeB")
+	expectPresence(t, events, PresenceLeave, "nodeB", PresenceReasonKick)
+}
+
+func TestPresenceReplaced(t *testing.T) {
+
+	var bus GBus
+	bus.Init()
+	bus.Run()
+
+	events := make(chan Msg, 10)
+	bus.Subscribe("presence", "", PresenceGroup, func(message *Msg, group, command, payload string) {
+		if message.GroupSource == PresenceGroup {
+			events <- *message
+		}
+	})
+
+	// the new session replace the old one, this is not an leave of the node
+	filename := filepath.Join(t.TempDir(), "x.sock")
+	server := SocketNew()
+	server.OptionsSet(SocketOptions{
+		PresenceDebounce:   300 * time.Millisecond,
+		MaxSessionsPerNode: 1,
+		DuplicateNode:      DuplicateKickOld,
+	})
+	server.PresenceBusSet(&bus)
+	go server.Serve(filename, SocketCallbacks{})
+	waitForSocket(filename)
+	defer server.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first := admissionClient(ctx, filename, "nodeA", 1)
+	expectPresence(t, events, PresenceJoin, "nodeA", PresenceReasonConnect)
+
+	admissionClient(ctx, filename, "nodeA", 0)
+	expectAdmissionError(t, first, 1)
+
+	time.Sleep(500 * time.Millisecond)
+	select {
+	case message := <-events:
+		t.Fatalf("Replaced session was not absorbed, got %s", message.Command)
+	default:
+	}
+	if presence := server.Presence(); len(presence) != 1 || presence[0].Sessions != 1 {
+		t.Fatalf("Wrong presence-table %+v", presence)
+	}
+}
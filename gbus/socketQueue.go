@@ -0,0 +1,499 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/gopilot/lib/config"
+)
+
+// Overflow-policies of the outbound-queue
+const (
+	QueueDropOldest = "dropOldest" // the oldest message is dropped to make room for the new one
+	QueueDropNewest = "dropNewest" // the new message is dropped
+)
+
+// OutboundQueueOptions configure the queue of a client for messages which are send while it is disconnected
+//
+// After the next handshake the queue is flushed in order
+type OutboundQueueOptions struct {
+	// Size is the max count of queued messages ( 0 means no queue, messages are dropped )
+	Size int
+
+	// MemorySize is the count of messages which are hold in memory, the rest is spilled to disk
+	// ( 0 means all messages are hold in memory )
+	MemorySize int
+
+	// SpillName enable spilling to the file "queue_<SpillName>.jsonl" inside config.ConfigPath
+	// the file survive an restart and is flushed on the next connect
+	SpillName string
+
+	// MaxAge drop messages which are older than this on flush ( 0 means no expiry )
+	MaxAge time.Duration
+
+	// Overflow is what happens if the queue is full ( default QueueDropOldest )
+	Overflow string
+}
+
+// OutboundQueueStats are the metrics of the outbound-queue
+type OutboundQueueStats struct {
+	Queued   int    // messages which are currently in the queue
+	Spilled  int    // messages of Queued which are on disk
+	Enqueued uint64 // messages which was added to the queue
+	Dropped  uint64 // messages which was dropped because the queue was full
+	Expired  uint64 // messages which was dropped because they are too old
+	Flushed  uint64 // messages which was send after a reconnect
+}
+
+// queuedMsg is an message with the time it was queued
+type queuedMsg struct {
+	Queued  int64 `json:"queued"`
+	Message Msg   `json:"msg"`
+}
+
+// outboundQueue hold the messages, the caller must hold the queueLock of the socket
+type outboundQueue struct {
+	log     *logrus.Entry
+	options OutboundQueueOptions
+	memory  []queuedMsg
+
+	// the spill-file, the first spillSkip lines are already dropped
+	// spillSkip is stored in the offset-file, so dropped messages don't come back after an restart
+	spillFilename  string
+	offsetFilename string
+	spillCount     int
+	spillSkip      int
+
+	// the lines after spillSkip which are send by an running flush, they stay on disk until spillDone
+	spillFlushing int
+
+	stats OutboundQueueStats
+}
+
+func outboundQueueNew(log *logrus.Entry, options OutboundQueueOptions) *outboundQueue {
+
+	newQueue := outboundQueue{
+		log:     log.WithField("queue", options.SpillName),
+		options: options,
+	}
+
+	if options.SpillName != "" {
+		newQueue.spillFilename = filepath.Join(config.ConfigPath, "queue_"+options.SpillName+".jsonl")
+		newQueue.offsetFilename = filepath.Join(config.ConfigPath, "queue_"+options.SpillName+".offset")
+		newQueue.spillCount = newQueue.spillLines()
+		newQueue.spillSkip = newQueue.offsetRead()
+	}
+
+	return &newQueue
+}
+
+// OutboundQueueStats return the metrics of the outbound-queue
+func (socket *SocketConnection) OutboundQueueStats() OutboundQueueStats {
+	socket.queueLock.Lock()
+	defer socket.queueLock.Unlock()
+
+	if socket.queue == nil {
+		return OutboundQueueStats{}
+	}
+
+	stats := socket.queue.stats
+	stats.Spilled = socket.queue.spillCount - socket.queue.spillSkip
+	stats.Queued = len(socket.queue.memory) + stats.Spilled
+	return stats
+}
+
+// len return the count of queued messages, the messages of an running flush are not counted
+func (queue *outboundQueue) len() int {
+	return len(queue.memory) + queue.spillCount - queue.spillSkip - queue.spillFlushing
+}
+
+// push add an message to the end of the queue
+func (queue *outboundQueue) push(message Msg) {
+	if queue.pushEntry(queuedMsg{
+		Queued:  time.Now().UnixNano(),
+		Message: message,
+	}) {
+		queue.stats.Enqueued++
+	}
+}
+
+// pushEntry add an entry to the end of the queue, return false if it was dropped
+func (queue *outboundQueue) pushEntry(newEntry queuedMsg) bool {
+
+	if queue.len() >= queue.options.Size {
+		if queue.options.Overflow == QueueDropNewest || !queue.dropOldest() {
+			queue.stats.Dropped++
+			queue.log.WithField("command", newEntry.Message.Command).Warn("Outbound queue is full, drop message")
+			return false
+		}
+		queue.stats.Dropped++
+	}
+
+	// if something is on disk, new messages must also go to disk to keep the order
+	memoryFull := queue.options.MemorySize > 0 && len(queue.memory) >= queue.options.MemorySize
+	if queue.spillFilename != "" && (memoryFull || queue.spillCount > queue.spillSkip) {
+		if err := queue.spill(newEntry); err == nil {
+			return true
+		}
+	}
+
+	queue.memory = append(queue.memory, newEntry)
+	return true
+}
+
+// dropOldest remove the oldest message
+func (queue *outboundQueue) dropOldest() bool {
+
+	if len(queue.memory) > 0 {
+		queue.memory = queue.memory[1:]
+		return true
+	}
+	// the oldest lines on disk are send by an running flush, so we can not drop them
+	if queue.spillFlushing == 0 && queue.spillCount > queue.spillSkip {
+		queue.spillSkip++
+
+		// the file should not grow forever
+		if queue.spillSkip*2 >= queue.spillCount {
+			queue.spillCompact()
+		} else {
+			queue.offsetWrite()
+		}
+		return true
+	}
+
+	return false
+}
+
+// offsetRead return the count of dropped lines at the start of the spill-file
+func (queue *outboundQueue) offsetRead() int {
+
+	data, err := ioutil.ReadFile(queue.offsetFilename)
+	if err != nil {
+		return 0
+	}
+
+	offset, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || offset < 0 {
+		return 0
+	}
+	if offset > queue.spillCount {
+		return queue.spillCount
+	}
+	return offset
+}
+
+// offsetWrite store the count of dropped lines
+func (queue *outboundQueue) offsetWrite() {
+	if err := ioutil.WriteFile(queue.offsetFilename, []byte(strconv.Itoa(queue.spillSkip)), 0600); err != nil {
+		queue.log.Error(err)
+	}
+}
+
+// spillCompact rewrite the spill-file without the dropped lines
+func (queue *outboundQueue) spillCompact() {
+
+	entries := queue.spillRead()
+
+	tempFilename := queue.spillFilename + ".tmp"
+	file, err := os.OpenFile(tempFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		queue.log.Error(err)
+		queue.offsetWrite()
+		return
+	}
+
+	writer := bufio.NewWriter(file)
+	for _, entry := range entries {
+		line, _ := json.Marshal(entry)
+		writer.Write(append(line, '\n'))
+	}
+	err = writer.Flush()
+	file.Close()
+	if err == nil {
+		err = os.Rename(tempFilename, queue.spillFilename)
+	}
+	if err != nil {
+		queue.log.Error(err)
+		os.Remove(tempFilename)
+		queue.offsetWrite()
+		return
+	}
+
+	queue.spillCount = len(entries)
+	queue.spillSkip = 0
+	os.Remove(queue.offsetFilename)
+}
+
+// spill append the entry to the spill-file
+func (queue *outboundQueue) spill(entry queuedMsg) error {
+
+	file, err := os.OpenFile(queue.spillFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		queue.log.Error(err)
+		return err
+	}
+	defer file.Close()
+
+	line, _ := json.Marshal(entry)
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		queue.log.Error(err)
+		return err
+	}
+
+	queue.spillCount++
+	return nil
+}
+
+// spillLines count the entrys of an existing spill-file
+func (queue *outboundQueue) spillLines() int {
+
+	file, err := os.Open(queue.spillFilename)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, recvBufferSize), DefaultMaxFrameSize*2)
+	for scanner.Scan() {
+		count++
+	}
+	return count
+}
+
+// spillRead return the entrys of the spill-file which are not dropped
+func (queue *outboundQueue) spillRead() []queuedMsg {
+
+	file, err := os.Open(queue.spillFilename)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var entries []queuedMsg
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, recvBufferSize), DefaultMaxFrameSize*2)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if line <= queue.spillSkip {
+			continue
+		}
+
+		var entry queuedMsg
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			queue.log.Error(err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// takeAll return all entrys in order and clear the memory
+//
+// the memory hold the older messages, the spill-file the newer ones.
+// The spilled entrys stay on disk until the flush call spillDone, so they are not lost if we crash while we flush
+func (queue *outboundQueue) takeAll() (memory []queuedMsg, spilled []queuedMsg) {
+
+	memory = queue.memory
+	queue.memory = nil
+
+	if queue.spillFilename != "" && queue.spillCount > queue.spillSkip {
+		spilled = queue.spillRead()
+		queue.spillFlushing = queue.spillCount - queue.spillSkip
+	}
+
+	return memory, spilled
+}
+
+// spillDone drop the first lines of the spill-file, after they was send by the flush
+func (queue *outboundQueue) spillDone(lines int) {
+
+	queue.spillFlushing = 0
+	if lines <= 0 {
+		return
+	}
+
+	queue.spillSkip += lines
+	if queue.spillSkip >= queue.spillCount {
+		os.Remove(queue.spillFilename)
+		os.Remove(queue.offsetFilename)
+		queue.spillCount = 0
+		queue.spillSkip = 0
+		return
+	}
+
+	// new messages was spilled while we flushed
+	if queue.spillSkip*2 >= queue.spillCount {
+		queue.spillCompact()
+	} else {
+		queue.offsetWrite()
+	}
+}
+
+// expired return true if the entry is older than MaxAge
+func (queue *outboundQueue) expired(entry queuedMsg, now int64) bool {
+
+	if queue.options.MaxAge > 0 && now-entry.Queued > int64(queue.options.MaxAge) {
+		queue.stats.Expired++
+		return true
+	}
+	return false
+}
+
+// drain return all messages in order and clear the queue, expired messages are dropped
+//
+// it is used for queues which are not flushed over the network, like the buffer of an parked session
+func (queue *outboundQueue) drain() []Msg {
+
+	memory, spilled := queue.takeAll()
+	queue.spillDone(queue.spillFlushing)
+
+	var messages []Msg
+	now := time.Now().UnixNano()
+	for _, entry := range append(memory, spilled...) {
+		if !queue.expired(entry, now) {
+			messages = append(messages, entry.Message)
+		}
+	}
+	return messages
+}
+
+// requeue put entrys of the memory back in front of the queue, after a flush failed
+//
+// they keep there queue-time and the limits of the queue are used again
+func (queue *outboundQueue) requeue(entries []queuedMsg) {
+
+	// messages which was queued while we flushed are newer
+	queue.memory = append(append([]queuedMsg{}, entries...), queue.memory...)
+
+	for queue.len() > queue.options.Size {
+		if queue.options.Overflow == QueueDropNewest && len(queue.memory) > 0 {
+			queue.memory = queue.memory[:len(queue.memory)-1]
+		} else if !queue.dropOldest() {
+			break
+		}
+		queue.stats.Dropped++
+	}
+}
+
+// queueMessage return true if the message was queued, because we are not connected
+//
+// sockets without an queue send directly
+func (socket *SocketConnection) queueMessage(message Msg) bool {
+
+	socket.queueLock.Lock()
+	defer socket.queueLock.Unlock()
+
+	if socket.queue == nil || socket.connected {
+		return false
+	}
+
+	socket.queue.push(message)
+	return true
+}
+
+// queueFlush send all queued messages and mark the socket as connected
+//
+// the queueLock is not hold while we send, new messages are queued and flushed in the next round
+func (socket *SocketConnection) queueFlush() {
+
+	for {
+		socket.queueLock.Lock()
+		if socket.queue == nil {
+			socket.connected = true
+			socket.queueLock.Unlock()
+			return
+		}
+
+		memory, spilled := socket.queue.takeAll()
+		if len(memory) == 0 && len(spilled) == 0 {
+			socket.connected = true
+			socket.queueLock.Unlock()
+			return
+		}
+		socket.queueLock.Unlock()
+
+		sent, err := socket.queueSend(memory)
+		if err != nil {
+			// we lost the connection again, so we keep the rest
+			socket.queueLock.Lock()
+			socket.queue.spillDone(0)
+			socket.queue.requeue(memory[sent:])
+			socket.queueLock.Unlock()
+			return
+		}
+
+		sent, err = socket.queueSend(spilled)
+		socket.queueLock.Lock()
+		if err == nil {
+			// all lines are done, also the lines we could not parse
+			sent = socket.queue.spillFlushing
+		}
+		socket.queue.spillDone(sent)
+		socket.queueLock.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// queueSend send the entrys in order, expired entrys are skipped
+//
+// return the count of entrys which are done
+func (socket *SocketConnection) queueSend(entries []queuedMsg) (int, error) {
+
+	now := time.Now().UnixNano()
+	for index, entry := range entries {
+		socket.queueLock.Lock()
+		expired := socket.queue.expired(entry, now)
+		socket.queueLock.Unlock()
+		if expired {
+			continue
+		}
+
+		if err := socket.sendNow(entry.Message, false); err != nil {
+			return index, err
+		}
+
+		socket.queueLock.Lock()
+		socket.queue.stats.Flushed++
+		socket.queueLock.Unlock()
+	}
+	return len(entries), nil
+}
+
+// queueDisconnected mark the socket as disconnected, new messages will be queued
+func (socket *SocketConnection) queueDisconnected() {
+	socket.queueLock.Lock()
+	socket.connected = false
+	socket.queueLock.Unlock()
+}
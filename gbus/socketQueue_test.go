@@ -0,0 +1,225 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/gopilot/lib/config"
+)
+
+func queueCommands(messages []Msg) string {
+	var commands string
+	for _, message := range messages {
+		commands = commands + message.Command
+	}
+	return commands
+}
+
+func TestOutboundQueueOverflow(t *testing.T) {
+
+	for overflow, expected := range map[string]string{
+		QueueDropOldest: "234",
+		QueueDropNewest: "012",
+	} {
+		queue := outboundQueueNew(logrus.WithField("test", overflow), OutboundQueueOptions{
+			Size:     3,
+			Overflow: overflow,
+		})
+
+		for i := 0; i < 5; i++ {
+			queue.push(Msg{Command: fmt.Sprintf("%d", i)})
+		}
+		if queue.stats.Dropped != 2 {
+			t.Fatalf("%s: expected 2 dropped, got %d", overflow, queue.stats.Dropped)
+		}
+		if commands := queueCommands(queue.drain()); commands != expected {
+			t.Fatalf("%s: expected %s, got %s", overflow, expected, commands)
+		}
+	}
+}
+
+func TestOutboundQueueSpill(t *testing.T) {
+
+	tempDir, _ := ioutil.TempDir("", "gbus")
+	defer os.RemoveAll(tempDir)
+	config.ConfigPath = tempDir
+
+	queue := outboundQueueNew(logrus.WithField("test", "spill"), OutboundQueueOptions{
+		Size:       4,
+		MemorySize: 2,
+		SpillName:  "test",
+	})
+	for i := 0; i < 5; i++ {
+		queue.push(Msg{Command: fmt.Sprintf("%d", i)})
+	}
+	// 0 was dropped, everything after the first spill goes to disk to keep the order
+	if queue.spillCount-queue.spillSkip != 3 {
+		t.Fatalf("Expected 3 spilled messages, got %d", queue.spillCount-queue.spillSkip)
+	}
+
+	// a new queue finds the spilled messages
+	reloaded := outboundQueueNew(logrus.WithField("test", "spill"), OutboundQueueOptions{SpillName: "test"})
+	if reloaded.spillCount != 3 {
+		t.Fatalf("Expected 3 lines in spill-file, got %d", reloaded.spillCount)
+	}
+
+	// the spill-file stay on disk until the flush was successful
+	memory, spilled := queue.takeAll()
+	if len(memory) != 1 || len(spilled) != 3 {
+		t.Fatalf("Expected 1 message in memory and 3 on disk, got %d/%d", len(memory), len(spilled))
+	}
+	if _, err := os.Stat(queue.spillFilename); err != nil {
+		t.Fatal("Spill-file was removed before the flush")
+	}
+	queue.spillDone(queue.spillFlushing)
+	if commands := queueCommands([]Msg{memory[0].Message, spilled[0].Message, spilled[1].Message, spilled[2].Message}); commands != "1234" {
+		t.Fatalf("Expected 1234, got %s", commands)
+	}
+	if _, err := os.Stat(queue.spillFilename); !os.IsNotExist(err) {
+		t.Fatal("Spill-file was not removed")
+	}
+}
+
+func TestOutboundQueueSpillDropOldest(t *testing.T) {
+
+	tempDir, _ := ioutil.TempDir("", "gbus")
+	defer os.RemoveAll(tempDir)
+	config.ConfigPath = tempDir
+
+	queue := outboundQueueNew(logrus.WithField("test", "spill"), OutboundQueueOptions{
+		Size:       3,
+		MemorySize: 1,
+		SpillName:  "dropoldest",
+	})
+	for i := 0; i < 10; i++ {
+		queue.push(Msg{Command: fmt.Sprintf("%d", i)})
+
+		// dropped lines are removed from time to time
+		if lines := queue.spillLines(); lines > 2*3 {
+			t.Fatalf("Spill-file has %d lines", lines)
+		}
+	}
+
+	// dropped messages don't come back after an restart
+	reloaded := outboundQueueNew(logrus.WithField("test", "spill"), OutboundQueueOptions{Size: 3, SpillName: "dropoldest"})
+	if commands := queueCommands(reloaded.drain()); commands != "789" {
+		t.Fatalf("Expected 789, got %s", commands)
+	}
+}
+
+func TestOutboundQueueRequeue(t *testing.T) {
+
+	queue := outboundQueueNew(logrus.WithField("test", "requeue"), OutboundQueueOptions{
+		Size:   3,
+		MaxAge: 50 * time.Millisecond,
+	})
+	queue.push(Msg{Command: "a"})
+	queue.push(Msg{Command: "b"})
+	entries, _ := queue.takeAll()
+	time.Sleep(30 * time.Millisecond)
+
+	// new messages while we flush
+	queue.push(Msg{Command: "c"})
+	queue.push(Msg{Command: "d"})
+
+	// the flush failed, the oldest is dropped
+	queue.requeue(entries)
+	if queue.len() != 3 || queue.stats.Dropped != 1 {
+		t.Fatalf("Expected 3 queued and 1 dropped, got %d/%d", queue.len(), queue.stats.Dropped)
+	}
+
+	// the requeued message keep its age
+	time.Sleep(30 * time.Millisecond)
+	if commands := queueCommands(queue.drain()); commands != "cd" {
+		t.Fatalf("Expected cd, got %s", commands)
+	}
+}
+
+func TestOutboundQueueExpiry(t *testing.T) {
+
+	queue := outboundQueueNew(logrus.WithField("test", "expiry"), OutboundQueueOptions{
+		Size:   10,
+		MaxAge: 10 * time.Millisecond,
+	})
+	queue.push(Msg{Command: "old"})
+	time.Sleep(20 * time.Millisecond)
+	queue.push(Msg{Command: "new"})
+
+	if commands := queueCommands(queue.drain()); commands != "new" {
+		t.Fatalf("Expected new, got %s", commands)
+	}
+	if queue.stats.Expired != 1 {
+		t.Fatal("Expected one expired message")
+	}
+}
+
+func TestOutboundQueueFlush(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+
+	client := SocketNew()
+	client.OptionsSet(SocketOptions{
+		Reconnect:     ReconnectPolicy{InitialBackoff: 10 * time.Millisecond},
+		OutboundQueue: OutboundQueueOptions{Size: 10},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.Connect(ctx, filename, "testnode", "test", SocketCallbacks{})
+
+	// the server is not there yet
+	for i := 0; i < 3; i++ {
+		client.SendMessage(Msg{NodeSource: "testnode", Command: fmt.Sprintf("queued%d", i)})
+	}
+	if stats := client.OutboundQueueStats(); stats.Queued != 3 {
+		t.Fatalf("Expected 3 queued messages, got %d", stats.Queued)
+	}
+
+	messages := make(chan Msg, 10)
+	server := SocketNew()
+	go server.Serve(filename, SocketCallbacks{
+		OnMessage: func(socket *SocketConnection, message Msg) {
+			messages <- message
+		},
+	})
+	defer server.Shutdown()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case message := <-messages:
+			if message.Command != fmt.Sprintf("queued%d", i) {
+				t.Fatalf("Expected queued%d, got %s", i, message.Command)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Queue was not flushed")
+		}
+	}
+
+	if stats := client.OutboundQueueStats(); stats.Flushed != 3 || stats.Queued != 0 {
+		t.Fatalf("Wrong stats %+v", stats)
+	}
+}
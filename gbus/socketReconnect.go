@@ -0,0 +1,217 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// default values of the ReconnectPolicy
+const (
+	DefaultInitialBackoff = time.Second
+	DefaultMaxBackoff     = 30 * time.Second
+	DefaultBackoffFactor  = 2.0
+)
+
+// ReconnectPolicy define how a client retry if dial or handshake failed or the connection was lost
+//
+// fields with 0 use the default values
+type ReconnectPolicy struct {
+	InitialBackoff time.Duration // wait time after the first failed attempt
+	MaxBackoff     time.Duration // the wait time never grow above this
+	Multiplier     float64       // the wait time is multiplied with this after every failed attempt
+	Jitter         float64       // 0.0 - 1.0, the wait time is randomly changed by this fraction
+	MaxAttempts    int           // give up after this attempts without an successful handshake ( 0 means never )
+}
+
+// ConnectError is returned by Connect() if the ReconnectPolicy give up
+type ConnectError struct {
+	Attempts int
+	LastErr  error
+}
+
+func (err *ConnectError) Error() string {
+	return fmt.Sprintf("Giving up after %d attempts: %s", err.Attempts, err.LastErr)
+}
+
+// jitterRand is the seeded source for the jitter, so not every client wait the same time after a restart
+var (
+	jitterRand     = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterRandLock sync.Mutex
+)
+
+// jitterFloat64 return a random number in [0.0,1.0)
+func jitterFloat64() float64 {
+	jitterRandLock.Lock()
+	defer jitterRandLock.Unlock()
+	return jitterRand.Float64()
+}
+
+// backoff return the wait time after attempt failed attempts
+func (policy ReconnectPolicy) backoff(attempt int) time.Duration {
+
+	initialBackoff := policy.InitialBackoff
+	if initialBackoff <= 0 {
+		initialBackoff = DefaultInitialBackoff
+	}
+	maxBackoff := policy.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+	multiplier := policy.Multiplier
+	if multiplier < 1.0 {
+		multiplier = DefaultBackoffFactor
+	}
+
+	backoff := float64(initialBackoff)
+	for i := 1; i < attempt && backoff < float64(maxBackoff); i++ {
+		backoff = backoff * multiplier
+	}
+	if backoff > float64(maxBackoff) {
+		backoff = float64(maxBackoff)
+	}
+
+	// +/- jitter
+	if policy.Jitter > 0 {
+		backoff = backoff + backoff*policy.Jitter*(jitterFloat64()*2-1)
+	}
+
+	return time.Duration(backoff)
+}
+
+// closeOnCancel close the connection if ctx is done, call the returned function to stop watching
+func (socket *SocketConnection) closeOnCancel(ctx context.Context) func() {
+
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			socket.close()
+		case <-stop:
+		}
+	}()
+
+	return func() {
+		close(stop)
+	}
+}
+
+// connectLoop [BLOCKING] dial, handshake and handle messages until ctx is done or the policy give up
+//
+// this is used by every transport of the client
+func (socket *SocketConnection) connectLoop(ctx context.Context, transport Transport, listenForNodeName, listenForGroupName string, cb SocketCallbacks) error {
+
+	policy := socket.options.Reconnect
+	attempt := 0
+
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		err := socket.connectOnce(ctx, transport, listenForNodeName, listenForGroupName, cb)
+		if err == nil {
+			// we was connected, so we start again
+			attempt = 0
+		} else {
+			attempt = attempt + 1
+			socket.log.WithFields(logrus.Fields{
+				"attempt": attempt,
+			}).Error(err)
+
+			if cb.OnConnectFailed != nil {
+				cb.OnConnectFailed(socket, attempt, err)
+			}
+
+			if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+				return &ConnectError{Attempts: attempt, LastErr: err}
+			}
+		}
+
+		// wait before the next attempt
+		backoff := policy.backoff(attempt)
+		socket.log.WithField("backoff", backoff).Debug("Reconnect")
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// connectOnce dial, handshake and handle messages until the connection is lost
+// return an error if dial or handshake failed or the server closed the session because of its admission
+func (socket *SocketConnection) connectOnce(ctx context.Context, transport Transport, listenForNodeName, listenForGroupName string, cb SocketCallbacks) error {
+
+	newSocketCon, err := transport.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	socket.connSet(newSocketCon)
+
+	stopWatching := socket.closeOnCancel(ctx)
+	defer stopWatching()
+
+	// ################################# handshake #################################
+	socket.kickedErr = nil
+	if err := socket.handshakeClient(listenForNodeName, listenForGroupName); err != nil {
+		// we was never connected, so only OnConnectFailed is fired
+		socket.close()
+		return err
+	}
+
+	// tell the server again what we want
+	socket.subscriptionsRestore()
+
+	// the server maybe never got them
+	socket.ackRetransmit()
+
+	// send what was queued while we was disconnected
+	socket.queueFlush()
+
+	// callback - connected
+	if cb.OnConnect != nil {
+		cb.OnConnect(socket)
+	}
+
+	socket.log.Debug("")
+	socket.log.Debug("############################ Handshake finished ############################")
+	socket.log.Debug("")
+	// ############################ handshake finished #############################
+
+	// callback - finished with handshake
+	if cb.OnHandshakeFinished != nil {
+		cb.OnHandshakeFinished(socket)
+	}
+
+	socket.eventLoopWaitForMessage(cb)
+
+	// the server replaced us, this count as failed attempt so the backoff apply
+	if socket.kickedErr != nil {
+		return socket.kickedErr
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+
+	policy := ReconnectPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+	}
+
+	if policy.backoff(1) != 100*time.Millisecond || policy.backoff(2) != 200*time.Millisecond {
+		t.Fatalf("Wrong backoff %s %s", policy.backoff(1), policy.backoff(2))
+	}
+	// after an lost session we start with the initial backoff again
+	if policy.backoff(0) != 100*time.Millisecond {
+		t.Fatalf("Wrong backoff after session %s", policy.backoff(0))
+	}
+	if policy.backoff(10) != time.Second {
+		t.Fatalf("Backoff not limited %s", policy.backoff(10))
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		backoff := policy.backoff(2)
+		if backoff < 100*time.Millisecond || backoff > 300*time.Millisecond {
+			t.Fatalf("Jitter out of range %s", backoff)
+		}
+	}
+}
+
+func TestReconnectMaxAttempts(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+
+	client := SocketNew()
+	client.OptionsSet(SocketOptions{
+		Reconnect: ReconnectPolicy{InitialBackoff: 10 * time.Millisecond, MaxAttempts: 3},
+	})
+
+	failed := 0
+	err := client.Connect(context.Background(), filename, "testnode", "test", SocketCallbacks{
+		OnConnectFailed: func(socket *SocketConnection, attempt int, err error) {
+			failed = attempt
+		},
+	})
+
+	connectErr, ok := err.(*ConnectError)
+	if !ok || connectErr.Attempts != 3 || failed != 3 {
+		t.Fatalf("Expected ConnectError after 3 attempts, got %v", err)
+	}
+}
+
+func TestReconnectCancel(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	client := SocketNew()
+	done := make(chan error)
+	go func() {
+		done <- client.Connect(ctx, filename, "testnode", "test", SocketCallbacks{})
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("Expected canceled, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Connect was not canceled")
+	}
+}
+
+func TestReconnectAfterDisconnect(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+
+	// the server kick the first connection
+	var handshakes int32
+	server := SocketNew()
+	go server.Serve(filename, SocketCallbacks{
+		OnHandshakeFinished: func(socket *SocketConnection) {
+			if atomic.AddInt32(&handshakes, 1) == 1 {
+				socket.close()
+			}
+		},
+	})
+	waitForSocket(filename)
+	defer server.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	connected := make(chan struct{}, 2)
+	disconnected := make(chan struct{}, 2)
+
+	client := SocketNew()
+	client.OptionsSet(SocketOptions{
+		Reconnect: ReconnectPolicy{InitialBackoff: 10 * time.Millisecond},
+	})
+	go client.Connect(ctx, filename, "testnode", "test", SocketCallbacks{
+		OnConnect: func(socket *SocketConnection) {
+			connected <- struct{}{}
+		},
+		OnDisconnect: func(socket *SocketConnection) {
+			disconnected <- struct{}{}
+		},
+	})
+
+	for _, event := range []chan struct{}{connected, disconnected, connected} {
+		select {
+		case <-event:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Client did not reconnect")
+		}
+	}
+}
+
+func TestReconnectHandshakeFailedCallbacks(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+
+	// the server close every connection before the HELO
+	listener, err := net.Listen("unix", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	client := SocketNew()
+	client.OptionsSet(SocketOptions{
+		Reconnect: ReconnectPolicy{InitialBackoff: 10 * time.Millisecond, MaxAttempts: 2},
+	})
+
+	var failed, disconnected int
+	client.Connect(context.Background(), filename, "testnode", "test", SocketCallbacks{
+		OnConnectFailed: func(socket *SocketConnection, attempt int, err error) {
+			failed++
+		},
+		OnDisconnect: func(socket *SocketConnection) {
+			disconnected++
+		},
+	})
+
+	if failed != 2 || disconnected != 0 {
+		t.Fatalf("Expected 2 failed and no disconnect, got %d/%d", failed, disconnected)
+	}
+}
@@ -0,0 +1,238 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSessionUnknown is returned if no session with this id is connected to the server
+var ErrSessionUnknown = errors.New("Session is not connected")
+
+// SessionInfo describe an active session of the server
+type SessionInfo struct {
+	ID              string
+	RemoteNodeName  string
+	RemoteNodeGroup string
+	Listener        string // name of the listener which accepted the session
+	Connected       time.Time
+	LastActivity    time.Time
+	MessagesIn      uint64 // data-messages
+	MessagesOut     uint64 // data-messages
+	ControlIn       uint64 // handshake, PING, PONG, ACK, SUBSCRIBE, ...
+	ControlOut      uint64 // handshake, PING, PONG, ACK, SUBSCRIBE, ...
+	BytesIn         uint64 // bytes on the wire
+	BytesOut        uint64 // bytes on the wire
+}
+
+// sessionCounters count the messages of an connection, control-messages are counted separate
+type sessionCounters struct {
+	messagesIn  uint64 // atomic
+	messagesOut uint64 // atomic
+	controlIn   uint64 // atomic
+	controlOut  uint64 // atomic
+}
+
+func (counters *sessionCounters) count(control bool, in bool) {
+	switch {
+	case in && control:
+		atomic.AddUint64(&counters.controlIn, 1)
+	case in:
+		atomic.AddUint64(&counters.messagesIn, 1)
+	case control:
+		atomic.AddUint64(&counters.controlOut, 1)
+	default:
+		atomic.AddUint64(&counters.messagesOut, 1)
+	}
+}
+
+// Info return the metrics of the connection
+func (socket *SocketConnection) Info() SessionInfo {
+
+	stats := socket.compressStats.get()
+
+	return SessionInfo{
+		ID:              socket.ID(),
+		RemoteNodeName:  socket.RemoteNodeName(),
+		RemoteNodeGroup: socket.RemoteNodeGroup(),
+		Listener:        socket.Listener(),
+		Connected:       time.Unix(0, atomic.LoadInt64(&socket.connectTime)),
+		LastActivity:    time.Unix(0, atomic.LoadInt64(&socket.lastActivity)),
+		MessagesIn:      atomic.LoadUint64(&socket.counters.messagesIn),
+		MessagesOut:     atomic.LoadUint64(&socket.counters.messagesOut),
+		ControlIn:       atomic.LoadUint64(&socket.counters.controlIn),
+		ControlOut:      atomic.LoadUint64(&socket.counters.controlOut),
+		BytesIn:         stats.WireBytesIn,
+		BytesOut:        stats.WireBytesOut,
+	}
+}
+
+// sessionAdd is called after the handshake of an new session
+//
+// an AdmissionError is returned if the server reject it.
+// If the client want to resume an parked session, it get the missed messages
+func (socket *SocketConnection) sessionAdd(session *SocketConnection) error {
+
+	atomic.StoreInt64(&session.connectTime, time.Now().UnixNano())
+
+	socket.forwardLock.Lock()
+
+	socket.sessionsLock.Lock()
+	if socket.sessions == nil {
+		socket.sessions = make(map[string]*SocketConnection)
+	}
+	kick, err := socket.sessionAdmit(session)
+	if err != nil {
+		socket.sessionsLock.Unlock()
+		socket.forwardLock.Unlock()
+		return err
+	}
+	socket.sessions[session.ID()] = session
+	parked := socket.sessionUnpark(session)
+	socket.sessionsLock.Unlock()
+
+	for _, kicked := range kick {
+		go socket.sessionKick(kicked)
+	}
+
+	if parked != nil {
+		session.sessionResume(parked)
+	}
+
+	// the client wait for this, before it count as connected
+	// if it fail, the connection is lost and the event-loop remove the session
+	if err := session.handshakeAccept(); err != nil {
+		session.log.Error(err)
+	}
+	socket.forwardLock.Unlock()
+	return nil
+}
+
+// sessionRemove is called if the session is disconnected, it is parked if it can be resumed
+func (socket *SocketConnection) sessionRemove(session *SocketConnection) {
+
+	socket.forwardLock.Lock()
+	defer socket.forwardLock.Unlock()
+
+	socket.sessionsLock.Lock()
+	delete(socket.sessions, session.ID())
+	socket.sessionPark(session)
+	socket.sessionsLock.Unlock()
+}
+
+// sessionList return the active sessions of the server
+func (socket *SocketConnection) sessionList() []*SocketConnection {
+	socket.sessionsLock.Lock()
+	defer socket.sessionsLock.Unlock()
+
+	sessions := make([]*SocketConnection, 0, len(socket.sessions))
+	for _, session := range socket.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// Session return the active session with the id or nil
+func (socket *SocketConnection) Session(id string) *SocketConnection {
+	socket.sessionsLock.Lock()
+	defer socket.sessionsLock.Unlock()
+
+	return socket.sessions[id]
+}
+
+// Sessions return the infos of all active sessions of the server, the oldest first
+func (socket *SocketConnection) Sessions() []SessionInfo {
+
+	var infos []SessionInfo
+	for _, session := range socket.sessionList() {
+		infos = append(infos, session.Info())
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Connected.Equal(infos[j].Connected) {
+			return infos[i].ID < infos[j].ID
+		}
+		return infos[i].Connected.Before(infos[j].Connected)
+	})
+	return infos
+}
+
+// SendTo send the message to the session with the id
+func (socket *SocketConnection) SendTo(id string, message Msg) error {
+
+	session := socket.Session(id)
+	if session == nil {
+		return ErrSessionUnknown
+	}
+
+	return session.SendMessage(message)
+}
+
+// Broadcast send the message to all sessions, it return the count of sessions which got it
+//
+// like on every session, the message is not send back to the session it came from
+func (socket *SocketConnection) Broadcast(message Msg) int {
+
+	count := 0
+	for _, session := range socket.sessionList() {
+		if message.context == session.ID() {
+			continue
+		}
+		if err := session.SendMessage(message); err == nil {
+			count++
+		}
+	}
+
+	return count
+}
+
+// Disconnect close the session with the id
+func (socket *SocketConnection) Disconnect(id string) error {
+
+	session := socket.Session(id)
+	if session == nil {
+		return ErrSessionUnknown
+	}
+
+	session.log.Info("Disconnect session")
+	atomic.StoreInt32(&session.noResume, 1)
+	session.close()
+	return nil
+}
+
+// DisconnectNode close all sessions of the remote node, it return the count of closed sessions
+func (socket *SocketConnection) DisconnectNode(nodeName string) int {
+
+	count := 0
+	for _, session := range socket.sessionList() {
+		if session.RemoteNodeName() != nodeName {
+			continue
+		}
+
+		session.log.Info("Disconnect session")
+		atomic.StoreInt32(&session.noResume, 1)
+		session.close()
+		count++
+	}
+
+	return count
+}
@@ -0,0 +1,121 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitForSessions wait until the server has count sessions
+func waitForSessions(t *testing.T, server *SocketConnection, count int) []SessionInfo {
+	for i := 0; i < 250; i++ {
+		if sessions := server.Sessions(); len(sessions) == count {
+			return sessions
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d sessions, got %d", count, len(server.Sessions()))
+	return nil
+}
+
+func expectMessage(t *testing.T, messages chan Msg, command string) {
+	select {
+	case message := <-messages:
+		if message.Command != command {
+			t.Fatalf("Expected %s, got %s", command, message.Command)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Message %s was not recieved", command)
+	}
+}
+
+func TestSessionRegistry(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+
+	server := SocketNew()
+	go server.Serve(filename, SocketCallbacks{})
+	waitForSocket(filename)
+	defer server.Shutdown()
+
+	recieved := map[string]chan Msg{}
+	for _, node := range []string{"nodeA", "nodeB"} {
+		messages := make(chan Msg, 10)
+		recieved[node] = messages
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		client := SocketNew()
+		go client.Connect(ctx, filename, node, "test", SocketCallbacks{
+			OnMessage: func(socket *SocketConnection, message Msg) {
+				messages <- message
+			},
+			// no reconnect after we was kicked
+			OnDisconnect: func(socket *SocketConnection) {
+				cancel()
+			},
+		})
+	}
+
+	sessions := waitForSessions(t, server, 2)
+	var sessionA SessionInfo
+	for _, session := range sessions {
+		if session.RemoteNodeName == "nodeA" {
+			sessionA = session
+		}
+		if session.Connected.IsZero() || session.RemoteNodeGroup != "test" {
+			t.Fatalf("Wrong session info %+v", session)
+		}
+	}
+
+	if err := server.SendTo(sessionA.ID, Msg{NodeSource: "server", Command: "direct"}); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, recieved["nodeA"], "direct")
+
+	if count := server.Broadcast(Msg{NodeSource: "server", Command: "all"}); count != 2 {
+		t.Fatalf("Broadcast reached %d sessions", count)
+	}
+	expectMessage(t, recieved["nodeA"], "all")
+	expectMessage(t, recieved["nodeB"], "all")
+
+	// the HELO is an control-message, only the data-messages are counted as messages
+	if info := server.Session(sessionA.ID).Info(); info.MessagesOut != 2 || info.ControlOut == 0 || info.BytesOut == 0 {
+		t.Fatalf("Wrong stats %+v", info)
+	}
+
+	if err := server.Disconnect("unknown"); err != ErrSessionUnknown {
+		t.Fatalf("Expected unknown session, got %v", err)
+	}
+	if count := server.DisconnectNode("nodeA"); count != 1 {
+		t.Fatalf("Expected 1 disconnected session, got %d", count)
+	}
+
+	sessions = waitForSessions(t, server, 1)
+	if sessions[0].RemoteNodeName != "nodeB" {
+		t.Fatalf("Wrong session left %+v", sessions[0])
+	}
+	if err := server.SendTo(sessionA.ID, Msg{Command: "gone"}); err != ErrSessionUnknown {
+		t.Fatalf("Expected unknown session, got %v", err)
+	}
+}
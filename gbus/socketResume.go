@@ -0,0 +1,216 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CapResume is the capability for session-tokens
+const CapResume = "resume"
+
+// DefaultResumeBufferSize is the default count of messages which are buffered for an disconnected session
+const DefaultResumeBufferSize = 1000
+
+// parkedSession is an disconnected session which can be resumed inside the grace-period
+type parkedSession struct {
+	sessionID     string
+	nodeName      string
+	subscriptions []Subscription
+	buffer        *outboundQueue // protected by the sessionsLock of the server
+	timer         *time.Timer
+}
+
+// Resumed return true if this session continued an older session of the same client
+func (socket *SocketConnection) Resumed() bool {
+	return atomic.LoadInt32(&socket.resumed) == 1
+}
+
+// ParkedSessions return the count of disconnected sessions which wait for there client
+func (socket *SocketConnection) ParkedSessions() int {
+	socket.sessionsLock.Lock()
+	defer socket.sessionsLock.Unlock()
+
+	return len(socket.parked)
+}
+
+// sessionPark keep the subscriptions of an disconnected session for the grace-period
+//
+// the caller must hold forwardLock and sessionsLock
+func (socket *SocketConnection) sessionPark(session *SocketConnection) {
+
+	grace := socket.options.SessionResume
+	if grace <= 0 || session.sessionToken == "" || atomic.LoadInt32(&session.noResume) == 1 {
+		return
+	}
+
+	bufferSize := socket.options.ResumeBufferSize
+	if bufferSize <= 0 {
+		bufferSize = DefaultResumeBufferSize
+	}
+
+	token := session.sessionToken
+	parked := &parkedSession{
+		sessionID:     session.ID(),
+		nodeName:      session.RemoteNodeName(),
+		subscriptions: session.RemoteSubscriptions(),
+		buffer: outboundQueueNew(session.log, OutboundQueueOptions{
+			Size:     bufferSize,
+			Overflow: QueueDropOldest,
+		}),
+	}
+	parked.timer = time.AfterFunc(grace, func() {
+		socket.sessionsLock.Lock()
+		if socket.parked[token] == parked {
+			delete(socket.parked, token)
+			session.log.Info("Parked session expired")
+		}
+		socket.sessionsLock.Unlock()
+	})
+
+	if socket.parked == nil {
+		socket.parked = make(map[string]*parkedSession)
+	}
+	socket.parked[token] = parked
+
+	session.log.WithField("grace", grace).Info("Park session")
+}
+
+// sessionUnpark take the parked session for the token, it must belong to the same node
+//
+// the caller must hold forwardLock and sessionsLock
+func (socket *SocketConnection) sessionUnpark(session *SocketConnection) *parkedSession {
+
+	parked, exist := socket.parked[session.resumeToken]
+	if !exist {
+		return nil
+	}
+	if parked.nodeName != session.RemoteNodeName() {
+		session.log.WithFields(logrus.Fields{
+			"parkedNode": parked.nodeName,
+		}).Warn("Session-token belongs to another node")
+		return nil
+	}
+
+	parked.timer.Stop()
+	delete(socket.parked, session.resumeToken)
+	return parked
+}
+
+// sessionResume take the subscriptions and the buffer of the parked session, the buffer is send with replaySend
+// after the subscriptions are checked by the ACL
+//
+// the caller must hold forwardLock, so no new message can overtake the buffered ones
+func (session *SocketConnection) sessionResume(parked *parkedSession) {
+
+	session.subscriptionsLock.Lock()
+	session.remoteSubscriptions = parked.subscriptions
+	session.subscriptionsLock.Unlock()
+
+	session.log.WithFields(logrus.Fields{
+		"messages": parked.buffer.len(),
+		"dropped":  parked.buffer.stats.Dropped,
+	}).Info("Resume session")
+
+	session.replayLock.Lock()
+	session.replayBuffer = parked.buffer
+	session.replayLock.Unlock()
+
+	atomic.StoreInt32(&session.resumed, 1)
+}
+
+// replaySend send the buffer of the resumed session, the oldest first
+//
+// it block until the buffer is empty, messages which are forwarded meanwhile are send after the buffered ones.
+// The subscriptions can change meanwhile ( ACL ), so every message is checked again
+func (session *SocketConnection) replaySend() {
+
+	for {
+		session.replayLock.Lock()
+		if session.replayBuffer == nil {
+			session.replayLock.Unlock()
+			return
+		}
+		messages := session.replayBuffer.drain()
+		if len(messages) == 0 {
+			session.replayBuffer = nil
+			session.replayLock.Unlock()
+			return
+		}
+		session.replayLock.Unlock()
+
+		for _, message := range messages {
+			if _, subscribed := session.subscribedQoS(message); subscribed {
+				session.SendMessage(message)
+			}
+		}
+	}
+}
+
+// replayAppend append the message to the buffer, if it is still replayed
+func (session *SocketConnection) replayAppend(message Msg) bool {
+	session.replayLock.Lock()
+	defer session.replayLock.Unlock()
+
+	if session.replayBuffer == nil {
+		return false
+	}
+	session.replayBuffer.push(message)
+	return true
+}
+
+// ForwardAll send an message of the bus to all sessions which are subscribed to it
+//
+// for disconnected sessions which can be resumed, the message is buffered.
+// A slow session never block the others, if its send-queue is full the message is dropped for it.
+// it can be used directly as callback of the bus with bus.Subscribe("server", "", "", server.ForwardAll)
+func (socket *SocketConnection) ForwardAll(message *Msg, group, command, payload string) {
+
+	socket.forwardLock.Lock()
+	defer socket.forwardLock.Unlock()
+
+	for _, session := range socket.sessionList() {
+		session.forward(message, true)
+	}
+
+	socket.sessionsLock.Lock()
+	defer socket.sessionsLock.Unlock()
+
+	for _, parked := range socket.parked {
+
+		// it came from this session
+		if message.context == parked.sessionID {
+			continue
+		}
+
+		qos, subscribed := subscriptionsMatch(parked.subscriptions, *message)
+		if !subscribed {
+			continue
+		}
+
+		buffered := *message
+		if qos > buffered.QoS {
+			buffered.QoS = qos
+		}
+		parked.buffer.push(buffered)
+	}
+}
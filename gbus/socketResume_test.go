@@ -0,0 +1,234 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func waitForParked(t *testing.T, server *SocketConnection, count int) {
+	for i := 0; i < 250 && server.ParkedSessions() != count; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if server.ParkedSessions() != count {
+		t.Fatalf("Expected %d parked sessions, got %d", count, server.ParkedSessions())
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+
+	var bus GBus
+	bus.Init()
+	bus.Run()
+
+	subscribed := make(chan *SocketConnection, 10)
+	server := SocketNew()
+	server.OptionsSet(SocketOptions{SessionResume: 5 * time.Second})
+	bus.Subscribe("server", "", "", server.ForwardAll)
+	go server.Serve(filename, SocketCallbacks{
+		OnSubscriptionChanged: func(socket *SocketConnection) {
+			subscribed <- socket
+		},
+	})
+	waitForSocket(filename)
+	defer server.Shutdown()
+
+	messages := make(chan Msg, 10)
+	client := SocketNew()
+	client.OptionsSet(SocketOptions{
+		Reconnect: ReconnectPolicy{InitialBackoff: time.Second},
+	})
+	client.Subscribe(Subscription{GroupTarget: "alerts"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.Connect(ctx, filename, "nodeA", "clients", SocketCallbacks{
+		OnMessage: func(socket *SocketConnection, message Msg) {
+			messages <- message
+		},
+	})
+
+	var session *SocketConnection
+	select {
+	case session = <-subscribed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client did not subscribe")
+	}
+
+	// the connection is lost, the client wait a second before it reconnect
+	session.close()
+	waitForParked(t, server, 1)
+
+	for i := 0; i < 3; i++ {
+		bus.PublishPayload("server", "", "", "alerts", fmt.Sprintf("missed%d", i), "")
+	}
+	bus.PublishPayload("server", "", "", "other", "ignored", "")
+
+	// after the reconnect the client get what it missed, in order
+	for i := 0; i < 3; i++ {
+		expectMessage(t, messages, fmt.Sprintf("missed%d", i))
+	}
+	waitForParked(t, server, 0)
+
+	sessions := server.Sessions()
+	if len(sessions) != 1 || !server.Session(sessions[0].ID).Resumed() {
+		t.Fatal("Session was not resumed")
+	}
+
+	// an kicked session can not be resumed
+	server.DisconnectNode("nodeA")
+	time.Sleep(100 * time.Millisecond)
+	if server.ParkedSessions() != 0 {
+		t.Fatal("Kicked session was parked")
+	}
+}
+
+func TestBusCallbacksResume(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+
+	var bus GBus
+	bus.Init()
+	bus.Run()
+
+	// BusCallbacks use ForwardAll, so the bus-messages are buffered for parked sessions
+	subscribed := make(chan *SocketConnection, 10)
+	server := SocketNew()
+	server.OptionsSet(SocketOptions{SessionResume: 5 * time.Second})
+	go server.Serve(filename, BusCallbacks(&bus, SocketCallbacks{
+		OnSubscriptionChanged: func(socket *SocketConnection) {
+			subscribed <- socket
+		},
+	}))
+	waitForSocket(filename)
+	defer server.Shutdown()
+
+	messages := make(chan Msg, 10)
+	client := SocketNew()
+	client.OptionsSet(SocketOptions{
+		Reconnect: ReconnectPolicy{InitialBackoff: time.Second},
+	})
+	client.Subscribe(Subscription{GroupTarget: "alerts"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.Connect(ctx, filename, "nodeA", "clients", SocketCallbacks{
+		OnMessage: func(socket *SocketConnection, message Msg) {
+			messages <- message
+		},
+	})
+
+	var session *SocketConnection
+	select {
+	case session = <-subscribed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client did not subscribe")
+	}
+
+	bus.PublishPayload("server", "", "", "alerts", "live", "")
+	expectMessage(t, messages, "live")
+
+	session.close()
+	waitForParked(t, server, 1)
+	bus.PublishPayload("server", "", "", "alerts", "missed", "")
+
+	// the message is delivered once after the resume
+	expectMessage(t, messages, "missed")
+	select {
+	case message := <-messages:
+		t.Fatalf("Unexpected message %s", message.Command)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestForwardAllSlowSession(t *testing.T) {
+
+	// nobody read from the slow session
+	left, right := net.Pipe()
+	defer right.Close()
+
+	slow := SocketNew()
+	slow.OptionsSet(SocketOptions{SendQueueSize: 1, WriteTimeout: 10 * time.Second})
+	slow.connSet(left)
+	slow.remoteNodeName = "slow"
+	slow.remoteSubscriptionsReset()
+	slow.capabilities = []string{CapAck}
+
+	server := SocketNew()
+	server.sessions = map[string]*SocketConnection{slow.ID(): slow}
+
+	// the slow session must not block the forwarding
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			server.ForwardAll(&Msg{NodeSource: "server", NodeTarget: "slow", Command: "forward", QoS: QoSAtLeastOnce}, "", "", "")
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ForwardAll blocked on the slow session")
+	}
+	if slow.SendStats().Dropped == 0 {
+		t.Fatal("Expected dropped messages")
+	}
+
+	// dropped messages don't wait for an ACK
+	if pending := slow.Unacked(); pending+int(slow.SendStats().Dropped) != 10 {
+		t.Fatalf("Expected %d pending messages, got %d", 10-slow.SendStats().Dropped, pending)
+	}
+}
+
+func TestResumeReplayOrder(t *testing.T) {
+
+	server, client, serverErr, clientErr := pipeHandshake(SocketOptions{}, SocketOptions{})
+	if serverErr != nil || clientErr != nil {
+		t.Fatal(serverErr, clientErr)
+	}
+
+	buffer := outboundQueueNew(server.log, OutboundQueueOptions{Size: 10})
+	buffer.push(Msg{NodeSource: "server", NodeTarget: "testnode", Command: "buffered"})
+	server.sessionResume(&parkedSession{
+		subscriptions: server.RemoteSubscriptions(),
+		buffer:        buffer,
+	})
+
+	// forwarded before the buffer was send, it must not overtake it
+	server.Forward(&Msg{NodeSource: "server", NodeTarget: "testnode", Command: "forwarded"}, "", "", "")
+	go server.replaySend()
+
+	for _, expected := range []string{"buffered", "forwarded"} {
+		message, err := client.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Command != expected {
+			t.Fatalf("Expected %s, got %s", expected, message.Command)
+		}
+	}
+}
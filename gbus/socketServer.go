@@ -0,0 +1,171 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrServerClosed is returned by the Serve-functions after Shutdown()
+var ErrServerClosed = errors.New("Server closed")
+
+// ServerListener is one listener of an server
+type ServerListener struct {
+	Name     string // is added to the log and SessionInfo
+	Listener Listener
+
+	// Options of the sessions of this listener, like PeerAllow, Signer or ACL ( nil means the options of the server )
+	// limits of the server ( MaxSessions, SessionResume, ... ) are always taken from the server
+	Options *SocketOptions
+}
+
+// serverOptions return the options of the server which created this session
+//
+// the options of an listener can replace the session-options, the limits of the server are taken from here
+func (socket *SocketConnection) serverOptions() *SocketOptions {
+	if socket.server != nil {
+		return &socket.server.options
+	}
+	return &socket.options
+}
+
+// ServeListeners [BLOCKING] accept connections on all listeners
+//
+// all sessions are managed by this server, so Sessions(), ForwardAll() and Shutdown() work over all listeners.
+// If one listener fail, the server is shutdown and the error is returned
+func (socket *SocketConnection) ServeListeners(listeners []ServerListener, cb SocketCallbacks) error {
+
+	socket.log = socket.log.WithField("type", "server")
+
+	errs := make(chan error, len(listeners))
+	for _, serverListener := range listeners {
+		go func(serverListener ServerListener) {
+			errs <- socket.serveListener(serverListener, cb)
+		}(serverListener)
+	}
+
+	if len(listeners) == 0 {
+		return nil
+	}
+
+	// the first which stop, stop all
+	err := <-errs
+	socket.Shutdown()
+	for index := 1; index < len(listeners); index++ {
+		<-errs
+	}
+
+	return err
+}
+
+// listenerAdd remember the listener for Shutdown(), it return false if the server is already down
+func (socket *SocketConnection) listenerAdd(listener Listener) bool {
+	socket.listenersLock.Lock()
+	defer socket.listenersLock.Unlock()
+
+	if socket.isShutdown() {
+		return false
+	}
+	socket.listeners = append(socket.listeners, listener)
+	return true
+}
+
+func (socket *SocketConnection) listenerRemove(listener Listener) {
+	socket.listenersLock.Lock()
+	defer socket.listenersLock.Unlock()
+
+	for index, existing := range socket.listeners {
+		if existing == listener {
+			socket.listeners = append(socket.listeners[:index], socket.listeners[index+1:]...)
+			return
+		}
+	}
+}
+
+func (socket *SocketConnection) isShutdown() bool {
+	return atomic.LoadInt32(&socket.shutdown) == 1
+}
+
+// Shutdown close all listeners and sessions of the server, the sessions can not be resumed
+func (socket *SocketConnection) Shutdown() {
+
+	socket.listenersLock.Lock()
+	atomic.StoreInt32(&socket.shutdown, 1)
+	listeners := socket.listeners
+	socket.listeners = nil
+	socket.listenersLock.Unlock()
+
+	socket.log.Info("Shutdown server")
+
+	for _, listener := range listeners {
+		listener.Close()
+	}
+
+	for _, session := range socket.sessionList() {
+		atomic.StoreInt32(&session.noResume, 1)
+		session.close()
+	}
+}
+
+// Listener return the name of the listener which accepted this session
+func (socket *SocketConnection) Listener() string {
+	return socket.listenerName
+}
+
+// BusCallbacks connect all sessions of an server with the bus
+//
+// messages of the remote nodes are published on the bus, and the remote nodes get the messages of there subscriptions.
+// If the server can resume sessions, the server subscribe once with ForwardAll, so messages for parked sessions are buffered.
+// The callbacks of cb are called after that
+func BusCallbacks(bus *GBus, cb SocketCallbacks) SocketCallbacks {
+
+	busCallbacks := cb
+	var forwardAllOnce sync.Once
+
+	busCallbacks.OnHandshakeFinished = func(socket *SocketConnection) {
+		if server := socket.server; server != nil && server.options.SessionResume > 0 {
+			forwardAllOnce.Do(func() {
+				bus.Subscribe(server.ID(), "", "", server.ForwardAll)
+			})
+		} else {
+			bus.Subscribe(socket.ID(), "", "", socket.Forward)
+		}
+		if cb.OnHandshakeFinished != nil {
+			cb.OnHandshakeFinished(socket)
+		}
+	}
+
+	busCallbacks.OnMessage = func(socket *SocketConnection, message Msg) {
+		bus.PublishMsg(message)
+		if cb.OnMessage != nil {
+			cb.OnMessage(socket, message)
+		}
+	}
+
+	busCallbacks.OnDisconnect = func(socket *SocketConnection) {
+		bus.UnSubscribeID(socket.ID())
+		if cb.OnDisconnect != nil {
+			cb.OnDisconnect(socket)
+		}
+	}
+
+	return busCallbacks
+}
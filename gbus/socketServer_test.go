@@ -0,0 +1,168 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServeListeners(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+
+	var bus GBus
+	bus.Init()
+	bus.Run()
+
+	unixListener, err := NetListen("unix", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpListener, err := NetListen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// remote nodes can only send status-messages
+	acl, _ := ACLNew(ACLConfig{
+		Rules: []ACLRule{{Action: ACLPublish, Command: "status", Allow: true}},
+	})
+
+	server := SocketNew()
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ServeListeners([]ServerListener{
+			{
+				Name:     "plugins",
+				Listener: unixListener,
+				Options:  &SocketOptions{PeerAllow: &PeerPolicy{UIDs: []uint32{uint32(os.Getuid())}}},
+			},
+			{
+				Name:     "remote",
+				Listener: tcpListener,
+				Options:  &SocketOptions{ACL: acl},
+			},
+		}, BusCallbacks(&bus, SocketCallbacks{}))
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pluginMessages := make(chan Msg, 10)
+	plugin := SocketNew()
+	go plugin.Connect(ctx, filename, "plugin", "plugins", SocketCallbacks{
+		OnMessage: func(socket *SocketConnection, message Msg) {
+			pluginMessages <- message
+		},
+	})
+
+	remoteErrs := make(chan error, 10)
+	remote := SocketNew()
+	go remote.ConnectTransport(ctx, NetTransport{Network: "tcp", Address: tcpListener.(net.Listener).Addr().String()}, "remote", "remotes", SocketCallbacks{
+		OnError: func(socket *SocketConnection, err error) {
+			remoteErrs <- err
+		},
+	})
+
+	// one registry for both listeners
+	sessions := waitForSessions(t, server, 2)
+	listeners := map[string]string{}
+	for _, session := range sessions {
+		listeners[session.RemoteNodeName] = session.Listener
+	}
+	if listeners["plugin"] != "plugins" || listeners["remote"] != "remote" {
+		t.Fatalf("Wrong listeners %v", listeners)
+	}
+
+	// the remote node reach the plugin over the bus
+	remote.SendMessage(Msg{NodeSource: "remote", NodeTarget: "plugin", Command: "status"})
+	expectMessage(t, pluginMessages, "status")
+
+	// but the ACL of the tcp-listener apply
+	remote.SendMessage(Msg{NodeSource: "remote", NodeTarget: "plugin", Command: "shutdown"})
+	select {
+	case err := <-remoteErrs:
+		if remoteErr, ok := err.(*RemoteError); !ok || remoteErr.Code != ErrorCodeACL {
+			t.Fatalf("Expected ACL-error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message was not denied")
+	}
+
+	// shutdown stop everything
+	server.Shutdown()
+	select {
+	case err := <-served:
+		if err != ErrServerClosed {
+			t.Errorf("Expected ErrServerClosed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeListeners still running")
+	}
+	waitForSessions(t, server, 0)
+}
+
+func TestServeListenersResume(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+	listener, err := NetListen("unix", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the listener has its own options, but the server decide about the resume
+	server := SocketNew()
+	server.OptionsSet(SocketOptions{SessionResume: 5 * time.Second})
+	go server.ServeListeners([]ServerListener{
+		{
+			Name:     "plugins",
+			Listener: listener,
+			Options:  &SocketOptions{PeerAllow: &PeerPolicy{UIDs: []uint32{uint32(os.Getuid())}}},
+		},
+	}, SocketCallbacks{})
+	defer server.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := SocketNew()
+	client.OptionsSet(SocketOptions{
+		Reconnect: ReconnectPolicy{InitialBackoff: 10 * time.Millisecond},
+	})
+	go client.Connect(ctx, filename, "plugin", "plugins", SocketCallbacks{})
+
+	sessions := waitForSessions(t, server, 1)
+	server.Session(sessions[0].ID).close()
+
+	// the client resume its session
+	for i := 0; i < 250; i++ {
+		if sessions := server.Sessions(); len(sessions) == 1 {
+			if session := server.Session(sessions[0].ID); session != nil && session.Resumed() {
+				return
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("Session of the listener was not resumed")
+}
@@ -0,0 +1,319 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CapSubscribe is the capability for SUBSCRIBE/UNSUBSCRIBE
+const CapSubscribe = "subscribe"
+
+// ErrSubscribeUnsupported is returned if the remote side don't understand SUBSCRIBE
+var ErrSubscribeUnsupported = errors.New("Remote side does not support subscriptions")
+
+// Subscription is an filter for messages which the remote side of an connection want to get
+//
+// like on the bus, fields with "" means "ignore the value"
+type Subscription struct {
+	NodeTarget  string `json:"t,omitempty"`
+	GroupTarget string `json:"tg,omitempty"`
+	Command     string `json:"c,omitempty"`
+
+	// QoS is the min delivery-guarantee for messages of this subscription
+	QoS int `json:"q,omitempty"`
+}
+
+// Match return true if the message should be delivered to this subscription
+func (sub Subscription) Match(message Msg) bool {
+	if message.NodeTarget != "" && sub.NodeTarget != "" && message.NodeTarget != sub.NodeTarget {
+		return false
+	}
+	if message.GroupTarget != "" && sub.GroupTarget != "" && message.GroupTarget != sub.GroupTarget {
+		return false
+	}
+	if sub.Command != "" && message.Command != sub.Command {
+		return false
+	}
+	return true
+}
+
+// subscriptionsRemove return the list without sub
+func subscriptionsRemove(list []Subscription, sub Subscription) []Subscription {
+	var newList []Subscription
+	for _, existing := range list {
+		if existing != sub {
+			newList = append(newList, existing)
+		}
+	}
+	return newList
+}
+
+// subscriptionsAdd return the list with sub, if it is not already inside
+func subscriptionsAdd(list []Subscription, sub Subscription) []Subscription {
+	for _, existing := range list {
+		if existing == sub {
+			return list
+		}
+	}
+	return append(list, sub)
+}
+
+// Subscribe tell the remote side that we want messages which match sub
+//
+// the subscription is remembered and send again after an reconnect
+func (socket *SocketConnection) Subscribe(sub Subscription) error {
+	return socket.subscriptionChange(cmdSubscribe, sub)
+}
+
+// Unsubscribe remove an subscription which was added with Subscribe
+func (socket *SocketConnection) Unsubscribe(sub Subscription) error {
+	return socket.subscriptionChange(cmdUnsubscribe, sub)
+}
+
+func (socket *SocketConnection) subscriptionChange(command string, sub Subscription) error {
+
+	socket.subscriptionsSendLock.Lock()
+	defer socket.subscriptionsSendLock.Unlock()
+
+	socket.subscriptionsLock.Lock()
+	if command == cmdSubscribe {
+		socket.subscriptions = subscriptionsAdd(socket.subscriptions, sub)
+	} else {
+		socket.subscriptions = subscriptionsRemove(socket.subscriptions, sub)
+	}
+	active := socket.subscriptionsActive
+	socket.subscriptionsLock.Unlock()
+
+	// not connected, we send it after the handshake
+	if !active {
+		return nil
+	}
+	if !socket.HasCapability(CapSubscribe) {
+		return ErrSubscribeUnsupported
+	}
+
+	return socket.subscriptionSend(command, sub)
+}
+
+func (socket *SocketConnection) subscriptionSend(command string, sub Subscription) error {
+
+	payload, _ := json.Marshal(sub)
+
+	return socket.SendMessage(Msg{
+		NodeSource: socket.localNodeName,
+		NodeTarget: socket.remoteNodeName,
+		Command:    command,
+		Payload:    string(payload),
+	})
+}
+
+// Subscriptions return our subscriptions
+func (socket *SocketConnection) Subscriptions() []Subscription {
+	socket.subscriptionsLock.Lock()
+	defer socket.subscriptionsLock.Unlock()
+
+	return append([]Subscription{}, socket.subscriptions...)
+}
+
+// subscriptionsRestore send our subscriptions after the handshake
+func (socket *SocketConnection) subscriptionsRestore() {
+
+	socket.subscriptionsSendLock.Lock()
+	defer socket.subscriptionsSendLock.Unlock()
+
+	socket.subscriptionsLock.Lock()
+	socket.subscriptionsActive = true
+	subscriptions := append([]Subscription{}, socket.subscriptions...)
+	socket.subscriptionsLock.Unlock()
+
+	if len(subscriptions) == 0 {
+		return
+	}
+	if !socket.HasCapability(CapSubscribe) {
+		socket.log.Warn(ErrSubscribeUnsupported)
+		return
+	}
+
+	for _, sub := range subscriptions {
+		if err := socket.subscriptionSend(cmdSubscribe, sub); err != nil {
+			return
+		}
+	}
+}
+
+// subscriptionsInactive is called if the connection is lost, changes are send after the next handshake
+func (socket *SocketConnection) subscriptionsInactive() {
+	socket.subscriptionsLock.Lock()
+	socket.subscriptionsActive = false
+	socket.subscriptionsLock.Unlock()
+}
+
+// remoteSubscriptionsReset is called in the handshake
+//
+// the remote side is subscribed to the node/group it told us in the handshake
+func (socket *SocketConnection) remoteSubscriptionsReset() {
+	socket.subscriptionsLock.Lock()
+	socket.remoteSubscriptions = []Subscription{socket.remoteSubscriptionDefault()}
+	socket.subscriptionsLock.Unlock()
+}
+
+// remoteSubscriptionDefault return the subscription of the handshake
+func (socket *SocketConnection) remoteSubscriptionDefault() Subscription {
+
+	// an signed client can listen for an other node-name than it is
+	nodeTarget := socket.remoteNodeName
+	if socket.remoteListenNode != "" {
+		nodeTarget = socket.remoteListenNode
+	}
+
+	return Subscription{
+		NodeTarget:  nodeTarget,
+		GroupTarget: socket.remoteNodeGroup,
+	}
+}
+
+// remoteSubscriptionsCount return the count of subscriptions without the one of the handshake
+func (socket *SocketConnection) remoteSubscriptionsCount() int {
+
+	handshakeSub := socket.remoteSubscriptionDefault()
+
+	socket.subscriptionsLock.Lock()
+	defer socket.subscriptionsLock.Unlock()
+
+	count := 0
+	for _, sub := range socket.remoteSubscriptions {
+		if sub != handshakeSub {
+			count++
+		}
+	}
+	return count
+}
+
+// RemoteSubscriptions return the subscriptions of the remote side
+func (socket *SocketConnection) RemoteSubscriptions() []Subscription {
+	socket.subscriptionsLock.Lock()
+	defer socket.subscriptionsLock.Unlock()
+
+	return append([]Subscription{}, socket.remoteSubscriptions...)
+}
+
+// Subscribed return true if the remote side subscribed to the message
+func (socket *SocketConnection) Subscribed(message Msg) bool {
+	_, subscribed := socket.subscribedQoS(message)
+	return subscribed
+}
+
+// subscribedQoS return the highest QoS of all subscriptions which match the message
+func (socket *SocketConnection) subscribedQoS(message Msg) (int, bool) {
+	socket.subscriptionsLock.Lock()
+	defer socket.subscriptionsLock.Unlock()
+
+	return subscriptionsMatch(socket.remoteSubscriptions, message)
+}
+
+// subscriptionsMatch return the highest QoS of all subscriptions in list which match the message
+func subscriptionsMatch(list []Subscription, message Msg) (int, bool) {
+
+	qos := QoSAtMostOnce
+	subscribed := false
+	for _, sub := range list {
+		if sub.Match(message) {
+			subscribed = true
+			if sub.QoS > qos {
+				qos = sub.QoS
+			}
+		}
+	}
+	return qos, subscribed
+}
+
+// Forward send an message of the bus to the remote side, if it is subscribed to it
+// the QoS of the message is raised to the QoS of the subscription
+//
+// it can be used directly as callback of the bus with bus.Subscribe(session.ID(), "", "", session.Forward)
+func (socket *SocketConnection) Forward(message *Msg, group, command, payload string) {
+	socket.forward(message, false)
+}
+
+// forward send the message if the remote side subscribed to it, with noWait we never block on an full send-queue
+func (socket *SocketConnection) forward(message *Msg, noWait bool) {
+	qos, subscribed := socket.subscribedQoS(*message)
+	if !subscribed {
+		return
+	}
+
+	forward := *message
+	if qos > forward.QoS {
+		forward.QoS = qos
+	}
+
+	// the buffer of an resumed session is send first
+	if socket.replayAppend(forward) {
+		return
+	}
+	socket.send(forward, noWait)
+}
+
+// subscriptionHandle handle an SUBSCRIBE/UNSUBSCRIBE of the remote side
+func (socket *SocketConnection) subscriptionHandle(message Msg, cb SocketCallbacks) {
+
+	var sub Subscription
+	if err := json.Unmarshal([]byte(message.Payload), &sub); err != nil {
+		socket.log.Error(err)
+		socket.sendError(ErrorCodeSubscribe, err.Error())
+		return
+	}
+
+	socket.log.WithFields(logrus.Fields{
+		"command":     message.Command,
+		"nodeTarget":  sub.NodeTarget,
+		"groupTarget": sub.GroupTarget,
+		"filter":      sub.Command,
+	}).Debug("Subscription changed")
+
+	if message.Command == cmdSubscribe {
+		if err := socket.aclSubscribe(sub); err != nil {
+			socket.log.Warn(err)
+			socket.sendError(ErrorCodeACL, err.Error())
+			return
+		}
+		if err := socket.limitSubscription(cb); err != nil {
+			if err.(*LimitError).Violation.Action == LimitDisconnect {
+				socket.close()
+			}
+			return
+		}
+	}
+
+	socket.subscriptionsLock.Lock()
+	if message.Command == cmdSubscribe {
+		socket.remoteSubscriptions = subscriptionsAdd(socket.remoteSubscriptions, sub)
+	} else {
+		socket.remoteSubscriptions = subscriptionsRemove(socket.remoteSubscriptions, sub)
+	}
+	socket.subscriptionsLock.Unlock()
+
+	if cb.OnSubscriptionChanged != nil {
+		cb.OnSubscriptionChanged(socket)
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionMatch(t *testing.T) {
+
+	sub := Subscription{GroupTarget: "alerts", Command: "fire"}
+
+	if !sub.Match(Msg{NodeTarget: "nodeA", GroupTarget: "alerts", Command: "fire"}) {
+		t.Fatal("Expected match")
+	}
+	if !sub.Match(Msg{Command: "fire"}) {
+		t.Fatal("Messages without target must match")
+	}
+	if sub.Match(Msg{GroupTarget: "alerts", Command: "noise"}) {
+		t.Fatal("Command must not match")
+	}
+	if sub.Match(Msg{GroupTarget: "other", Command: "fire"}) {
+		t.Fatal("Group must not match")
+	}
+}
+
+func TestSubscribeReconnect(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+
+	var bus GBus
+	bus.Init()
+	bus.Run()
+
+	changed := make(chan *SocketConnection, 10)
+	server := SocketNew()
+	go server.Serve(filename, SocketCallbacks{
+		OnHandshakeFinished: func(socket *SocketConnection) {
+			bus.Subscribe(socket.ID(), "", "", socket.Forward)
+		},
+		OnDisconnect: func(socket *SocketConnection) {
+			bus.UnSubscribeID(socket.ID())
+		},
+		OnSubscriptionChanged: func(socket *SocketConnection) {
+			changed <- socket
+		},
+	})
+	waitForSocket(filename)
+	defer server.Shutdown()
+
+	// the subscription is send after the handshake
+	messages := make(chan Msg, 10)
+	client := SocketNew()
+	client.OptionsSet(SocketOptions{
+		Reconnect: ReconnectPolicy{InitialBackoff: 10 * time.Millisecond},
+	})
+	client.Subscribe(Subscription{GroupTarget: "alerts", Command: "fire"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.Connect(ctx, filename, "nodeA", "clients", SocketCallbacks{
+		OnMessage: func(socket *SocketConnection, message Msg) {
+			messages <- message
+		},
+	})
+
+	waitChanged := func() *SocketConnection {
+		select {
+		case session := <-changed:
+			return session
+		case <-time.After(5 * time.Second):
+			t.Fatal("Subscription was not send")
+		}
+		return nil
+	}
+
+	session := waitChanged()
+	if len(session.RemoteSubscriptions()) != 2 {
+		t.Fatalf("Expected handshake- and alert-subscription, got %v", session.RemoteSubscriptions())
+	}
+
+	bus.PublishPayload("server", "nodeB", "", "alerts", "noise", "")
+	bus.PublishPayload("server", "nodeB", "", "alerts", "fire", "")
+	expectMessage(t, messages, "fire")
+
+	// after an reconnect the subscription is restored
+	server.DisconnectNode("nodeA")
+	waitChanged()
+
+	bus.PublishPayload("server", "nodeB", "", "alerts", "fire", "")
+	expectMessage(t, messages, "fire")
+
+	// the filter of the handshake still work
+	client.Unsubscribe(Subscription{GroupTarget: "alerts", Command: "fire"})
+	waitChanged()
+
+	bus.PublishPayload("server", "nodeB", "", "alerts", "fire", "")
+	bus.PublishPayload("server", "nodeA", "", "clients", "direct", "")
+	expectMessage(t, messages, "direct")
+}
+
+func TestControlCommandNamespace(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "x.sock")
+
+	messages := make(chan Msg, 10)
+	server := SocketNew()
+	go server.Serve(filename, SocketCallbacks{
+		OnMessage: func(socket *SocketConnection, message Msg) {
+			messages <- message
+		},
+	})
+	defer server.Shutdown()
+	waitForSocket(filename)
+
+	errs := make(chan error, 10)
+	client := SocketNew()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.Connect(ctx, filename, "nodeA", "clients", SocketCallbacks{
+		OnError: func(socket *SocketConnection, err error) {
+			errs <- err
+		},
+	})
+	waitForSessions(t, server, 1)
+
+	// only commands with the prefix belong to the protocol
+	for _, command := range []string{"SUBSCRIBE", "ERROR", "PING", "HELO"} {
+		client.SendMessage(Msg{NodeSource: "nodeA", Command: command, Payload: "app"})
+		expectMessage(t, messages, command)
+	}
+
+	select {
+	case err := <-errs:
+		t.Fatalf("Application-command was handled as control-command: %s", err)
+	default:
+	}
+}
@@ -0,0 +1,300 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// ErrListenerClosed is returned by Accept() if the listener was closed
+var ErrListenerClosed = errors.New("Listener is closed")
+
+// Transport create connections for an client
+//
+// Dial is called for every ( re- ) connect
+type Transport interface {
+	Dial(ctx context.Context) (net.Conn, error)
+}
+
+// Listener accept connections for an server, every net.Listener is an Listener
+type Listener interface {
+	Accept() (net.Conn, error)
+	Close() error
+}
+
+// ################################# net #################################
+
+// NetTransport dial an network-address like "unix" or "tcp"
+type NetTransport struct {
+	Network string
+	Address string
+}
+
+// Dial connect to the address
+func (transport NetTransport) Dial(ctx context.Context) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, transport.Network, transport.Address)
+}
+
+// NetListen listen on an network-address
+//
+// an stale unix-socket is removed before, but never an file which is not an socket or an socket which is in use.
+// Unix-addresses which start with "@" are in the abstract namespace of linux, they have no file
+func NetListen(network, address string) (Listener, error) {
+
+	if network == "unix" && !isAbstractSocket(address) {
+		if err := unixSocketRemoveStale(address); err != nil {
+			return nil, err
+		}
+	}
+
+	return net.Listen(network, address)
+}
+
+// ################################# pipe #################################
+
+// PipeTransport connect an client and an server inside the same process without an socket
+//
+// it is Transport and Listener at the same time, every Dial() is returned by Accept()
+type PipeTransport struct {
+	conns     chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// PipeTransportNew create a new in-memory transport
+func PipeTransportNew() *PipeTransport {
+	return &PipeTransport{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Dial create a new connection and pass the other end to Accept()
+func (transport *PipeTransport) Dial(ctx context.Context) (net.Conn, error) {
+
+	local, remote := net.Pipe()
+
+	select {
+	case transport.conns <- remote:
+		return local, nil
+	case <-transport.closed:
+		return nil, ErrListenerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Accept wait for the next Dial()
+func (transport *PipeTransport) Accept() (net.Conn, error) {
+	select {
+	case conn := <-transport.conns:
+		return conn, nil
+	case <-transport.closed:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close stop Accept() and Dial()
+func (transport *PipeTransport) Close() error {
+	transport.closeOnce.Do(func() {
+		close(transport.closed)
+	})
+	return nil
+}
+
+// ################################# io.ReadWriteCloser #################################
+
+// ConnFromReadWriteCloser create an connection from an stream like the pipes of an process
+//
+// the stream is connected over an net.Pipe(), so deadlines work like on every other connection.
+// If the connection is closed, the stream is closed
+func ConnFromReadWriteCloser(rwc io.ReadWriteCloser) net.Conn {
+
+	local, remote := net.Pipe()
+
+	// stream -> connection
+	go func() {
+		io.Copy(remote, rwc)
+		remote.Close()
+	}()
+
+	// connection -> stream
+	go func() {
+		io.Copy(rwc, remote)
+		rwc.Close()
+	}()
+
+	return local
+}
+
+// rwcJoin join an reader and an writer to one stream
+type rwcJoin struct {
+	io.ReadCloser
+	io.WriteCloser
+}
+
+func (rwc rwcJoin) Close() error {
+	rwc.WriteCloser.Close()
+	return rwc.ReadCloser.Close()
+}
+
+// ################################# stdio #################################
+
+// StdioListener accept one connection over stdin/stdout of our process
+//
+// this is used on the remote side of an CommandTransport, after the connection is closed Accept() return ErrListenerClosed
+type StdioListener struct {
+	once      sync.Once
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// StdioListenerNew create a listener for stdin/stdout
+func StdioListenerNew() *StdioListener {
+	return &StdioListener{
+		closed: make(chan struct{}),
+	}
+}
+
+// Accept return the connection over stdin/stdout the first time, after that it block until Close()
+func (listener *StdioListener) Accept() (net.Conn, error) {
+
+	var conn net.Conn
+	listener.once.Do(func() {
+		conn = ConnFromReadWriteCloser(rwcJoin{
+			ReadCloser:  os.Stdin,
+			WriteCloser: &stdioCloser{WriteCloser: os.Stdout, listener: listener},
+		})
+	})
+	if conn != nil {
+		return conn, nil
+	}
+
+	<-listener.closed
+	return nil, ErrListenerClosed
+}
+
+// Close the listener
+func (listener *StdioListener) Close() error {
+	listener.closeOnce.Do(func() {
+		close(listener.closed)
+	})
+	return nil
+}
+
+// stdioCloser close the listener together with stdout, so Serve() return if the connection is gone
+type stdioCloser struct {
+	io.WriteCloser
+	listener *StdioListener
+}
+
+func (closer *stdioCloser) Close() error {
+	closer.listener.Close()
+	return closer.WriteCloser.Close()
+}
+
+// ################################# command #################################
+
+// CommandTransport start an process and talk over its stdin/stdout
+//
+// the process must serve an StdioListener, with an "ssh"-command the bus can be tunneled without an open port
+type CommandTransport struct {
+	Name string
+	Args []string
+
+	// Env is the environment of the process ( nil means the environment of our process )
+	Env []string
+}
+
+// SSHTransportNew return an transport which run remoteCommand with ssh on host
+func SSHTransportNew(host string, remoteCommand ...string) CommandTransport {
+	return CommandTransport{
+		Name: "ssh",
+		Args: append([]string{"-T", "-o", "BatchMode=yes", host}, remoteCommand...),
+	}
+}
+
+// Dial start the process, it is killed if ctx is done
+func (transport CommandTransport) Dial(ctx context.Context) (net.Conn, error) {
+
+	cmd := exec.CommandContext(ctx, transport.Name, transport.Args...)
+	cmd.Env = transport.Env
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return ConnFromReadWriteCloser(&commandStream{
+		rwcJoin: rwcJoin{ReadCloser: stdout, WriteCloser: stdin},
+		cmd:     cmd,
+	}), nil
+}
+
+// commandStream wait for the process if the stream is closed
+type commandStream struct {
+	rwcJoin
+	cmd       *exec.Cmd
+	closeOnce sync.Once
+}
+
+// Close stdin, so the process can exit, it is killed if it don't exit in time
+//
+// Wait close stdout, so we read stdout until the process is gone before we wait for it
+func (stream *commandStream) Close() error {
+	stream.closeOnce.Do(func() {
+		stream.WriteCloser.Close()
+
+		drained := make(chan struct{})
+		go func() {
+			io.Copy(ioutil.Discard, stream.ReadCloser)
+			close(drained)
+		}()
+
+		select {
+		case <-drained:
+		case <-time.After(5 * time.Second):
+			stream.cmd.Process.Kill()
+
+			// an child of the process can still hold stdout
+			stream.ReadCloser.Close()
+			<-drained
+		}
+
+		stream.cmd.Wait()
+	})
+	return nil
+}
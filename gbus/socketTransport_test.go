@@ -0,0 +1,146 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// transportPing connect over the transport, send an ping and wait for the answer of the echo-server
+func transportPing(t *testing.T, transport Transport) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages := make(chan Msg, 10)
+	client := SocketNew()
+	go client.ConnectTransport(ctx, transport, "testnode", "test", SocketCallbacks{
+		OnHandshakeFinished: func(socket *SocketConnection) {
+			socket.SendMessage(Msg{NodeSource: "testnode", Command: "ping"})
+		},
+		OnMessage: func(socket *SocketConnection, message Msg) {
+			messages <- message
+		},
+	})
+
+	expectMessage(t, messages, "echo-ping")
+}
+
+// echoServer answer every message with "echo-<command>"
+func echoServer(listener Listener) {
+	server := SocketNew()
+	server.ServeListener(listener, SocketCallbacks{
+		OnMessage: func(socket *SocketConnection, message Msg) {
+			socket.SendMessage(Msg{NodeSource: "echo", Command: "echo-" + message.Command})
+		},
+	})
+}
+
+func TestPipeTransport(t *testing.T) {
+
+	pipe := PipeTransportNew()
+	defer pipe.Close()
+
+	go echoServer(pipe)
+	transportPing(t, pipe)
+}
+
+func TestTCPTransport(t *testing.T) {
+
+	listener, err := NetListen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go echoServer(listener)
+	transportPing(t, NetTransport{Network: "tcp", Address: listener.(net.Listener).Addr().String()})
+}
+
+// TestStdioHelperProcess is not an real test, it is the echo-server for TestCommandTransport
+func TestStdioHelperProcess(t *testing.T) {
+	if os.Getenv("GBUS_STDIO_HELPER") != "1" {
+		return
+	}
+
+	logrus.SetLevel(logrus.WarnLevel)
+	echoServer(StdioListenerNew())
+	os.Exit(0)
+}
+
+func TestCommandTransport(t *testing.T) {
+
+	transportPing(t, CommandTransport{
+		Name: os.Args[0],
+		Args: []string{"-test.run=^TestStdioHelperProcess$"},
+		Env:  append(os.Environ(), "GBUS_STDIO_HELPER=1"),
+	})
+}
+
+func TestCommandTransportClose(t *testing.T) {
+
+	// the process write a lot after stdin is closed, it only exit if somebody read it
+	conn, err := CommandTransport{
+		Name: "sh",
+		Args: []string{"-c", "cat >/dev/null; seq 1 200000"},
+	}.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		conn.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Close waited for the kill-timeout")
+	}
+}
+
+func TestStdioListenerClose(t *testing.T) {
+
+	listener := StdioListenerNew()
+
+	var wait sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			listener.Close()
+		}()
+	}
+	wait.Wait()
+
+	select {
+	case <-listener.closed:
+	default:
+		t.Fatal("Listener was not closed")
+	}
+}
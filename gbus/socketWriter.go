@@ -0,0 +1,399 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of the send-queue of an connection
+const (
+	DefaultSendQueueSize = 256
+	DefaultWriteTimeout  = 10 * time.Second
+	DefaultBatchBytes    = 64 * 1024
+)
+
+// Policies what SendMessage do if the send-queue is full
+const (
+	SendBlock      = "block"      // wait until there is room again ( max WriteTimeout )
+	SendDropNewest = "dropNewest" // the new message is dropped and ErrSendQueueFull is returned
+	SendDropOldest = "dropOldest" // the oldest queued message is dropped
+)
+
+// errors of SendMessage
+var (
+	ErrNotConnected  = errors.New("Not connected")
+	ErrSendQueueFull = errors.New("Send queue is full")
+	ErrSendTimeout   = errors.New("Timeout while waiting for room in the send queue")
+)
+
+// SendStats are the metrics of the send-queue of the current connection
+type SendStats struct {
+	Queued  int    // frames which wait to be written
+	Sent    uint64 // frames which was written to the connection
+	Dropped uint64 // frames which was dropped because the queue was full
+	Writes  uint64 // writes to the connection, with batching this is lower than Sent
+}
+
+// writerFrame is an encoded frame which wait to be written
+type writerFrame struct {
+	data      []byte
+	batchable bool // it is an length-frame, so it can be placed inside an batch-frame
+	noWait    bool // don't block if the queue is full, also if the policy is SendBlock
+}
+
+// socketWriter is the only one who write to the connection
+//
+// every frame is written completely, so concurrent senders can not mix there bytes
+type socketWriter struct {
+	conn    net.Conn
+	frames  chan writerFrame
+	policy  string
+	timeout time.Duration // 0 means no timeout
+
+	// coalescing of queued frames into a single write
+	batchMessages int // 0 means no batching
+	batchBytes    int
+	batchDelay    time.Duration
+
+	// the remote side can read batch-frames
+	batchFrames  int32 // atomic
+	batchMaxSize int
+
+	stopOnce sync.Once
+	stop     chan struct{} // write what is queued and exit
+	finished chan struct{} // the goroutine is gone
+
+	errLock sync.Mutex
+	err     error
+
+	sent    uint64 // atomic
+	dropped uint64 // atomic
+	writes  uint64 // atomic
+}
+
+func socketWriterNew(conn net.Conn, options SocketOptions) *socketWriter {
+
+	size := options.SendQueueSize
+	if size <= 0 {
+		size = DefaultSendQueueSize
+	}
+
+	timeout := options.WriteTimeout
+	if timeout == 0 {
+		timeout = DefaultWriteTimeout
+	}
+	if timeout < 0 {
+		timeout = 0
+	}
+
+	batchBytes := options.BatchBytes
+	if batchBytes <= 0 {
+		batchBytes = DefaultBatchBytes
+	}
+
+	newWriter := socketWriter{
+		conn:          conn,
+		frames:        make(chan writerFrame, size),
+		policy:        options.SendPolicy,
+		timeout:       timeout,
+		batchMessages: options.BatchMessages,
+		batchBytes:    batchBytes,
+		batchDelay:    options.BatchDelay,
+		stop:          make(chan struct{}),
+		finished:      make(chan struct{}),
+	}
+
+	go newWriter.loop()
+	return &newWriter
+}
+
+// loop write frames until the writer is stopped or the connection is broken
+func (writer *socketWriter) loop() {
+	defer close(writer.finished)
+
+	for {
+		select {
+		case frame := <-writer.frames:
+			if !writer.write(writer.collect(frame)) {
+				return
+			}
+
+		case <-writer.stop:
+			// write what is left, so an ERROR before close reach the remote side
+			var frames []writerFrame
+			for {
+				select {
+				case frame := <-writer.frames:
+					frames = append(frames, frame)
+					continue
+				default:
+				}
+				break
+			}
+			if len(frames) > 0 {
+				writer.write(frames)
+			}
+			return
+		}
+	}
+}
+
+// collect return the frame and the following queued frames until the batch is full
+//
+// we wait max batchDelay for more frames
+func (writer *socketWriter) collect(first writerFrame) []writerFrame {
+
+	frames := []writerFrame{first}
+	if writer.batchMessages <= 1 {
+		return frames
+	}
+
+	var delay <-chan time.Time
+	if writer.batchDelay > 0 {
+		timer := time.NewTimer(writer.batchDelay)
+		defer timer.Stop()
+		delay = timer.C
+	}
+
+	size := len(first.data)
+	for len(frames) < writer.batchMessages && size < writer.batchBytes {
+
+		// what is already there
+		select {
+		case frame := <-writer.frames:
+			frames = append(frames, frame)
+			size = size + len(frame.data)
+			continue
+		default:
+		}
+
+		if delay == nil {
+			break
+		}
+
+		// wait for more
+		select {
+		case frame := <-writer.frames:
+			frames = append(frames, frame)
+			size = size + len(frame.data)
+			continue
+		case <-delay:
+		case <-writer.stop:
+		}
+		break
+	}
+
+	return frames
+}
+
+// batchFramesEnable is called after the handshake, if the remote side can read batch-frames
+func (writer *socketWriter) batchFramesEnable(maxSize int) {
+	writer.batchMaxSize = maxSize
+	atomic.StoreInt32(&writer.batchFrames, 1)
+}
+
+// encode the frames into one buffer
+//
+// length-frames are wrapped into batch-frames if the remote side support it
+func (writer *socketWriter) encode(frames []writerFrame) []byte {
+
+	if len(frames) == 1 {
+		return frames[0].data
+	}
+
+	batchFrames := atomic.LoadInt32(&writer.batchFrames) == 1
+
+	var buffer []byte
+	var batch [][]byte
+	batchSize := 0
+
+	flushBatch := func() {
+		if len(batch) == 1 {
+			buffer = append(buffer, batch[0]...)
+		} else if len(batch) > 1 {
+			buffer = append(buffer, batchEncode(batch)...)
+		}
+		batch = nil
+		batchSize = 0
+	}
+
+	for _, frame := range frames {
+		if !batchFrames || !frame.batchable {
+			flushBatch()
+			buffer = append(buffer, frame.data...)
+			continue
+		}
+
+		// an batch-frame must not be bigger than the max frame size of the remote side
+		if batchSize+len(frame.data) > writer.batchMaxSize {
+			flushBatch()
+		}
+		batch = append(batch, frame.data)
+		batchSize = batchSize + len(frame.data)
+	}
+	flushBatch()
+
+	return buffer
+}
+
+// write return false if the connection is broken
+func (writer *socketWriter) write(frames []writerFrame) bool {
+
+	if writer.timeout > 0 {
+		writer.conn.SetWriteDeadline(time.Now().Add(writer.timeout))
+	}
+
+	if _, err := writer.conn.Write(writer.encode(frames)); err != nil {
+		writer.errLock.Lock()
+		writer.err = err
+		writer.errLock.Unlock()
+
+		// the reader will notice it
+		writer.conn.Close()
+		return false
+	}
+
+	atomic.AddUint64(&writer.sent, uint64(len(frames)))
+	atomic.AddUint64(&writer.writes, 1)
+	return true
+}
+
+// errGet return why the writer is gone
+func (writer *socketWriter) errGet() error {
+	writer.errLock.Lock()
+	defer writer.errLock.Unlock()
+
+	if writer.err != nil {
+		return writer.err
+	}
+	return ErrNotConnected
+}
+
+// enqueue add the frame to the send-queue with the policy of the writer
+func (writer *socketWriter) enqueue(frame writerFrame) error {
+
+	select {
+	case <-writer.stop:
+		return ErrNotConnected
+	case <-writer.finished:
+		return writer.errGet()
+	default:
+	}
+
+	policy := writer.policy
+	if frame.noWait && policy != SendDropOldest {
+		policy = SendDropNewest
+	}
+
+	switch policy {
+
+	case SendDropNewest:
+		select {
+		case writer.frames <- frame:
+			return nil
+		default:
+			atomic.AddUint64(&writer.dropped, 1)
+			return ErrSendQueueFull
+		}
+
+	case SendDropOldest:
+		for {
+			select {
+			case writer.frames <- frame:
+				return nil
+			default:
+			}
+
+			select {
+			case <-writer.frames:
+				atomic.AddUint64(&writer.dropped, 1)
+			default:
+			}
+		}
+
+	default:
+		var timeout <-chan time.Time
+		if writer.timeout > 0 {
+			timer := time.NewTimer(writer.timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case writer.frames <- frame:
+			return nil
+		case <-writer.finished:
+			return writer.errGet()
+		case <-timeout:
+			return ErrSendTimeout
+		}
+	}
+}
+
+// close write the queued frames and close the connection
+//
+// we wait max the write-timeout for the queued frames
+func (writer *socketWriter) close() {
+
+	writer.stopOnce.Do(func() {
+		close(writer.stop)
+	})
+
+	wait := writer.timeout
+	if wait <= 0 {
+		wait = DefaultWriteTimeout
+	}
+
+	select {
+	case <-writer.finished:
+	case <-time.After(wait):
+	}
+
+	writer.conn.Close()
+}
+
+func (writer *socketWriter) stats() SendStats {
+	return SendStats{
+		Queued:  len(writer.frames),
+		Sent:    atomic.LoadUint64(&writer.sent),
+		Dropped: atomic.LoadUint64(&writer.dropped),
+		Writes:  atomic.LoadUint64(&writer.writes),
+	}
+}
+
+// writerGet return the writer of the current connection
+func (socket *SocketConnection) writerGet() *socketWriter {
+	socket.writerLock.Lock()
+	defer socket.writerLock.Unlock()
+	return socket.writer
+}
+
+// SendStats return the metrics of the send-queue of the current connection
+func (socket *SocketConnection) SendStats() SendStats {
+	writer := socket.writerGet()
+	if writer == nil {
+		return SendStats{}
+	}
+	return writer.stats()
+}
@@ -0,0 +1,244 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package gbus
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// waitForSent wait until the writer count sent frames, the last write maybe not returned yet
+func waitForSent(socket *SocketConnection, sent uint64) SendStats {
+	for i := 0; i < 100 && socket.SendStats().Sent < sent; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return socket.SendStats()
+}
+
+func TestSendConcurrent(t *testing.T) {
+
+	sender, reciever := pipeSockets(FramingLength, SocketOptions{DisableCompression: true})
+
+	const senders = 10
+	const messages = 50
+
+	var wait sync.WaitGroup
+	for s := 0; s < senders; s++ {
+		wait.Add(1)
+		go func(s int) {
+			defer wait.Done()
+			for i := 0; i < messages; i++ {
+				err := sender.SendMessage(Msg{
+					NodeSource: "sender",
+					Command:    fmt.Sprintf("%d-%d", s, i),
+					Payload:    strings.Repeat("x", 3000),
+				})
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}(s)
+	}
+
+	// every sender must arrive in order and no frame is broken
+	next := make([]int, senders)
+	for n := 0; n < senders*messages; n++ {
+		message, err := reciever.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var s, i int
+		fmt.Sscanf(message.Command, "%d-%d", &s, &i)
+		if next[s] != i {
+			t.Fatalf("Expected %d-%d, got %s", s, next[s], message.Command)
+		}
+		next[s]++
+	}
+
+	wait.Wait()
+	if stats := waitForSent(sender, senders*messages); stats.Sent != senders*messages {
+		t.Fatalf("Wrong stats %+v", stats)
+	}
+}
+
+func TestSendDropNewest(t *testing.T) {
+
+	// nobody read from the other side
+	left, right := net.Pipe()
+	defer right.Close()
+
+	sender := SocketNew()
+	sender.OptionsSet(SocketOptions{SendQueueSize: 2, SendPolicy: SendDropNewest})
+	sender.connSet(left)
+
+	var lastErr error
+	for i := 0; i < 10; i++ {
+		if err := sender.SendMessage(Msg{NodeSource: "sender", Command: "full"}); err != nil {
+			lastErr = err
+		}
+	}
+	if lastErr != ErrSendQueueFull {
+		t.Fatalf("Expected full queue, got %v", lastErr)
+	}
+	if sender.SendStats().Dropped == 0 {
+		t.Fatal("Expected dropped messages")
+	}
+}
+
+func TestSendBlockTimeout(t *testing.T) {
+
+	left, right := net.Pipe()
+	defer right.Close()
+
+	sender := SocketNew()
+	sender.OptionsSet(SocketOptions{SendQueueSize: 1, WriteTimeout: 100 * time.Millisecond})
+	sender.connSet(left)
+
+	// the writer give up after the timeout, so SendMessage must fail
+	done := make(chan error, 1)
+	go func() {
+		for {
+			if err := sender.SendMessage(Msg{NodeSource: "sender", Command: "block"}); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("SendMessage blocked forever")
+	}
+}
+
+func TestSendBatching(t *testing.T) {
+
+	options := SocketOptions{BatchMessages: 32, BatchDelay: 50 * time.Millisecond}
+	server, client, serverErr, clientErr := pipeHandshake(options, options)
+	if serverErr != nil || clientErr != nil {
+		t.Fatal(serverErr, clientErr)
+	}
+	if !client.HasCapability(CapBatch) {
+		t.Fatalf("Batch was not negotiated %v", client.Capabilities())
+	}
+
+	const messages = 100
+	for i := 0; i < messages; i++ {
+		client.SendMessage(Msg{NodeSource: "testnode", Command: fmt.Sprintf("cmd%d", i)})
+	}
+
+	for i := 0; i < messages; i++ {
+		message, err := server.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Command != fmt.Sprintf("cmd%d", i) {
+			t.Fatalf("Expected cmd%d, got %s", i, message.Command)
+		}
+	}
+
+	// the OLEH is one write, the messages are coalesced
+	stats := waitForSent(client, messages+1)
+	if stats.Sent != messages+1 || stats.Writes > 10 {
+		t.Fatalf("Messages was not batched %+v", stats)
+	}
+}
+
+// benchmarkSockets return connected sockets after the handshake
+func benchmarkSockets(b *testing.B, options SocketOptions) (*SocketConnection, *SocketConnection) {
+	server, client, serverErr, clientErr := pipeHandshake(options, options)
+	if serverErr != nil || clientErr != nil {
+		b.Fatal(serverErr, clientErr)
+	}
+	return server, client
+}
+
+var benchmarkBatching = []struct {
+	name    string
+	options SocketOptions
+}{
+	{"off", SocketOptions{}},
+	{"on", SocketOptions{BatchMessages: 64}},
+	{"delay", SocketOptions{BatchMessages: 64, BatchDelay: time.Millisecond}},
+}
+
+// BenchmarkSendThroughput send b.N messages as fast as possible
+func BenchmarkSendThroughput(b *testing.B) {
+	logrus.SetLevel(logrus.WarnLevel)
+
+	for _, bench := range benchmarkBatching {
+		b.Run(bench.name, func(b *testing.B) {
+			server, client := benchmarkSockets(b, bench.options)
+			message := Msg{NodeSource: "testnode", Command: "bench", Payload: strings.Repeat("x", 100)}
+
+			done := make(chan struct{})
+			go func() {
+				for i := 0; i < b.N; i++ {
+					if _, err := server.ReadMessage(); err != nil {
+						b.Error(err)
+						break
+					}
+				}
+				close(done)
+			}()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				client.SendMessage(message)
+			}
+			<-done
+			b.StopTimer()
+
+			client.close()
+			server.close()
+		})
+	}
+}
+
+// BenchmarkSendLatency send one message and wait until it arrive
+func BenchmarkSendLatency(b *testing.B) {
+	logrus.SetLevel(logrus.WarnLevel)
+
+	for _, bench := range benchmarkBatching {
+		b.Run(bench.name, func(b *testing.B) {
+			server, client := benchmarkSockets(b, bench.options)
+			message := Msg{NodeSource: "testnode", Command: "bench", Payload: strings.Repeat("x", 100)}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				client.SendMessage(message)
+				if _, err := server.ReadMessage(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			client.close()
+			server.close()
+		})
+	}
+}
@@ -19,21 +19,34 @@ along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
 package gbus
 
 import (
-	"sync"
+	"context"
+	"net"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// waitForSocket wait until the server accept connections
+func waitForSocket(filename string) {
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("unix", filename); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
 func TestSocketHandshake(t *testing.T) {
 	logrus.SetLevel(logrus.DebugLevel)
 
-	var finished sync.Mutex
-	finished.Lock()
+	filename := filepath.Join(t.TempDir(), "x.sock")
+	finished := make(chan struct{}, 1)
 
 	server := SocketNew()
-	go server.Serve("/tmp/inttest.sock", SocketCallbacks{
+	go server.Serve(filename, SocketCallbacks{
 		OnHandshakeFinished: func(socket *SocketConnection) {
 			if socket.RemoteNodeName() != "testnode" {
 				t.Fail()
@@ -41,38 +54,47 @@ func TestSocketHandshake(t *testing.T) {
 			if socket.RemoteNodeGroup() != "test" {
 				t.Fail()
 			}
-			finished.Unlock()
+			finished <- struct{}{}
 		},
 	})
+	defer server.Shutdown()
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	client := SocketNew()
-	go client.Connect("/tmp/inttest.sock", "testnode", "test", SocketCallbacks{})
+	go client.Connect(ctx, filename, "testnode", "test", SocketCallbacks{})
 
-	finished.Lock()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handshake not finished")
+	}
 }
 
 func TestMessage(t *testing.T) {
 	logrus.SetLevel(logrus.DebugLevel)
 
-	var finished sync.Mutex
-	finished.Lock()
+	filename := filepath.Join(t.TempDir(), "x.sock")
+	finished := make(chan struct{}, 1)
 
 	server := SocketNew()
-	go server.Serve("/tmp/inttest.sock", SocketCallbacks{
+	go server.Serve(filename, SocketCallbacks{
 		OnMessage: func(socket *SocketConnection, message Msg) {
 
 			if message.Command != "ping" {
 				t.Fail()
 			}
-			finished.Unlock()
+			finished <- struct{}{}
 			return
 		},
 	})
+	waitForSocket(filename)
+	defer server.Shutdown()
 
-	time.Sleep(time.Second * 2)
-
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	client := SocketNew()
-	go client.Connect("/tmp/inttest.sock", "testnode", "test", SocketCallbacks{
+	go client.Connect(ctx, filename, "testnode", "test", SocketCallbacks{
 		OnHandshakeFinished: func(socket *SocketConnection) {
 			socket.SendMessage(Msg{
 				NodeSource:  "testnode",
@@ -84,6 +106,9 @@ func TestMessage(t *testing.T) {
 		},
 	})
 
-	finished.Lock()
-
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message not recieved")
+	}
 }
@@ -0,0 +1,227 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package nodekey provide the Ed25519-keypair of an node and a store of trusted keys of other nodes
+package nodekey
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/gopilot/lib/config"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// ErrDecrypt is returned if data could not be decrypted
+var ErrDecrypt = errors.New("Could not decrypt data")
+
+// Identity is the keypair of an node
+//
+// PublicKey is used for signatures, BoxPublicKey for encryption ( NaCl box )
+type Identity struct {
+	NodeName      string
+	PublicKey     ed25519.PublicKey
+	privateKey    ed25519.PrivateKey
+	BoxPublicKey  *[32]byte
+	boxPrivateKey *[32]byte
+}
+
+// identityFile is how the keypair is stored on disk
+type identityFile struct {
+	NodeName      string `json:"node"`
+	PublicKey     string `json:"publicKey"`
+	PrivateKey    string `json:"privateKey"`
+	BoxPublicKey  string `json:"boxPublicKey,omitempty"`
+	BoxPrivateKey string `json:"boxPrivateKey,omitempty"`
+}
+
+// IdentityFilename return the file where the keypair of nodeName is stored
+func IdentityFilename(nodeName string) string {
+	return filepath.Join(config.ConfigPath, fmt.Sprintf("node_%s.key", nodeName))
+}
+
+// IdentityLoad will load the keypair of nodeName from the config-path
+// if no keypair exist, a new one is created and saved
+func IdentityLoad(nodeName string) (*Identity, error) {
+
+	filename := IdentityFilename(nodeName)
+
+	byteValue, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return identityCreate(nodeName, filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var stored identityFile
+	if err := json.Unmarshal(byteValue, &stored); err != nil {
+		return nil, err
+	}
+	if stored.NodeName != nodeName {
+		return nil, fmt.Errorf("Keyfile '%s' belongs to node '%s'", filename, stored.NodeName)
+	}
+
+	privateKey, err := base64.StdEncoding.DecodeString(stored.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return nil, errors.New("Private key has the wrong size")
+	}
+
+	newIdentity := Identity{
+		NodeName:   nodeName,
+		privateKey: ed25519.PrivateKey(privateKey),
+	}
+	newIdentity.PublicKey = newIdentity.privateKey.Public().(ed25519.PublicKey)
+
+	// keyfiles of older versions don't contain an box-key
+	if stored.BoxPrivateKey == "" {
+		newIdentity.BoxPublicKey, newIdentity.boxPrivateKey, err = box.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return &newIdentity, newIdentity.save(filename)
+	}
+
+	boxPrivateKey, err := decodeBoxKey(stored.BoxPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	newIdentity.boxPrivateKey = boxPrivateKey
+	newIdentity.BoxPublicKey = new([32]byte)
+	curve25519.ScalarBaseMult(newIdentity.BoxPublicKey, boxPrivateKey)
+
+	return &newIdentity, nil
+}
+
+func identityCreate(nodeName, filename string) (*Identity, error) {
+
+	var newIdentity Identity
+	var err error
+
+	newIdentity.NodeName = nodeName
+	newIdentity.PublicKey, newIdentity.privateKey, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	newIdentity.BoxPublicKey, newIdentity.boxPrivateKey, err = box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := newIdentity.save(filename); err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"prefix":   "NODEKEY",
+		"nodename": nodeName,
+		"file":     filename,
+	}).Info("Created new node keypair")
+
+	return &newIdentity, nil
+}
+
+// save write the keypair to filename
+func (identity *Identity) save(filename string) error {
+
+	byteValue, _ := json.MarshalIndent(identityFile{
+		NodeName:      identity.NodeName,
+		PublicKey:     base64.StdEncoding.EncodeToString(identity.PublicKey),
+		PrivateKey:    base64.StdEncoding.EncodeToString(identity.privateKey),
+		BoxPublicKey:  base64.StdEncoding.EncodeToString(identity.BoxPublicKey[:]),
+		BoxPrivateKey: base64.StdEncoding.EncodeToString(identity.boxPrivateKey[:]),
+	}, "", "    ")
+
+	// only we should read our private key
+	return ioutil.WriteFile(filename, byteValue, 0600)
+}
+
+// PublicKeyString return the public key as base64
+func (identity *Identity) PublicKeyString() string {
+	return base64.StdEncoding.EncodeToString(identity.PublicKey)
+}
+
+// BoxPublicKeyString return the public box-key as base64
+func (identity *Identity) BoxPublicKeyString() string {
+	return base64.StdEncoding.EncodeToString(identity.BoxPublicKey[:])
+}
+
+// Sign will sign data with the private key
+func (identity *Identity) Sign(data []byte) []byte {
+	return ed25519.Sign(identity.privateKey, data)
+}
+
+// Verify check the signature of data with the publicKey
+func Verify(publicKey ed25519.PublicKey, data, signature []byte) bool {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(publicKey, data, signature)
+}
+
+// Seal encrypt data for the owner of peersBoxKey, the nonce is prepended to the result
+func (identity *Identity) Seal(data []byte, peersBoxKey *[32]byte) ([]byte, error) {
+
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+
+	return box.Seal(nonce[:], data, &nonce, peersBoxKey, identity.boxPrivateKey), nil
+}
+
+// Open decrypt data which was sealed by the owner of peersBoxKey for us
+func (identity *Identity) Open(sealed []byte, peersBoxKey *[32]byte) ([]byte, error) {
+
+	if len(sealed) < 24+box.Overhead {
+		return nil, ErrDecrypt
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], sealed[:24])
+
+	data, ok := box.Open(nil, sealed[24:], &nonce, peersBoxKey, identity.boxPrivateKey)
+	if !ok {
+		return nil, ErrDecrypt
+	}
+	return data, nil
+}
+
+func decodeBoxKey(boxKey string) (*[32]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(boxKey)
+	if err != nil || len(key) != 32 {
+		return nil, ErrKeyInvalid
+	}
+
+	var newKey [32]byte
+	copy(newKey[:], key)
+	return &newKey, nil
+}
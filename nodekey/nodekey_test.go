@@ -0,0 +1,112 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nodekey
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"gitlab.com/gopilot/lib/config"
+)
+
+func TestIdentity(t *testing.T) {
+
+	tempDir, _ := ioutil.TempDir("", "nodekey")
+	defer os.RemoveAll(tempDir)
+	config.ConfigPath = tempDir
+
+	identity, err := IdentityLoad("testnode")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// load it again, must be the same key
+	loaded, err := IdentityLoad("testnode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.PublicKeyString() != identity.PublicKeyString() {
+		t.Fatal("Loaded key differ from created key")
+	}
+
+	signature := loaded.Sign([]byte("data"))
+	if !Verify(identity.PublicKey, []byte("data"), signature) {
+		t.Fatal("Signature is invalid")
+	}
+	if Verify(identity.PublicKey, []byte("other"), signature) {
+		t.Fatal("Signature of other data is valid")
+	}
+}
+
+func TestTrustStore(t *testing.T) {
+
+	tempDir, _ := ioutil.TempDir("", "nodekey")
+	defer os.RemoveAll(tempDir)
+	config.ConfigPath = tempDir
+
+	nodeA, _ := IdentityLoad("nodeA")
+	nodeB, _ := IdentityLoad("nodeB")
+
+	store, err := TrustStoreLoad("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without tofu, unknown nodes are rejected
+	if err := store.Check("nodeA", nodeA.PublicKeyString()); err != ErrNodeUnknown {
+		t.Fatalf("Expected unknown node, got %v", err)
+	}
+
+	// tofu pin the first key
+	store.TOFUSet(true)
+	if err := store.Check("nodeA", nodeA.PublicKeyString()); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Check("nodeA", nodeB.PublicKeyString()); err != ErrKeyMismatch {
+		t.Fatalf("Expected key mismatch, got %v", err)
+	}
+
+	// pre-provisioned
+	if err := store.Trust("nodeB", nodeB.PublicKeyString(), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// the store is saved
+	loaded, err := TrustStoreLoad("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyList := loaded.List()
+	if len(keyList) != 2 || keyList[0].Source != SourceTOFU || keyList[1].Source != SourceManual {
+		t.Fatalf("Unexpected keys %+v", keyList)
+	}
+
+	// revoke
+	if err := loaded.Revoke("nodeA"); err != nil {
+		t.Fatal(err)
+	}
+	loaded.TOFUSet(true)
+	if err := loaded.Check("nodeA", nodeA.PublicKeyString()); err != ErrKeyRevoked {
+		t.Fatalf("Expected revoked key, got %v", err)
+	}
+	if _, err := loaded.Lookup("nodeA"); err != ErrKeyRevoked {
+		t.Fatalf("Expected revoked key, got %v", err)
+	}
+}
@@ -0,0 +1,321 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nodekey
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/gopilot/lib/config"
+	"golang.org/x/crypto/ed25519"
+)
+
+// errors of the trust-store
+var (
+	ErrNodeUnknown = errors.New("Node is not in the trust-store")
+	ErrKeyMismatch = errors.New("Public key of node does not match the pinned key")
+	ErrKeyRevoked  = errors.New("Public key of node was revoked")
+	ErrKeyInvalid  = errors.New("Public key is invalid")
+)
+
+// how a key was added to the store
+const (
+	SourceManual = "manual" // pre-provisioned with Trust()
+	SourceTOFU   = "tofu"   // trust on first use
+)
+
+// TrustedKey is an entry in the trust-store
+type TrustedKey struct {
+	NodeName  string    `json:"node"`
+	PublicKey string    `json:"publicKey"`
+	BoxKey    string    `json:"boxKey,omitempty"`
+	Source    string    `json:"source"`
+	Added     time.Time `json:"added"`
+	Revoked   bool      `json:"revoked,omitempty"`
+}
+
+// TrustStore hold the pinned public keys of other nodes
+//
+// The store is saved to a json-file on every change
+type TrustStore struct {
+	log      *log.Entry
+	filename string
+	tofu     bool
+
+	keysLock sync.Mutex
+	keys     map[string]TrustedKey
+}
+
+// TrustStoreFilename return the default file of the trust-store inside the config-path
+func TrustStoreFilename() string {
+	return filepath.Join(config.ConfigPath, "trusted_nodes.json")
+}
+
+// TrustStoreLoad load the trust-store from filename ( "" means TrustStoreFilename() )
+// if the file not exist, an empty store is returned
+func TrustStoreLoad(filename string) (*TrustStore, error) {
+
+	if filename == "" {
+		filename = TrustStoreFilename()
+	}
+
+	newStore := TrustStore{
+		log: log.WithFields(
+			log.Fields{
+				"prefix": "TRUSTSTORE",
+			},
+		),
+		filename: filename,
+		keys:     make(map[string]TrustedKey),
+	}
+
+	byteValue, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return &newStore, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keyList []TrustedKey
+	if err := json.Unmarshal(byteValue, &keyList); err != nil {
+		return nil, err
+	}
+	for _, key := range keyList {
+		newStore.keys[key.NodeName] = key
+	}
+
+	return &newStore, nil
+}
+
+// TOFUSet enable or disable trust-on-first-use
+// if enabled, an unknown node is pinned with the first key we see
+func (store *TrustStore) TOFUSet(enabled bool) {
+	store.keysLock.Lock()
+	store.tofu = enabled
+	store.keysLock.Unlock()
+}
+
+// List return all keys of the store sorted by nodename
+func (store *TrustStore) List() []TrustedKey {
+
+	store.keysLock.Lock()
+	defer store.keysLock.Unlock()
+
+	var keyList []TrustedKey
+	for _, key := range store.keys {
+		keyList = append(keyList, key)
+	}
+	sort.Slice(keyList, func(i, j int) bool {
+		return keyList[i].NodeName < keyList[j].NodeName
+	})
+
+	return keyList
+}
+
+// Trust will pin the publicKey and the boxKey ( base64 ) of nodeName, an existing or revoked key is replaced
+//
+// boxKey can be "", then it will be pinned on first use
+func (store *TrustStore) Trust(nodeName, publicKey, boxKey string) error {
+
+	if _, err := decodeKey(publicKey); err != nil {
+		return err
+	}
+	if boxKey != "" {
+		if _, err := decodeBoxKey(boxKey); err != nil {
+			return err
+		}
+	}
+
+	store.keysLock.Lock()
+	defer store.keysLock.Unlock()
+
+	store.keys[nodeName] = TrustedKey{
+		NodeName:  nodeName,
+		PublicKey: publicKey,
+		BoxKey:    boxKey,
+		Source:    SourceManual,
+		Added:     time.Now(),
+	}
+	store.log.WithField("node", nodeName).Info("Trust key")
+
+	return store.save()
+}
+
+// Revoke will mark the key of nodeName as revoked
+// the node is rejected until a new key is trusted with Trust()
+func (store *TrustStore) Revoke(nodeName string) error {
+
+	store.keysLock.Lock()
+	defer store.keysLock.Unlock()
+
+	key, exist := store.keys[nodeName]
+	if !exist {
+		return ErrNodeUnknown
+	}
+
+	key.Revoked = true
+	store.keys[nodeName] = key
+	store.log.WithField("node", nodeName).Info("Revoke key")
+
+	return store.save()
+}
+
+// Lookup return the pinned key of nodeName
+func (store *TrustStore) Lookup(nodeName string) (ed25519.PublicKey, error) {
+
+	store.keysLock.Lock()
+	key, exist := store.keys[nodeName]
+	store.keysLock.Unlock()
+
+	if !exist {
+		return nil, ErrNodeUnknown
+	}
+	if key.Revoked {
+		return nil, ErrKeyRevoked
+	}
+
+	return decodeKey(key.PublicKey)
+}
+
+// LookupBoxKey return the pinned box-key of nodeName
+func (store *TrustStore) LookupBoxKey(nodeName string) (*[32]byte, error) {
+
+	store.keysLock.Lock()
+	key, exist := store.keys[nodeName]
+	store.keysLock.Unlock()
+
+	if !exist || key.BoxKey == "" {
+		return nil, ErrNodeUnknown
+	}
+	if key.Revoked {
+		return nil, ErrKeyRevoked
+	}
+
+	return decodeBoxKey(key.BoxKey)
+}
+
+// CheckBoxKey will check the boxKey ( base64 ) which nodeName present to us
+//
+// The node must be already known by Check(), the first box-key is pinned
+// The caller must ensure that the boxKey was signed by the node
+func (store *TrustStore) CheckBoxKey(nodeName, boxKey string) error {
+
+	if _, err := decodeBoxKey(boxKey); err != nil {
+		return err
+	}
+
+	store.keysLock.Lock()
+	defer store.keysLock.Unlock()
+
+	key, exist := store.keys[nodeName]
+	if !exist {
+		return ErrNodeUnknown
+	}
+	if key.Revoked {
+		return ErrKeyRevoked
+	}
+	if key.BoxKey == boxKey {
+		return nil
+	}
+	if key.BoxKey != "" {
+		store.log.WithField("node", nodeName).Warn(ErrKeyMismatch)
+		return ErrKeyMismatch
+	}
+
+	key.BoxKey = boxKey
+	store.keys[nodeName] = key
+	store.log.WithField("node", nodeName).Info("Pin box-key")
+
+	return store.save()
+}
+
+// Check will check the publicKey ( base64 ) which nodeName present to us
+//
+// If the node is unknown and TOFU is enabled, the key will be pinned
+func (store *TrustStore) Check(nodeName, publicKey string) error {
+
+	if _, err := decodeKey(publicKey); err != nil {
+		return err
+	}
+
+	store.keysLock.Lock()
+	defer store.keysLock.Unlock()
+
+	key, exist := store.keys[nodeName]
+	if !exist {
+		if !store.tofu {
+			return ErrNodeUnknown
+		}
+
+		store.keys[nodeName] = TrustedKey{
+			NodeName:  nodeName,
+			PublicKey: publicKey,
+			Source:    SourceTOFU,
+			Added:     time.Now(),
+		}
+		store.log.WithField("node", nodeName).Info("Pin key on first use")
+		return store.save()
+	}
+
+	if key.Revoked {
+		return ErrKeyRevoked
+	}
+	if key.PublicKey != publicKey {
+		store.log.WithField("node", nodeName).Warn(ErrKeyMismatch)
+		return ErrKeyMismatch
+	}
+
+	return nil
+}
+
+// save write the store to the file, keysLock must be held
+func (store *TrustStore) save() error {
+
+	var keyList []TrustedKey
+	for _, key := range store.keys {
+		keyList = append(keyList, key)
+	}
+	sort.Slice(keyList, func(i, j int) bool {
+		return keyList[i].NodeName < keyList[j].NodeName
+	})
+
+	byteValue, _ := json.MarshalIndent(keyList, "", "    ")
+	err := ioutil.WriteFile(store.filename, byteValue, 0644)
+	if err != nil {
+		store.log.Error(err)
+	}
+	return err
+}
+
+func decodeKey(publicKey string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, ErrKeyInvalid
+	}
+	return ed25519.PublicKey(key), nil
+}